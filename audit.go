@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Privilege used for ownership of objects and membership of roles in the
+// privilege inventory.
+const (
+	PRIVILEGE_OWNER  = "OWNER"
+	PRIVILEGE_MEMBER = "MEMBER"
+)
+
+// PrivilegeRecord is a single privilege of a grantee on an object, in a form
+// that is the same for every type of database.
+type PrivilegeRecord struct {
+	DatabaseId   int    `json:"database_id"`
+	DatabaseName string `json:"database_name"`
+	ConnectionId int    `json:"connection_id"`
+	DbName       string `json:"db_name"`
+	Grantee      string `json:"grantee"`
+	Managed      bool   `json:"managed"`
+	ObjectType   string `json:"object_type"`
+	Object       string `json:"object"`
+	Privilege    string `json:"privilege"`
+	Grantable    bool   `json:"grantable"`
+	// Via is the role the privilege is held through, empty when it was
+	// granted directly.
+	Via string `json:"via"`
+}
+
+var privilegeCsvHeader = []string{
+	"database_id", "database_name", "connection_id", "db_name", "grantee",
+	"managed", "object_type", "object", "privilege", "grantable", "via",
+}
+
+func (rec *PrivilegeRecord) csvRow() []string {
+	return []string{
+		strconv.Itoa(rec.DatabaseId), rec.DatabaseName, strconv.Itoa(rec.ConnectionId),
+		rec.DbName, rec.Grantee, strconv.FormatBool(rec.Managed), rec.ObjectType,
+		rec.Object, rec.Privilege, strconv.FormatBool(rec.Grantable), rec.Via,
+	}
+}
+
+// RoleMembership means that Member is granted Role.
+type RoleMembership struct {
+	Role   string
+	Member string
+}
+
+// PrivilegeInventory holds the privileges granted directly to each grantee
+// of a database along with the role memberships. ServerWide is set when the
+// inventory covers the whole server rather than the connected database, in
+// which case it is only gathered once per database.
+type PrivilegeInventory struct {
+	Privileges  []*PrivilegeRecord
+	Memberships []RoleMembership
+	ServerWide  bool
+}
+
+// rolesOf returns every role the member belongs to, directly or not, mapped
+// to the role granted directly to the member that leads to it.
+func (inv *PrivilegeInventory) rolesOf(member string) map[string]string {
+	direct := map[string][]string{}
+	for _, ms := range inv.Memberships {
+		direct[ms.Member] = append(direct[ms.Member], ms.Role)
+	}
+	reached := map[string]string{}
+	var visit func(string, string)
+	visit = func(grantee string, through string) {
+		for _, role := range direct[grantee] {
+			if _, seen := reached[role]; seen || role == member {
+				continue
+			}
+			via := through
+			if via == "" {
+				via = role
+			}
+			reached[role] = via
+			visit(role, via)
+		}
+	}
+	visit(member, "")
+	return reached
+}
+
+// effective expands the inventory into the privileges every grantee holds,
+// including those inherited through roles and the memberships themselves.
+func (inv *PrivilegeInventory) effective() []*PrivilegeRecord {
+	byGrantee := map[string][]*PrivilegeRecord{}
+	grantees := map[string]bool{}
+	for _, rec := range inv.Privileges {
+		byGrantee[rec.Grantee] = append(byGrantee[rec.Grantee], rec)
+		grantees[rec.Grantee] = true
+	}
+	for _, ms := range inv.Memberships {
+		grantees[ms.Member] = true
+	}
+	records := append([]*PrivilegeRecord{}, inv.Privileges...)
+	for grantee := range grantees {
+		for role, firstHop := range inv.rolesOf(grantee) {
+			via := ""
+			if firstHop != role {
+				via = firstHop
+			}
+			records = append(records, &PrivilegeRecord{
+				Grantee:    grantee,
+				ObjectType: "role",
+				Object:     role,
+				Privilege:  PRIVILEGE_MEMBER,
+				Via:        via,
+			})
+			for _, rec := range byGrantee[role] {
+				inherited := *rec
+				inherited.Grantee = grantee
+				inherited.Via = role
+				records = append(records, &inherited)
+			}
+		}
+	}
+	sortPrivilegeRecords(records)
+	return records
+}
+
+func sortPrivilegeRecords(records []*PrivilegeRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		keysA := []string{a.Grantee, a.ObjectType, a.Object, a.Privilege, a.Via}
+		keysB := []string{b.Grantee, b.ObjectType, b.Object, b.Privilege, b.Via}
+		for k := range keysA {
+			if keysA[k] != keysB[k] {
+				return keysA[k] < keysB[k]
+			}
+		}
+		return false
+	})
+}
+
+// isManagedGrantee tells whether the grantee is one of the users, given as
+// MySQL accounts (user@host) or plain usernames.
+func isManagedGrantee(grantee string, usernames map[string]bool) bool {
+	if usernames[grantee] {
+		return true
+	}
+	return strings.HasSuffix(grantee, "@"+MYSQL_USER_HOST) &&
+		usernames[strings.TrimSuffix(grantee, "@"+MYSQL_USER_HOST)]
+}
+
+// auditConnections gathers the effective privileges on every connection of
+// the grants response. Connections that cannot be audited are logged and
+// skipped.
+func auditConnections(app *Application, grantsResponse *GrantsResponse) []*PrivilegeRecord {
+	records := []*PrivilegeRecord{}
+	serverWideDone := map[int]bool{}
+	for i := range grantsResponse.Connections {
+		conn := &grantsResponse.Connections[i]
+		if serverWideDone[conn.Database.Id] {
+			continue
+		}
+		regItem := openConnection(app, conn)
+		if regItem.Error != nil {
+			regItem.close()
+			logger.Errorf("Could not audit connection %d: %s", conn.Id, regItem.Error)
+			continue
+		}
+		inventory, err := regItem.Impl.privilegeInventory()
+		regItem.close()
+		if err != nil {
+			logger.Errorf("Could not audit connection %d: %s", conn.Id, err)
+			continue
+		}
+		if inventory.ServerWide {
+			serverWideDone[conn.Database.Id] = true
+		}
+		managed := grantsResponse.usernamesForDatabase(conn.Database.Id)
+		for _, rec := range inventory.effective() {
+			rec.DatabaseId = conn.Database.Id
+			rec.DatabaseName = conn.Database.Name
+			rec.ConnectionId = conn.Id
+			rec.DbName = conn.DbName
+			rec.Managed = isManagedGrantee(rec.Grantee, managed)
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// auditTargets returns the connections to audit, preferring the ones of the
+// server and falling back to the cached ones when it cannot be reached.
+func auditTargets(app *Application) *GrantsResponse {
+	if app.conf.AccessToken != "" {
+		grantsResponse, _, err := fetchGrants(app, "")
+		if err == nil {
+			return grantsResponse
+		}
+		logger.Warningf("Could not fetch grants, auditing cached connections: %s", err)
+	}
+	return &GrantsResponse{Connections: app.state.cachedConnections()}
+}
+
+func writePrivilegeRecords(w io.Writer, format string, records []*PrivilegeRecord) error {
+	if format == "csv" {
+		writer := csv.NewWriter(w)
+		if err := writer.Write(privilegeCsvHeader); err != nil {
+			return err
+		}
+		for _, rec := range records {
+			if err := writer.Write(rec.csvRow()); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(records)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAclItems(t *testing.T) {
+	items := splitAclItems(`alice=arwdDxt/alice,"bob, jr"=r*/alice,=U/alice,group "my ""g"""=r/alice`)
+	assert.Len(t, items, 4)
+
+	entries, err := parseAclItem(items[1])
+	assert.Nil(t, err)
+	assert.Equal(t, []pgAclEntry{{Grantee: "bob, jr", Privilege: "SELECT", Grantable: true}}, entries)
+
+	entries, err = parseAclItem(items[2])
+	assert.Nil(t, err)
+	assert.Equal(t, []pgAclEntry{{Grantee: PG_PUBLIC_GRANTEE, Privilege: "USAGE"}}, entries)
+
+	entries, err = parseAclItem(items[3])
+	assert.Nil(t, err)
+	assert.Equal(t, `group my "g"`, entries[0].Grantee)
+
+	_, err = parseAclItem("garbage")
+	assert.Error(t, err)
+
+	records, err := aclRecords("table", "public.t", "alice", sql.NullString{})
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, PRIVILEGE_OWNER, records[0].Privilege)
+
+	acl := sql.NullString{String: "bob=r/alice", Valid: true}
+	records, err = aclRecords("column", "public.t.x", "", acl)
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "bob", records[0].Grantee)
+	assert.Equal(t, "SELECT", records[0].Privilege)
+}
+
+func TestEffectivePrivileges(t *testing.T) {
+	inventory := &PrivilegeInventory{
+		Privileges: []*PrivilegeRecord{
+			{Grantee: "readers", ObjectType: "table", Object: "public.t", Privilege: "SELECT"},
+		},
+		Memberships: []RoleMembership{
+			{Role: "readers", Member: "analysts"},
+			{Role: "analysts", Member: "alice"},
+		},
+	}
+	var alice []string
+	for _, rec := range inventory.effective() {
+		if rec.Grantee == "alice" {
+			alice = append(alice, rec.ObjectType+" "+rec.Object+" "+rec.Privilege+" "+rec.Via)
+		}
+	}
+	assert.Equal(t, []string{
+		"role analysts MEMBER ",
+		"role readers MEMBER analysts",
+		"table public.t SELECT readers",
+	}, alice)
+}
+
+func TestWritePrivilegeRecords(t *testing.T) {
+	records := []*PrivilegeRecord{
+		{DatabaseName: "db", Grantee: "bob@%", Managed: true, ObjectType: "global",
+			Object: "*.*", Privilege: "SELECT"},
+	}
+	var out bytes.Buffer
+	assert.Nil(t, writePrivilegeRecords(&out, "csv", records))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "0,db,0,,bob@%,true,global,*.*,SELECT,false,", lines[1])
+
+	out.Reset()
+	assert.Nil(t, writePrivilegeRecords(&out, "json", records))
+	assert.Contains(t, out.String(), `"grantee": "bob@%"`)
+	assert.True(t, isManagedGrantee("bob@%", map[string]bool{"bob": true}))
+	assert.False(t, isManagedGrantee("bob@localhost", map[string]bool{"bob": true}))
+}
+
+func TestPrivilegeDrift(t *testing.T) {
+	inventory := &PrivilegeInventory{
+		Privileges: []*PrivilegeRecord{
+			{Grantee: "bob", ObjectType: "table", Object: "public.t", Privilege: "SELECT"},
+			{Grantee: "bob", ObjectType: "table", Object: "public.u", Privilege: PRIVILEGE_OWNER},
+			{Grantee: "bob", ObjectType: "schema", Object: "public", Privilege: "USAGE", Grantable: true},
+		},
+		Memberships: []RoleMembership{{Role: "readers", Member: "bob"}},
+	}
+	current := privilegeKeys(inventory, "bob")
+	assert.Equal(t, []string{
+		"MEMBER of role readers",
+		"SELECT on table public.t",
+		"USAGE on schema public with grant option",
+	}, current)
+
+	added, removed := diffPrivilegeKeys([]string{"SELECT on table public.t", "UPDATE on table public.t"}, current)
+	assert.Equal(t, []string{"MEMBER of role readers", "USAGE on schema public with grant option"}, added)
+	assert.Equal(t, []string{"UPDATE on table public.t"}, removed)
+	assert.Equal(t, "+ a\n- b", formatPrivilegeDiff([]string{"a"}, []string{"b"}))
+}
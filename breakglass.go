@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// cachedDatabase returns the cached connections of the database with the
+// given name, without connecting to them.
+func cachedDatabase(app *Application, databaseName string) (*GrantsResponse, error) {
+	conns := app.state.cachedConnectionsForDatabase(databaseName)
+	if len(conns) == 0 {
+		msg := fmt.Sprintf("No cached connection found for database %s", databaseName)
+		return nil, errors.New(msg)
+	}
+	return &GrantsResponse{Connections: conns}, nil
+}
+
+// openCachedConnections connects to the given cached connections. Those
+// that cannot be opened are left in the registry with their error. The
+// registry must be closed by the caller.
+func openCachedConnections(app *Application, conns []*Connection) ConnRegistry {
+	connRegistry := ConnRegistry{}
+	for _, conn := range conns {
+		connRegistry[conn.Id] = openConnection(app, conn)
+	}
+	return connRegistry
+}
+
+func closeRegistry(connRegistry ConnRegistry) {
+	for _, item := range connRegistry {
+		item.close()
+	}
+}
+
+// revokeOnConnection revokes everything the user has on one connection.
+func revokeOnConnection(app *Application, item *RegistryItem, user *User, drop bool) error {
+	if item.Error != nil {
+		return item.Error
+	}
+	logger.Infof("(%s) Revoking everything for %s in %s", item.Impl.getName(),
+		user.Username, item.Conn.DbName)
+	if err := item.Impl.revokeEverything(userGrantee(user.Username)); err != nil {
+		return err
+	}
+	if drop && app.conf.DropStrategy == DROP_STRATEGY_REASSIGN {
+		return item.Impl.reassignOwned(user, app.conf.ReassignOwnedTo)
+	}
+	return nil
+}
+
+// revokeUserLocally is the break-glass revocation of a user: it does not
+// involve the server at all. The tombstone is recorded before connecting to
+// anything, so that neither a slow nor a partial failure keeps the next
+// grant cycles from restoring access, and the user is then revoked on every
+// connection that can be reached.
+func revokeUserLocally(app *Application, databaseName string, username string, drop bool) error {
+	grantsResponse, err := cachedDatabase(app, databaseName)
+	if err != nil {
+		return err
+	}
+	databaseId := grantsResponse.Connections[0].Database.Id
+	err = app.state.addTombstone(&Tombstone{
+		DatabaseId:   databaseId,
+		DatabaseName: databaseName,
+		Username:     username,
+		Dropped:      drop,
+		CreatedAt:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	conns := []*Connection{}
+	for i := range grantsResponse.Connections {
+		conns = append(conns, &grantsResponse.Connections[i])
+	}
+	connRegistry := openCachedConnections(app, conns)
+	defer closeRegistry(connRegistry)
+	user := &User{Username: username, DatabaseId: databaseId}
+	failures := []string{}
+	for _, item := range connRegistry.forDatabase(databaseId) {
+		if err := revokeOnConnection(app, item, user, drop); err != nil {
+			logger.Errorf("Could not revoke %s in %s: %s", username, item.Conn.DbName, err)
+			failures = append(failures, fmt.Sprintf("%s: %s", item.Conn.DbName, err))
+		}
+	}
+	conn, err := grantsResponse.defaultConnection(databaseId)
+	if err != nil {
+		return err
+	}
+	item := connRegistry[conn.Id]
+	if item.Error != nil {
+		failures = append(failures, fmt.Sprintf("could not lock or drop %s: %s", username, item.Error))
+	} else if drop {
+		logger.Infof("(%s) Dropping user %s", item.Impl.getName(), username)
+		if err := item.Impl.dropUser(user); err != nil {
+			failures = append(failures, fmt.Sprintf("could not drop %s: %s", username, err))
+		}
+	} else {
+		logger.Infof("(%s) Locking user %s", item.Impl.getName(), username)
+		if err := item.Impl.lockUser(user); err != nil {
+			failures = append(failures, fmt.Sprintf("could not lock %s: %s", username, err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New(fmt.Sprintf("The tombstone is recorded, but the revocation is incomplete: %s",
+			strings.Join(failures, "; ")))
+	}
+	return nil
+}
+
+// clearTombstone lets the grant cycles manage the user again. A user that
+// was locked rather than dropped is unlocked right away, through the
+// default connection only.
+func clearTombstone(app *Application, databaseName string, username string) error {
+	grantsResponse, err := cachedDatabase(app, databaseName)
+	if err != nil {
+		return err
+	}
+	databaseId := grantsResponse.Connections[0].Database.Id
+	tombstone := app.state.tombstone(databaseId, username)
+	if tombstone == nil {
+		return errors.New(fmt.Sprintf("No tombstone found for %s in %s", username, databaseName))
+	}
+	if !tombstone.Dropped {
+		conn, err := grantsResponse.defaultConnection(databaseId)
+		if err != nil {
+			return err
+		}
+		connRegistry := openCachedConnections(app, []*Connection{conn})
+		defer closeRegistry(connRegistry)
+		item := connRegistry[conn.Id]
+		if item.Error != nil {
+			return item.Error
+		}
+		user := &User{Username: username, DatabaseId: databaseId}
+		if err := item.Impl.unlockUser(user); err != nil {
+			return err
+		}
+	}
+	return app.state.removeTombstone(databaseId, username)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevokeUserLocallyUnreachable(t *testing.T) {
+	state := newAgentState("")
+	db := &Database{Id: 3, Name: "legacy", Type: "sybase"}
+	assert.Nil(t, state.cacheConnections([]Connection{{Id: 1, Database: db, DbName: "app"}}))
+	app := &Application{conf: &Config{}, state: state}
+
+	// The tombstone is recorded even though no connection can be opened.
+	err := revokeUserLocally(app, "legacy", "bob", false)
+	assert.Contains(t, err.Error(), "the revocation is incomplete")
+	assert.Contains(t, err.Error(), "app: Unknown database type: sybase")
+	assert.True(t, state.isTombstoned(3, "bob"))
+
+	assert.NotNil(t, clearTombstone(app, "legacy", "bob"))
+	assert.True(t, state.isTombstoned(3, "bob"))
+}
+
+// silentDatabase caches a connection to a server that accepts connections
+// but never answers, like a host that does not respond, so that connecting
+// blocks until the listener and the accepted connections are closed.
+func silentDatabase(t *testing.T, state *AgentState) (net.Listener, chan net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	accepted := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	db := &Database{
+		Id:                3,
+		Name:              "pg_test",
+		Type:              "postgresql",
+		Host:              "127.0.0.1",
+		Port:              listener.Addr().(*net.TCPAddr).Port,
+		Username:          "master",
+		EncryptedPassword: sealTestPassword("secret"),
+	}
+	assert.Nil(t, state.cacheConnections([]Connection{{Id: 1, Database: db, DbName: "app"}}))
+	return listener, accepted
+}
+
+func TestRevokeUserLocallyRecordsTombstoneFirst(t *testing.T) {
+	state := newAgentState("")
+	listener, accepted := silentDatabase(t, state)
+	app := &Application{conf: &Config{}, key: testAgentKey, state: state}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- revokeUserLocally(app, "pg_test", "bob", false)
+	}()
+	// The client is connected, and waits for an answer.
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The database was never connected to")
+	}
+	assert.True(t, state.isTombstoned(3, "bob"))
+	select {
+	case <-done:
+		t.Fatal("The revocation returned before the connection failed")
+	default:
+	}
+
+	listener.Close()
+	conn.Close()
+	err := <-done
+	assert.Contains(t, err.Error(), "the revocation is incomplete")
+	assert.True(t, state.isTombstoned(3, "bob"))
+}
+
+func TestClearDroppedTombstoneWithoutConnecting(t *testing.T) {
+	state := newAgentState("")
+	listener, accepted := silentDatabase(t, state)
+	defer listener.Close()
+	app := &Application{conf: &Config{}, key: testAgentKey, state: state}
+	assert.Nil(t, state.addTombstone(&Tombstone{DatabaseId: 3, Username: "bob", Dropped: true}))
+
+	assert.Nil(t, clearTombstone(app, "pg_test", "bob"))
+	assert.False(t, state.isTombstoned(3, "bob"))
+	assert.Equal(t, 0, len(accepted))
+}
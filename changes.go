@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Between cycles, the agent long-polls the server for changes of the
+// grants:
+//
+//	GET /api/grants/changes?revision=<revision>&wait=<seconds>
+//	    -> {"revision": "<current revision>", "changed": true | false}
+//
+// The server answers as soon as the revision differs from the given one, or
+// with changed false once the wait is over. A change starts a cycle right
+// away. Grants are still polled, less often while long-polling works and
+// as before when it does not, such as with servers that answer 404.
+const (
+	CHANGES_WAIT = 55 * time.Second
+	// CHANGES_RETRY_INTERVAL is the pause after a failed long-poll, and
+	// CHANGES_UNSUPPORTED_RETRY_INTERVAL the one after a 404.
+	CHANGES_RETRY_INTERVAL             = 30 * time.Second
+	CHANGES_UNSUPPORTED_RETRY_INTERVAL = 10 * time.Minute
+
+	POLL_INTERVAL = 30 * time.Second
+	// PUSH_POLL_INTERVAL is the poll interval while long-polling works,
+	// as a safety net for missed changes.
+	PUSH_POLL_INTERVAL = 5 * time.Minute
+)
+
+type ChangesResponse struct {
+	Revision string `json:"revision"`
+	Changed  bool   `json:"changed"`
+}
+
+// watchedRevision is the revision of the last fetched grants, along with
+// the key to sign the long-polls with.
+type watchedRevision struct {
+	revision string
+	key      AgentKey
+}
+
+// ChangeWatcher long-polls in its own goroutine, which shares nothing with
+// the cycles but the channel and what update stores.
+type ChangeWatcher struct {
+	conf   *Config
+	client *http.Client
+	wait   time.Duration
+	retry  time.Duration
+	// unsupportedRetry is the pause after a 404.
+	unsupportedRetry time.Duration
+	current          atomic.Value
+	healthy          atomic.Bool
+	changes          chan struct{}
+	stop             chan struct{}
+}
+
+// newChangeWatcher must be called before the watcher starts, as it builds
+// the shared client of the configuration.
+func newChangeWatcher(conf *Config) (*ChangeWatcher, error) {
+	base, err := conf.dbrhinoClient()
+	if err != nil {
+		return nil, err
+	}
+	// The client shares the connections of the other requests, with a
+	// timeout allowing for the wait.
+	client := *base
+	client.Timeout = base.Timeout + CHANGES_WAIT
+	return &ChangeWatcher{
+		conf:             conf,
+		client:           &client,
+		wait:             CHANGES_WAIT,
+		retry:            CHANGES_RETRY_INTERVAL,
+		unsupportedRetry: CHANGES_UNSUPPORTED_RETRY_INTERVAL,
+		changes:          make(chan struct{}, 1),
+		stop:             make(chan struct{}),
+	}, nil
+}
+
+// update is called by the cycles with the revision of the grants they
+// fetched.
+func (w *ChangeWatcher) update(revision string, key AgentKey) {
+	w.current.Store(&watchedRevision{revision: revision, key: key})
+}
+
+func (w *ChangeWatcher) notify() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (w *ChangeWatcher) pause(duration time.Duration) bool {
+	select {
+	case <-w.stop:
+		return false
+	case <-time.After(duration):
+		return true
+	}
+}
+
+func (w *ChangeWatcher) setHealthy(healthy bool) {
+	// Losing long-polling wakes the cycles up, so that they go back to the
+	// shorter poll interval.
+	if w.healthy.Swap(healthy) && !healthy {
+		w.notify()
+	}
+}
+
+func (w *ChangeWatcher) poll(current *watchedRevision, revision string) (*ChangesResponse, error) {
+	query := url.Values{}
+	query.Set("revision", revision)
+	query.Set("wait", strconv.Itoa(int(w.wait.Seconds())))
+	app := &Application{conf: w.conf, key: current.key}
+	result := &ChangesResponse{}
+	_, err := dbrhinoRequestWithClient(app, w.client, http.MethodGet,
+		"/api/grants/changes?"+query.Encode(), nil, nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (w *ChangeWatcher) run() {
+	var last *watchedRevision
+	var revision string
+	unsupported := false
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+		current, _ := w.current.Load().(*watchedRevision)
+		// Servers without revisions cannot be long-polled.
+		if current == nil || current.revision == "" {
+			w.setHealthy(false)
+			if !w.pause(w.retry) {
+				return
+			}
+			continue
+		}
+		// The revision seen by the watcher is kept until the cycle it
+		// started fetched the grants.
+		if current != last {
+			last = current
+			revision = current.revision
+		}
+		result, err := w.poll(current, revision)
+		if statusErr, ok := err.(*HttpStatusError); ok && statusErr.StatusCode == http.StatusNotFound {
+			if !unsupported {
+				logger.Infof("The server does not support long-polling, polling every %s", POLL_INTERVAL)
+			}
+			unsupported = true
+			w.setHealthy(false)
+			if !w.pause(w.unsupportedRetry) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			logger.Warningf("Could not long-poll the grants, polling every %s: %s", POLL_INTERVAL, err)
+			w.setHealthy(false)
+			if !w.pause(w.retry) {
+				return
+			}
+			continue
+		}
+		unsupported = false
+		w.setHealthy(true)
+		if result.Changed && result.Revision != revision {
+			logger.Debugf("The grants changed to revision %s", result.Revision)
+			revision = result.Revision
+			w.notify()
+		}
+	}
+}
+
+func (w *ChangeWatcher) start() {
+	go w.run()
+}
+
+func (w *ChangeWatcher) close() {
+	close(w.stop)
+}
+
+// startWatchingChanges starts the watcher unless long-polling is disabled.
+func (app *Application) startWatchingChanges() {
+	if !app.conf.LongPoll {
+		return
+	}
+	watcher, err := newChangeWatcher(app.conf)
+	if err != nil {
+		logger.Errorf("Could not long-poll the grants: %s", err)
+		return
+	}
+	app.watcher = watcher
+	watcher.start()
+}
+
+// pollInterval is the time between cycles when nothing changes.
+func (app *Application) pollInterval() time.Duration {
+	if app.watcher != nil && app.watcher.healthy.Load() {
+		return PUSH_POLL_INTERVAL
+	}
+	return POLL_INTERVAL
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// changesServer answers long-polls like the DbRhino server, holding them
+// until its revision differs from the one of the agent.
+type changesServer struct {
+	sync.Mutex
+	revision string
+	status   int
+	changed  chan struct{}
+	polls    []string
+}
+
+func newChangesServer(revision string) *changesServer {
+	return &changesServer{revision: revision, status: http.StatusOK, changed: make(chan struct{})}
+}
+
+func (cs *changesServer) setRevision(revision string) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.revision = revision
+	close(cs.changed)
+	cs.changed = make(chan struct{})
+}
+
+func (cs *changesServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/grants/changes" {
+		http.NotFound(w, r)
+		return
+	}
+	revision := r.URL.Query().Get("revision")
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait") + "s")
+	cs.Lock()
+	cs.polls = append(cs.polls, revision)
+	status, current, changed := cs.status, cs.revision, cs.changed
+	cs.Unlock()
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		return
+	}
+	if current == revision {
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+		cs.Lock()
+		current = cs.revision
+		cs.Unlock()
+	}
+	json.NewEncoder(w).Encode(&ChangesResponse{Revision: current, Changed: current != revision})
+}
+
+func (cs *changesServer) pollCount() int {
+	cs.Lock()
+	defer cs.Unlock()
+	return len(cs.polls)
+}
+
+func startTestWatcher(t *testing.T, url string) *ChangeWatcher {
+	watcher, err := newChangeWatcher(&Config{ServerUrl: url, LongPoll: true})
+	assert.Nil(t, err)
+	watcher.wait = time.Second
+	watcher.retry = 50 * time.Millisecond
+	watcher.unsupportedRetry = time.Hour
+	watcher.start()
+	return watcher
+}
+
+func waitForChange(watcher *ChangeWatcher, timeout time.Duration) bool {
+	select {
+	case <-watcher.changes:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestChangeWatcher(t *testing.T) {
+	cs := newChangesServer("1")
+	server := httptest.NewServer(cs)
+	defer server.Close()
+	watcher := startTestWatcher(t, server.URL)
+	defer watcher.close()
+	app := &Application{conf: watcher.conf, state: newAgentState(""), watcher: watcher}
+	assert.Equal(t, POLL_INTERVAL, app.pollInterval())
+
+	// Nothing is polled until the first cycle fetched a revision.
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, cs.pollCount())
+	watcher.update("1", nil)
+	assert.False(t, waitForChange(watcher, 1500*time.Millisecond))
+	assert.Equal(t, PUSH_POLL_INTERVAL, app.pollInterval())
+
+	// A change ends the wait for the next cycle right away.
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cs.setRevision("2")
+	}()
+	started := time.Now()
+	app.waitForNextCycle(time.Minute)
+	assert.True(t, time.Since(started) < time.Second)
+	// The watcher waits on the new revision until the cycle fetched it.
+	assert.False(t, waitForChange(watcher, 300*time.Millisecond))
+	watcher.update("2", nil)
+	cs.setRevision("3")
+	assert.True(t, waitForChange(watcher, time.Second))
+
+	// Failures wake the cycles up, which go back to polling.
+	cs.Lock()
+	cs.status = http.StatusServiceUnavailable
+	cs.Unlock()
+	assert.True(t, waitForChange(watcher, 2*time.Second))
+	assert.Equal(t, POLL_INTERVAL, app.pollInterval())
+}
+
+func TestChangeWatcherUnsupported(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	watcher := startTestWatcher(t, server.URL)
+	defer watcher.close()
+	watcher.update("1", nil)
+	assert.False(t, waitForChange(watcher, 200*time.Millisecond))
+	app := &Application{conf: watcher.conf, watcher: watcher}
+	assert.Equal(t, POLL_INTERVAL, app.pollInterval())
+
+	// Servers that do not send revisions are not long-polled.
+	cs := newChangesServer("1")
+	other := httptest.NewServer(cs)
+	defer other.Close()
+	watcher = startTestWatcher(t, other.URL)
+	defer watcher.close()
+	watcher.update("", nil)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 0, cs.pollCount())
+}
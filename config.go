@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -16,8 +24,118 @@ const (
 	ENV_DEBUG      = "DBRHINO_AGENT_DEBUG"
 	ENV_SERVER_URL = "DBRHINO_AGENT_SERVER_URL"
 	ENV_LOG_PATH   = "DBRHINO_AGENT_LOG_PATH"
+
+	ENV_DROP_STRATEGY     = "DBRHINO_AGENT_DROP_STRATEGY"
+	ENV_REASSIGN_OWNED_TO = "DBRHINO_AGENT_REASSIGN_OWNED_TO"
+
+	// DROP_STRATEGY_REVOKE revokes the privileges of a user before dropping
+	// it, which fails if the user still owns objects. DROP_STRATEGY_REASSIGN
+	// first reassigns everything the user owns in every database the agent
+	// has a connection for and then drops whatever is left. Redshift does not
+	// support reassigning.
+	DROP_STRATEGY_REVOKE   = "revoke"
+	DROP_STRATEGY_REASSIGN = "reassign"
+
+	ENV_IGNORED_USERS   = "DBRHINO_AGENT_IGNORED_USERS"
+	ENV_UNMANAGED_USERS = "DBRHINO_AGENT_UNMANAGED_USERS"
+
+	// Unmanaged users are always reported, and locked as well with
+	// UNMANAGED_USERS_LOCK.
+	UNMANAGED_USERS_REPORT = "report"
+	UNMANAGED_USERS_LOCK   = "lock"
+
+	ENV_DRIFT = "DBRHINO_AGENT_DRIFT"
+
+	// DRIFT_REPORT reports privileges that changed since the last apply and
+	// still applies every grant on every cycle. DRIFT_HEAL only applies a
+	// grant again when it changed or drifted.
+	DRIFT_OFF    = "off"
+	DRIFT_REPORT = "report"
+	DRIFT_HEAL   = "heal"
+
+	ENV_PASSWORDS         = "DBRHINO_AGENT_PASSWORDS"
+	ENV_PASSWORD_LENGTH   = "DBRHINO_AGENT_PASSWORD_LENGTH"
+	ENV_PASSWORD_SYMBOLS  = "DBRHINO_AGENT_PASSWORD_SYMBOLS"
+	ENV_PASSWORD_ROTATION = "DBRHINO_AGENT_PASSWORD_ROTATION"
+	ENV_PASSWORD_FILE_DIR = "DBRHINO_AGENT_PASSWORD_FILE_DIR"
+	ENV_PASSWORD_COMMAND  = "DBRHINO_AGENT_PASSWORD_COMMAND"
+
+	ENV_VAULT_ADDR          = "DBRHINO_AGENT_VAULT_ADDR"
+	ENV_VAULT_NAMESPACE     = "DBRHINO_AGENT_VAULT_NAMESPACE"
+	ENV_VAULT_TOKEN         = "DBRHINO_AGENT_VAULT_TOKEN"
+	ENV_VAULT_ROLE_ID       = "DBRHINO_AGENT_VAULT_ROLE_ID"
+	ENV_VAULT_SECRET_ID     = "DBRHINO_AGENT_VAULT_SECRET_ID"
+	ENV_VAULT_APPROLE_MOUNT = "DBRHINO_AGENT_VAULT_APPROLE_MOUNT"
+	ENV_VAULT_MOUNT         = "DBRHINO_AGENT_VAULT_MOUNT"
+	ENV_VAULT_PATH          = "DBRHINO_AGENT_VAULT_PATH"
+	ENV_VAULT_CA_BUNDLE     = "DBRHINO_AGENT_VAULT_CA_BUNDLE"
+
+	ENV_KEY_ROTATION = "DBRHINO_AGENT_KEY_ROTATION"
+	ENV_KEY_TYPE     = "DBRHINO_AGENT_KEY_TYPE"
+
+	ENV_KEY_PASSPHRASE         = "DBRHINO_AGENT_KEY_PASSPHRASE"
+	ENV_KEY_PASSPHRASE_FILE    = "DBRHINO_AGENT_KEY_PASSPHRASE_FILE"
+	ENV_KEY_PASSPHRASE_COMMAND = "DBRHINO_AGENT_KEY_PASSPHRASE_COMMAND"
+	ENV_KEY_SIGNER             = "DBRHINO_AGENT_KEY_SIGNER"
+
+	ENV_HTTP_TIMEOUT         = "DBRHINO_AGENT_HTTP_TIMEOUT"
+	ENV_HTTP_CONNECT_TIMEOUT = "DBRHINO_AGENT_HTTP_CONNECT_TIMEOUT"
+	ENV_CA_BUNDLE            = "DBRHINO_AGENT_CA_BUNDLE"
+	ENV_CLIENT_CERT          = "DBRHINO_AGENT_CLIENT_CERT"
+	ENV_CLIENT_KEY           = "DBRHINO_AGENT_CLIENT_KEY"
+	ENV_SERVER_PINS          = "DBRHINO_AGENT_SERVER_PINS"
+
+	ENV_SIGN_REQUESTS      = "DBRHINO_AGENT_SIGN_REQUESTS"
+	ENV_SERVER_SIGNING_KEY = "DBRHINO_AGENT_SERVER_SIGNING_KEY"
+
+	ENV_LONG_POLL = "DBRHINO_AGENT_LONG_POLL"
+
+	ENV_RECONCILE_INTERVAL   = "DBRHINO_AGENT_RECONCILE_INTERVAL"
+	ENV_DRIFT_CHECK_INTERVAL = "DBRHINO_AGENT_DRIFT_CHECK_INTERVAL"
+
+	ENV_SCOPE_DATABASE_IDS   = "DBRHINO_AGENT_SCOPE_DATABASE_IDS"
+	ENV_SCOPE_DATABASE_NAMES = "DBRHINO_AGENT_SCOPE_DATABASE_NAMES"
+	ENV_SCOPE_DATABASE_TYPES = "DBRHINO_AGENT_SCOPE_DATABASE_TYPES"
+	ENV_SCOPE_TAGS           = "DBRHINO_AGENT_SCOPE_TAGS"
+	ENV_SCOPE_HOSTS          = "DBRHINO_AGENT_SCOPE_HOSTS"
+
+	DEFAULT_RECONCILE_INTERVAL   = time.Hour
+	DEFAULT_DRIFT_CHECK_INTERVAL = 10 * time.Minute
+
+	DEFAULT_HTTP_TIMEOUT         = 10 * time.Second
+	DEFAULT_HTTP_CONNECT_TIMEOUT = 10 * time.Second
+
+	DEFAULT_VAULT_APPROLE_MOUNT = "approle"
+	DEFAULT_VAULT_MOUNT         = "secret"
+	DEFAULT_VAULT_PATH          = "dbrhino/{{ database_name }}/{{ username }}"
+
+	DEFAULT_PASSWORD_LENGTH = 32
+	// Redshift does not accept longer passwords
+	MAX_PASSWORD_LENGTH       = 64
+	MIN_PASSWORD_LENGTH       = 16
+	DEFAULT_PASSWORD_ROTATION = 30 * 24 * time.Hour
+
+	// With PASSWORDS_AGENT, the agent generates the passwords of users
+	// itself and hands them to the credential sinks, instead of using the
+	// ones sent by the server.
+	PASSWORDS_SERVER = "server"
+	PASSWORDS_AGENT  = "agent"
 )
 
+// Accounts that cloud providers and the databases themselves rely on, which
+// are never reported as unmanaged.
+var defaultIgnoredUsers = []string{
+	"rdsadmin",
+	"rdsrepladmin",
+	"rdsdb",
+	"cloudsqladmin",
+	"cloudsqlsuperuser",
+	"azure_superuser",
+	"mysql.sys",
+	"mysql.session",
+	"mysql.infoschema",
+}
+
 func debugModeEnabled() bool {
 	return os.Getenv(ENV_DEBUG) != ""
 }
@@ -43,6 +161,102 @@ type Config struct {
 	ServerUrl      string
 	PrivateKeyPath string
 	PublicKeyPath  string
+	// PreviousPrivateKeyPath holds the key being replaced while a key
+	// rotation is in progress.
+	PreviousPrivateKeyPath string
+	// KeyRotation is how often the agent rotates its key, never if zero.
+	KeyRotation time.Duration
+	// KeyType is the type of the keys generated by the agent. Existing keys
+	// are used whatever their type.
+	KeyType string
+	// KeyPassphrase, KeyPassphraseFile and KeyPassphraseCommand are the
+	// possible sources of the passphrase protecting the private key files.
+	KeyPassphrase        string
+	KeyPassphraseFile    string
+	KeyPassphraseCommand string
+	// KeySigner is the unix socket of the external signer holding the
+	// private key, in which case there are no private key files.
+	KeySigner    string
+	StatePath    string
+	DropStrategy string
+	// ReassignOwnedTo is the role receiving the objects of dropped users. It
+	// defaults to the master user of each database.
+	ReassignOwnedTo string
+	// IgnoredUsers holds the usernames that are not reported as unmanaged,
+	// on top of the managed users and the master user of each database.
+	IgnoredUsers   map[string]bool
+	UnmanagedUsers string
+	Drift          string
+	Passwords      string
+	PasswordPolicy PasswordPolicy
+	// PasswordFileDir and PasswordCommand configure the credential sinks.
+	PasswordFileDir string
+	PasswordCommand string
+	Vault           VaultConfig
+	Http            HttpConfig
+	// SignRequests signs requests to DbRhino with the agent key, and
+	// ServerSigningKey, if set, must have signed every response.
+	SignRequests     bool
+	ServerSigningKey crypto.PublicKey
+	// LongPoll waits for grant changes with long-polling between cycles,
+	// instead of only polling the grants.
+	LongPoll bool
+	// Cycles are skipped while the grants do not change, but grants are
+	// applied again every ReconcileInterval, and every DriftCheckInterval
+	// when checking for drift.
+	ReconcileInterval  time.Duration
+	DriftCheckInterval time.Duration
+	// Scope is the subset of the databases of the account the agent works
+	// on, all of them if empty.
+	Scope *Scope
+	// apiClient is built from Http on first use.
+	apiClient *http.Client
+}
+
+// HttpConfig configures the client of the DbRhino API. Proxies are taken
+// from the HTTPS_PROXY and NO_PROXY environment variables.
+type HttpConfig struct {
+	// Timeout bounds whole requests, and ConnectTimeout the connection and
+	// the TLS handshake. Zero means the default.
+	Timeout        time.Duration
+	ConnectTimeout time.Duration
+	// CaBundle is a PEM file of root certificates trusted on top of the
+	// system ones, such as the one of an intercepting proxy.
+	CaBundle string
+	// ClientCert and ClientKey are the PEM files of the client certificate
+	// presented to the server, if any.
+	ClientCert string
+	ClientKey  string
+	// ServerPins lists the accepted "sha256/<base64>" hashes of the subject
+	// public key info of the server certificate or one of its issuers.
+	ServerPins []string
+}
+
+// VaultConfig configures the Vault credential sink, which is enabled when
+// Addr is set. It authenticates with Token if set, and with AppRole
+// otherwise.
+type VaultConfig struct {
+	Addr         string
+	Namespace    string
+	Token        string
+	RoleId       string
+	SecretId     string
+	AppRoleMount string
+	// Mount is the KV version 2 secrets engine the credentials are written
+	// to, at the path rendered from the PathTemplate template.
+	Mount        string
+	PathTemplate string
+	// Http configures the client of Vault, apart from the one of the DbRhino
+	// API since the servers have nothing in common.
+	Http HttpConfig
+}
+
+// PasswordPolicy describes the passwords generated by the agent, and how
+// often they are rotated.
+type PasswordPolicy struct {
+	Length   int
+	Symbols  bool
+	Rotation time.Duration
 }
 
 func readConfig() (*Config, error) {
@@ -51,6 +265,42 @@ func readConfig() (*Config, error) {
 	conf.readAccessToken()
 	conf.readPrivateKeyPath()
 	conf.readPublicKeyPath()
+	if err := conf.readKeyRotation(); err != nil {
+		return nil, err
+	}
+	if err := conf.readKeyType(); err != nil {
+		return nil, err
+	}
+	if err := conf.readKeyProtection(); err != nil {
+		return nil, err
+	}
+	conf.readStatePath()
+	if err := conf.readDropStrategy(); err != nil {
+		return nil, err
+	}
+	conf.readIgnoredUsers()
+	if err := conf.readUnmanagedUsers(); err != nil {
+		return nil, err
+	}
+	if err := conf.readDrift(); err != nil {
+		return nil, err
+	}
+	if err := conf.readPasswords(); err != nil {
+		return nil, err
+	}
+	if err := conf.readHttp(); err != nil {
+		return nil, err
+	}
+	if err := conf.readSigning(); err != nil {
+		return nil, err
+	}
+	conf.LongPoll = os.Getenv(ENV_LONG_POLL) != "false"
+	if err := conf.readReconcile(); err != nil {
+		return nil, err
+	}
+	if err := conf.readScope(); err != nil {
+		return nil, err
+	}
 	return conf, nil
 }
 
@@ -79,3 +329,278 @@ func (c *Config) readPrivateKeyPath() {
 func (c *Config) readPublicKeyPath() {
 	c.PublicKeyPath = filepath.Join(getConfigDir(), "agent.pub")
 }
+
+func (c *Config) readKeyRotation() error {
+	c.PreviousPrivateKeyPath = filepath.Join(getConfigDir(), "agent.previous.pem")
+	if env := os.Getenv(ENV_KEY_ROTATION); env != "" {
+		rotation, err := time.ParseDuration(env)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid key rotation: %s", env))
+		}
+		c.KeyRotation = rotation
+	}
+	return nil
+}
+
+func (c *Config) readKeyType() error {
+	c.KeyType = os.Getenv(ENV_KEY_TYPE)
+	switch c.KeyType {
+	case "":
+		c.KeyType = KEY_TYPE_RSA
+	case KEY_TYPE_RSA, KEY_TYPE_ECDSA, KEY_TYPE_ED25519, KEY_TYPE_X25519:
+	default:
+		return errors.New(fmt.Sprintf("Invalid key type: %s", c.KeyType))
+	}
+	return nil
+}
+
+func (c *Config) readKeyProtection() error {
+	c.KeyPassphrase = os.Getenv(ENV_KEY_PASSPHRASE)
+	// The passphrase must not be passed on to credential commands.
+	os.Unsetenv(ENV_KEY_PASSPHRASE)
+	c.KeyPassphraseFile = os.Getenv(ENV_KEY_PASSPHRASE_FILE)
+	c.KeyPassphraseCommand = os.Getenv(ENV_KEY_PASSPHRASE_COMMAND)
+	c.KeySigner = os.Getenv(ENV_KEY_SIGNER)
+	sources := 0
+	for _, source := range []string{c.KeyPassphrase, c.KeyPassphraseFile, c.KeyPassphraseCommand} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("Only one of the key passphrase, file and command can be set")
+	}
+	if sources > 0 && c.KeySigner != "" {
+		return errors.New("A key passphrase cannot be used with an external signer")
+	}
+	return nil
+}
+
+// keyPassphrase returns the passphrase of the private key files, or nil if
+// they are not encrypted. The caller should wipe it after use.
+func (c *Config) keyPassphrase() ([]byte, error) {
+	var passphrase []byte
+	switch {
+	case c.KeyPassphrase != "":
+		passphrase = []byte(c.KeyPassphrase)
+	case c.KeyPassphraseFile != "":
+		data, err := ioutil.ReadFile(c.KeyPassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = bytes.TrimRight(data, "\r\n")
+	case c.KeyPassphraseCommand != "":
+		cmd := exec.Command("/bin/sh", "-c", c.KeyPassphraseCommand)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Key passphrase command failed: %s", err))
+		}
+		passphrase = bytes.TrimRight(output, "\r\n")
+	default:
+		return nil, nil
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("The key passphrase is empty")
+	}
+	return passphrase, nil
+}
+
+func (c *Config) readStatePath() {
+	c.StatePath = filepath.Join(getConfigDir(), "state.json")
+}
+
+func (c *Config) readDropStrategy() error {
+	c.DropStrategy = os.Getenv(ENV_DROP_STRATEGY)
+	switch c.DropStrategy {
+	case "":
+		c.DropStrategy = DROP_STRATEGY_REVOKE
+	case DROP_STRATEGY_REVOKE, DROP_STRATEGY_REASSIGN:
+	default:
+		return errors.New(fmt.Sprintf("Invalid drop strategy: %s", c.DropStrategy))
+	}
+	c.ReassignOwnedTo = os.Getenv(ENV_REASSIGN_OWNED_TO)
+	return nil
+}
+
+func (c *Config) readIgnoredUsers() {
+	c.IgnoredUsers = map[string]bool{}
+	for _, username := range defaultIgnoredUsers {
+		c.IgnoredUsers[username] = true
+	}
+	for _, username := range strings.Split(os.Getenv(ENV_IGNORED_USERS), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			c.IgnoredUsers[username] = true
+		}
+	}
+}
+
+func (c *Config) readUnmanagedUsers() error {
+	c.UnmanagedUsers = os.Getenv(ENV_UNMANAGED_USERS)
+	switch c.UnmanagedUsers {
+	case "":
+		c.UnmanagedUsers = UNMANAGED_USERS_REPORT
+	case UNMANAGED_USERS_REPORT, UNMANAGED_USERS_LOCK:
+	default:
+		return errors.New(fmt.Sprintf("Invalid unmanaged users mode: %s", c.UnmanagedUsers))
+	}
+	return nil
+}
+
+func (c *Config) readDrift() error {
+	c.Drift = os.Getenv(ENV_DRIFT)
+	switch c.Drift {
+	case "":
+		c.Drift = DRIFT_OFF
+	case DRIFT_OFF, DRIFT_REPORT, DRIFT_HEAL:
+	default:
+		return errors.New(fmt.Sprintf("Invalid drift mode: %s", c.Drift))
+	}
+	return nil
+}
+
+func (c *Config) readPasswords() error {
+	c.Passwords = os.Getenv(ENV_PASSWORDS)
+	switch c.Passwords {
+	case "":
+		c.Passwords = PASSWORDS_SERVER
+	case PASSWORDS_SERVER, PASSWORDS_AGENT:
+	default:
+		return errors.New(fmt.Sprintf("Invalid passwords mode: %s", c.Passwords))
+	}
+	c.PasswordPolicy = PasswordPolicy{
+		Length:   DEFAULT_PASSWORD_LENGTH,
+		Symbols:  os.Getenv(ENV_PASSWORD_SYMBOLS) == "true",
+		Rotation: DEFAULT_PASSWORD_ROTATION,
+	}
+	if env := os.Getenv(ENV_PASSWORD_LENGTH); env != "" {
+		length, err := strconv.Atoi(env)
+		if err != nil || length < MIN_PASSWORD_LENGTH || length > MAX_PASSWORD_LENGTH {
+			return errors.New(fmt.Sprintf("Password length must be between %d and %d",
+				MIN_PASSWORD_LENGTH, MAX_PASSWORD_LENGTH))
+		}
+		c.PasswordPolicy.Length = length
+	}
+	if env := os.Getenv(ENV_PASSWORD_ROTATION); env != "" {
+		rotation, err := time.ParseDuration(env)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid password rotation: %s", env))
+		}
+		c.PasswordPolicy.Rotation = rotation
+	}
+	c.PasswordFileDir = os.Getenv(ENV_PASSWORD_FILE_DIR)
+	c.PasswordCommand = os.Getenv(ENV_PASSWORD_COMMAND)
+	if err := c.readVault(); err != nil {
+		return err
+	}
+	noSink := c.PasswordFileDir == "" && c.PasswordCommand == "" && c.Vault.Addr == ""
+	if c.Passwords == PASSWORDS_AGENT && noSink {
+		return errors.New("Passwords generated by the agent need a credential sink")
+	}
+	return nil
+}
+
+func envOrDefault(name string, value string) string {
+	if env := os.Getenv(name); env != "" {
+		return env
+	}
+	return value
+}
+
+func readDurationEnv(name string, value *time.Duration) error {
+	if env := os.Getenv(name); env != "" {
+		duration, err := time.ParseDuration(env)
+		if err != nil || duration <= 0 {
+			return errors.New(fmt.Sprintf("Invalid duration for %s: %s", name, env))
+		}
+		*value = duration
+	}
+	return nil
+}
+
+func (c *Config) readHttp() error {
+	c.Http = HttpConfig{
+		Timeout:        DEFAULT_HTTP_TIMEOUT,
+		ConnectTimeout: DEFAULT_HTTP_CONNECT_TIMEOUT,
+		CaBundle:       os.Getenv(ENV_CA_BUNDLE),
+		ClientCert:     os.Getenv(ENV_CLIENT_CERT),
+		ClientKey:      os.Getenv(ENV_CLIENT_KEY),
+	}
+	if err := readDurationEnv(ENV_HTTP_TIMEOUT, &c.Http.Timeout); err != nil {
+		return err
+	}
+	if err := readDurationEnv(ENV_HTTP_CONNECT_TIMEOUT, &c.Http.ConnectTimeout); err != nil {
+		return err
+	}
+	if (c.Http.ClientCert == "") != (c.Http.ClientKey == "") {
+		return errors.New("The client certificate and key must be set together")
+	}
+	for _, pin := range strings.Split(os.Getenv(ENV_SERVER_PINS), ",") {
+		if pin = strings.TrimSpace(pin); pin == "" {
+			continue
+		}
+		if !strings.HasPrefix(pin, SPKI_PIN_PREFIX) {
+			return errors.New(fmt.Sprintf("Server pins must start with %s: %s", SPKI_PIN_PREFIX, pin))
+		}
+		c.Http.ServerPins = append(c.Http.ServerPins, pin)
+	}
+	return nil
+}
+
+func (c *Config) readSigning() error {
+	c.SignRequests = os.Getenv(ENV_SIGN_REQUESTS) != "false"
+	if path := os.Getenv(ENV_SERVER_SIGNING_KEY); path != "" {
+		key, err := readServerSigningKey(path)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid server signing key: %s", err))
+		}
+		c.ServerSigningKey = key
+	}
+	return nil
+}
+
+func (c *Config) readReconcile() error {
+	c.ReconcileInterval = DEFAULT_RECONCILE_INTERVAL
+	c.DriftCheckInterval = DEFAULT_DRIFT_CHECK_INTERVAL
+	if err := readDurationEnv(ENV_RECONCILE_INTERVAL, &c.ReconcileInterval); err != nil {
+		return err
+	}
+	return readDurationEnv(ENV_DRIFT_CHECK_INTERVAL, &c.DriftCheckInterval)
+}
+
+func (c *Config) readScope() error {
+	scope, err := parseScope(
+		os.Getenv(ENV_SCOPE_DATABASE_IDS),
+		os.Getenv(ENV_SCOPE_DATABASE_NAMES),
+		os.Getenv(ENV_SCOPE_DATABASE_TYPES),
+		os.Getenv(ENV_SCOPE_TAGS),
+		os.Getenv(ENV_SCOPE_HOSTS),
+	)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid scope: %s", err))
+	}
+	c.Scope = scope
+	return nil
+}
+
+func (c *Config) readVault() error {
+	c.Vault = VaultConfig{
+		Addr:         strings.TrimRight(os.Getenv(ENV_VAULT_ADDR), "/"),
+		Namespace:    os.Getenv(ENV_VAULT_NAMESPACE),
+		Token:        os.Getenv(ENV_VAULT_TOKEN),
+		RoleId:       os.Getenv(ENV_VAULT_ROLE_ID),
+		SecretId:     os.Getenv(ENV_VAULT_SECRET_ID),
+		AppRoleMount: envOrDefault(ENV_VAULT_APPROLE_MOUNT, DEFAULT_VAULT_APPROLE_MOUNT),
+		Mount:        envOrDefault(ENV_VAULT_MOUNT, DEFAULT_VAULT_MOUNT),
+		PathTemplate: envOrDefault(ENV_VAULT_PATH, DEFAULT_VAULT_PATH),
+		Http: HttpConfig{
+			Timeout:        DEFAULT_HTTP_TIMEOUT,
+			ConnectTimeout: DEFAULT_HTTP_CONNECT_TIMEOUT,
+			CaBundle:       os.Getenv(ENV_VAULT_CA_BUNDLE),
+		},
+	}
+	if c.Vault.Addr != "" && c.Vault.Token == "" && c.Vault.RoleId == "" {
+		return errors.New("Vault needs either a token or an AppRole role id")
+	}
+	return nil
+}
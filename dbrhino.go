@@ -2,13 +2,13 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
-	"time"
 )
 
 func dbrhinoGetUrl(conf *Config, path string) string {
@@ -23,75 +23,171 @@ func setHeaders(req *http.Request, conf *Config) {
 	req.Header.Set("Authorization", "Bearer "+conf.AccessToken)
 }
 
-func doRequest(client *http.Client, req *http.Request, result interface{}) error {
+// HttpStatusError is returned for responses with a non 2xx status.
+type HttpStatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *HttpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// errNotModified is returned for 304 responses to conditional requests.
+var errNotModified = errors.New("Not modified")
+
+// Checkins from GZIP_MIN_SIZE bytes on are sent compressed.
+const GZIP_MIN_SIZE = 1024
+
+// doRequest calls verify, if not nil, on successful responses before
+// decoding them, and returns the headers of the response.
+func doRequest(client *http.Client, req *http.Request,
+	verify func(*http.Response, []byte) error, result interface{}) (http.Header, error) {
 	res, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer res.Body.Close()
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotModified {
+		err = errNotModified
+	} else if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, &HttpStatusError{StatusCode: res.StatusCode, Body: body}
 	}
-	if res.StatusCode < 200 || res.StatusCode >= 300 {
-		return errors.New(fmt.Sprintf("HTTP %d: %s", res.StatusCode, body))
+	if verify != nil {
+		if verifyErr := verify(res, body); verifyErr != nil {
+			return nil, verifyErr
+		}
+	}
+	if err != nil {
+		return res.Header, err
 	}
 	// fmt.Print(string(body))
-	return json.Unmarshal(body, result)
+	return res.Header, json.Unmarshal(body, result)
 }
 
-func dbrhinoGetRequest(conf *Config, path string, result interface{}) error {
-	url := dbrhinoGetUrl(conf, path)
-	client := http.Client{
-		Timeout: time.Second * 10,
+func gzipPayload(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
 	}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return err
+	if err := writer.Close(); err != nil {
+		return nil, err
 	}
-	setHeaders(req, conf)
-	return doRequest(&client, req, result)
+	return buf.Bytes(), nil
 }
 
-func dbrhinoPostRequest(conf *Config, path string, payload []byte,
-	result interface{}) error {
-	url := dbrhinoGetUrl(conf, path)
-	client := http.Client{
-		Timeout: time.Second * 10,
+// dbrhinoRequest signs the request with the agent key, unless disabled,
+// and verifies the response if a server signing key is configured. The
+// header is added to the request, and the one of the response returned.
+func dbrhinoRequest(app *Application, method string, path string, payload []byte,
+	header http.Header, result interface{}) (http.Header, error) {
+	client, err := app.conf.dbrhinoClient()
+	if err != nil {
+		return nil, err
 	}
-	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(payload))
+	return dbrhinoRequestWithClient(app, client, method, path, payload, header, result)
+}
+
+func dbrhinoRequestWithClient(app *Application, client *http.Client, method string,
+	path string, payload []byte, header http.Header, result interface{}) (http.Header, error) {
+	conf := app.conf
+	req, err := http.NewRequest(method, dbrhinoGetUrl(conf, path), bytes.NewReader(payload))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	setHeaders(req, conf)
-	return doRequest(&client, req, result)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	key := app.key
+	if !conf.SignRequests {
+		key = nil
+	}
+	// Compressed payloads are signed as sent.
+	nonce, err := signRequest(key, req, payload)
+	if err != nil {
+		return nil, err
+	}
+	var verify func(*http.Response, []byte) error
+	if conf.ServerSigningKey != nil {
+		verify = func(res *http.Response, body []byte) error {
+			return verifyResponse(conf.ServerSigningKey, nonce, res, body)
+		}
+	}
+	return doRequest(client, req, verify, result)
+}
+
+func dbrhinoGetRequest(app *Application, path string, result interface{}) error {
+	_, err := dbrhinoRequest(app, http.MethodGet, path, nil, nil, result)
+	return err
+}
+
+func dbrhinoPostRequest(app *Application, path string, payload []byte,
+	result interface{}) error {
+	_, err := dbrhinoRequest(app, http.MethodPost, path, payload, nil, result)
+	return err
 }
 
-func fetchGrants(conf *Config) (*GrantsResponse, error) {
+// fetchGrants returns the grants in the scope of the agent along with
+// their ETag. With an ETag, it returns errNotModified if they did not
+// change since.
+func fetchGrants(app *Application, etag string) (*GrantsResponse, string, error) {
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
 	result := &GrantsResponse{}
-	err := dbrhinoGetRequest(conf, "/api/grants", result)
+	resHeader, err := dbrhinoRequest(app, http.MethodGet, "/api/grants", nil, header, result)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return result, nil
+	return app.conf.Scope.filter(result), resHeader.Get("ETag"), nil
 }
 
 type SendPubkeyRequest struct {
-	Pubkey []byte `json:"pubkey"`
+	Pubkey  []byte `json:"pubkey"`
+	KeyType string `json:"key_type"`
+	// EnvelopePubkey is the X25519 key envelopes are encrypted to, for
+	// Ed25519 keys which cannot be used for ECDH directly.
+	EnvelopePubkey []byte `json:"envelope_pubkey,omitempty"`
+	// PreviousPubkey is the key being rotated out, which the server uses
+	// until it re-encrypted every secret with the new one.
+	PreviousPubkey   []byte   `json:"previous_pubkey,omitempty"`
+	EnvelopeVersions []string `json:"envelope_versions"`
 }
 
 func sendPubkey(app *Application) (*SendPubkeyResponse, error) {
-	encoded, err := encodePublicKey(app.key, app.conf)
+	encoded, err := encodePublicKey(app.key)
+	if err != nil {
+		return nil, err
+	}
+	envelopeEncoded, err := encodeEnvelopePublicKey(app.key)
 	if err != nil {
 		return nil, err
 	}
-	payload, err := json.Marshal(SendPubkeyRequest{
-		Pubkey: encoded,
-	})
+	request := SendPubkeyRequest{
+		Pubkey:           encoded,
+		KeyType:          app.key.keyType(),
+		EnvelopePubkey:   envelopeEncoded,
+		EnvelopeVersions: app.key.envelopeVersions(),
+	}
+	if app.previousKey != nil {
+		request.PreviousPubkey, err = encodePublicKey(app.previousKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	payload, err := json.Marshal(request)
 	if err != nil {
 		return nil, err
 	}
 	result := &SendPubkeyResponse{}
-	err = dbrhinoPostRequest(app.conf, "/api/agents/startup", payload, result)
+	err = dbrhinoPostRequest(app, "/api/agents/startup", payload, result)
 	if err != nil {
 		return nil, err
 	}
@@ -103,8 +199,15 @@ func sendCheckin(app *Application, checkin *CheckinRequest) (*SendCheckinRespons
 	if err != nil {
 		return nil, err
 	}
+	header := http.Header{}
+	if len(payload) >= GZIP_MIN_SIZE {
+		if payload, err = gzipPayload(payload); err != nil {
+			return nil, err
+		}
+		header.Set("Content-Encoding", "gzip")
+	}
 	result := &SendCheckinResponse{}
-	err = dbrhinoPostRequest(app.conf, "/api/agents/checkin", payload, result)
+	_, err = dbrhinoRequest(app, http.MethodPost, "/api/agents/checkin", payload, header, result)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// grantsServer serves the grants with an ETag, compressed when the agent
+// accepts it, and records the checkins.
+type grantsServer struct {
+	sync.Mutex
+	etag        string
+	grants      []byte
+	notModified int
+	checkins    []*CheckinRequest
+	encodings   []string
+}
+
+func (gs *grantsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gs.Lock()
+	defer gs.Unlock()
+	switch r.URL.Path {
+	case "/api/grants":
+		if r.Header.Get("If-None-Match") == gs.etag {
+			gs.notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", gs.etag)
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Write(gs.grants)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := gzip.NewWriter(w)
+		writer.Write(gs.grants)
+		writer.Close()
+	case "/api/agents/checkin":
+		gs.encodings = append(gs.encodings, r.Header.Get("Content-Encoding"))
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			body, _ = gzip.NewReader(r.Body)
+		}
+		checkin := &CheckinRequest{}
+		json.NewDecoder(body).Decode(checkin)
+		gs.checkins = append(gs.checkins, checkin)
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestConditionalFetch(t *testing.T) {
+	gs := &grantsServer{etag: `"1"`, grants: []byte(`{"connections": [], "revision": "1"}`)}
+	server := httptest.NewServer(gs)
+	defer server.Close()
+	app := &Application{
+		conf:  &Config{ServerUrl: server.URL, ReconcileInterval: time.Hour, Drift: DRIFT_OFF},
+		state: newAgentState(""),
+	}
+
+	grantsResponse, etag, err := fetchGrants(app, "")
+	assert.Nil(t, err)
+	assert.Equal(t, `"1"`, etag)
+	assert.Equal(t, "1", grantsResponse.Revision)
+	_, _, err = fetchGrants(app, etag)
+	assert.Equal(t, errNotModified, err)
+
+	// Unchanged grants skip the whole cycle, checkin included.
+	assert.True(t, app.fullCycleDue())
+	assert.Nil(t, app.runGrantFetchAndApply())
+	assert.Equal(t, `"1"`, app.grantsEtag)
+	assert.False(t, app.fullCycleDue())
+	assert.Nil(t, app.runGrantFetchAndApply())
+	assert.Equal(t, 1, len(gs.checkins))
+	assert.Equal(t, 2, gs.notModified)
+
+	// Changed grants are applied.
+	gs.Lock()
+	gs.etag = `"2"`
+	gs.Unlock()
+	assert.Nil(t, app.runGrantFetchAndApply())
+	assert.Equal(t, 2, len(gs.checkins))
+	assert.Equal(t, `"2"`, app.grantsEtag)
+
+	// Grants are applied anyway once a full cycle is due.
+	app.lastFullCycle = time.Now().Add(-2 * time.Hour)
+	assert.True(t, app.fullCycleDue())
+	assert.Nil(t, app.runGrantFetchAndApply())
+	assert.Equal(t, 3, len(gs.checkins))
+	app.conf.Drift = DRIFT_REPORT
+	app.conf.DriftCheckInterval = time.Minute
+	app.lastFullCycle = time.Now().Add(-2 * time.Minute)
+	assert.True(t, app.fullCycleDue())
+	app.conf.Drift = DRIFT_OFF
+	assert.False(t, app.fullCycleDue())
+	app.state.ExpiryEvents = []*ExpiryEvent{&ExpiryEvent{GrantId: 1}}
+	assert.True(t, app.fullCycleDue())
+}
+
+func TestCheckinCompression(t *testing.T) {
+	gs := &grantsServer{}
+	server := httptest.NewServer(gs)
+	defer server.Close()
+	app := &Application{conf: &Config{ServerUrl: server.URL}}
+
+	small := newCheckinResult()
+	_, err := sendCheckin(app, small)
+	assert.Nil(t, err)
+	large := newCheckinResult()
+	for i := 0; i < 100; i++ {
+		large.GrantResults = append(large.GrantResults, &GrantResult{GrantId: i, Result: RESULT_APPLIED})
+	}
+	_, err = sendCheckin(app, large)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"", "gzip"}, gs.encodings)
+	assert.Equal(t, 100, len(gs.checkins[1].GrantResults))
+}
+
+func TestCheckinSettled(t *testing.T) {
+	checkin := newCheckinResult()
+	assert.True(t, checkin.settled())
+	checkin.UnmanagedUsers = append(checkin.UnmanagedUsers, &UnmanagedUser{Username: "bob"})
+	checkin.GrantResults = append(checkin.GrantResults, &GrantResult{Result: RESULT_APPLIED},
+		&GrantResult{Result: RESULT_EXPIRED})
+	assert.True(t, checkin.settled())
+	checkin.UserResults = append(checkin.UserResults, &UserResult{Result: RESULT_CONNECTION_ISSUE})
+	assert.False(t, checkin.settled())
+	checkin.UserResults = nil
+	checkin.GrantResults = append(checkin.GrantResults, &GrantResult{Result: RESULT_PENDING})
+	assert.False(t, checkin.settled())
+}
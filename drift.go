@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Grants skipped because nothing changed are still applied this often, as
+// statements such as GRANT ... ON ALL TABLES IN SCHEMA cover new objects
+// without rendering any differently.
+const DRIFT_FULL_APPLY_INTERVAL = time.Hour
+
+// privilegeKeys lists the privileges held directly by the grantee in a
+// stable textual form. Ownership is left out, since users are free to create
+// objects with the privileges they were granted.
+func privilegeKeys(inventory *PrivilegeInventory, grantee string) []string {
+	keys := []string{}
+	for _, rec := range inventory.Privileges {
+		if rec.Grantee != grantee || rec.Privilege == PRIVILEGE_OWNER {
+			continue
+		}
+		key := rec.Privilege + " on " + rec.ObjectType + " " + rec.Object
+		if rec.Grantable {
+			key += " with grant option"
+		}
+		keys = append(keys, key)
+	}
+	for _, ms := range inventory.Memberships {
+		if ms.Member == grantee {
+			keys = append(keys, PRIVILEGE_MEMBER+" of role "+ms.Role)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diffPrivilegeKeys returns the keys only found in current and those only
+// found in previous, both sorted.
+func diffPrivilegeKeys(previous []string, current []string) ([]string, []string) {
+	inPrevious := map[string]bool{}
+	for _, key := range previous {
+		inPrevious[key] = true
+	}
+	inCurrent := map[string]bool{}
+	added := []string{}
+	for _, key := range current {
+		inCurrent[key] = true
+		if !inPrevious[key] {
+			added = append(added, key)
+		}
+	}
+	removed := []string{}
+	for _, key := range previous {
+		if !inCurrent[key] {
+			removed = append(removed, key)
+		}
+	}
+	return added, removed
+}
+
+func formatPrivilegeDiff(added []string, removed []string) string {
+	lines := []string{}
+	for _, key := range added {
+		lines = append(lines, "+ "+key)
+	}
+	for _, key := range removed {
+		lines = append(lines, "- "+key)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// renderedHash identifies what applying the grant would run, which changes
+// with the catalog even if the grant itself does not.
+func renderedHash(impl *DatabaseImpl, grantee *Grantee, grant *Grant) (string, error) {
+	sqls, _, err := renderGrantStatements(impl, grantee, grant)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write([]byte(strings.Join(sqls, ";\n")))
+	extra, err := json.Marshal([]interface{}{grant.ColumnPrivileges, grant.Policies})
+	if err != nil {
+		return "", err
+	}
+	hash.Write(extra)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// DriftChecker compares the privileges of grantees with the fingerprints
+// taken after grants were last applied. It reads the privilege inventory of
+// each connection at most once before grants are applied, and once more
+// afterwards to take the new fingerprints.
+type DriftChecker struct {
+	app            *Application
+	grantsResponse *GrantsResponse
+	connRegistry   ConnRegistry
+	inventories    map[int]*PrivilegeInventory
+	applied        []*Grant
+	Reports        []*DriftReport
+}
+
+func newDriftChecker(app *Application, gr *GrantsResponse, connRegistry ConnRegistry) *DriftChecker {
+	return &DriftChecker{
+		app:            app,
+		grantsResponse: gr,
+		connRegistry:   connRegistry,
+		inventories:    map[int]*PrivilegeInventory{},
+		Reports:        []*DriftReport{},
+	}
+}
+
+func (dc *DriftChecker) enabled() bool {
+	return dc.app.conf.Drift != "" && dc.app.conf.Drift != DRIFT_OFF
+}
+
+// inventory returns nil if the inventory of the connection cannot be read.
+func (dc *DriftChecker) inventory(regItem *RegistryItem) *PrivilegeInventory {
+	if inventory, ok := dc.inventories[regItem.Conn.Id]; ok {
+		return inventory
+	}
+	inventory, err := regItem.Impl.privilegeInventory()
+	if err != nil {
+		logger.Errorf("(%s) Could not read privileges: %s", regItem.Impl.getName(), err)
+		inventory = nil
+	}
+	dc.inventories[regItem.Conn.Id] = inventory
+	return inventory
+}
+
+// canSkip checks the grant for drift before it is applied, and tells
+// whether applying it can be skipped because nothing changed. Time-bound
+// grants are never skipped, as they depend on the clock. Skipping relies on
+// the privilege inventory covering everything the grant gives, column
+// privileges and policies included.
+func (dc *DriftChecker) canSkip(grant *Grant) bool {
+	if !dc.enabled() || grant.isTimeBound() {
+		return false
+	}
+	fingerprint := dc.app.state.grantFingerprint(grant.Id)
+	if fingerprint == nil || fingerprint.Version != grant.Version ||
+		fingerprint.ConnectionId != grant.ConnectionId {
+		return false
+	}
+	regItem := dc.connRegistry[grant.ConnectionId]
+	if regItem == nil || regItem.Error != nil {
+		return false
+	}
+	inventory := dc.inventory(regItem)
+	if inventory == nil {
+		return false
+	}
+	grantee := dc.grantsResponse.granteeFor(grant)
+	current := privilegeKeys(inventory, regItem.Impl.inventoryGrantee(grantee))
+	added, removed := diffPrivilegeKeys(fingerprint.Privileges, current)
+	if len(added) > 0 || len(removed) > 0 {
+		report := &DriftReport{
+			GrantId:      grant.Id,
+			ConnectionId: grant.ConnectionId,
+			Username:     grant.Username,
+			Added:        added,
+			Removed:      removed,
+			Diff:         formatPrivilegeDiff(added, removed),
+		}
+		logger.Warningf("(%s) Privileges of %s drifted:\n%s", regItem.Impl.getName(),
+			grant.Username, report.Diff)
+		dc.Reports = append(dc.Reports, report)
+		return false
+	}
+	if dc.app.conf.Drift != DRIFT_HEAL {
+		return false
+	}
+	if time.Since(fingerprint.AppliedAt) > DRIFT_FULL_APPLY_INTERVAL {
+		return false
+	}
+	hash, err := renderedHash(&regItem.Impl, grantee, grant)
+	return err == nil && hash == fingerprint.RenderedHash
+}
+
+// track remembers a grant applied during this cycle, so that it gets a new
+// fingerprint.
+func (dc *DriftChecker) track(grant *Grant, result *GrantResult) {
+	if dc.enabled() && !grant.isTimeBound() && result.Result == RESULT_APPLIED {
+		dc.applied = append(dc.applied, grant)
+	}
+}
+
+// finish fingerprints the grants applied during this cycle. It must run
+// once everything has been applied, including role memberships.
+func (dc *DriftChecker) finish() {
+	if !dc.enabled() {
+		return
+	}
+	dc.inventories = map[int]*PrivilegeInventory{}
+	fingerprints := []*GrantFingerprint{}
+	for _, grant := range dc.applied {
+		regItem := dc.connRegistry[grant.ConnectionId]
+		inventory := dc.inventory(regItem)
+		if inventory == nil {
+			continue
+		}
+		grantee := dc.grantsResponse.granteeFor(grant)
+		hash, err := renderedHash(&regItem.Impl, grantee, grant)
+		if err != nil {
+			continue
+		}
+		fingerprints = append(fingerprints, &GrantFingerprint{
+			GrantId:      grant.Id,
+			ConnectionId: grant.ConnectionId,
+			Version:      grant.Version,
+			RenderedHash: hash,
+			Privileges:   privilegeKeys(inventory, regItem.Impl.inventoryGrantee(grantee)),
+			AppliedAt:    time.Now(),
+		})
+	}
+	keep := map[int]bool{}
+	for _, grant := range dc.grantsResponse.Grants {
+		keep[grant.Id] = true
+	}
+	if err := dc.app.state.replaceGrantFingerprints(fingerprints, keep); err != nil {
+		logger.Errorf("Could not save grant fingerprints: %s", err)
+	}
+}
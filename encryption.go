@@ -1,14 +1,11 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha256"
+	"crypto"
 	"crypto/x509"
-	"encoding/asn1"
-	"encoding/base64"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 )
@@ -17,73 +14,189 @@ func privateKeyFileExists(conf *Config) bool {
 	return fileExists(conf.PrivateKeyPath)
 }
 
-func encodePublicKey(key *rsa.PrivateKey, conf *Config) ([]byte, error) {
-	pub := key.PublicKey
-	asn1Bytes, err := asn1.Marshal(pub)
+// encodePublicKey encodes the public key as a PKIX "PUBLIC KEY" PEM block.
+func encodePublicKey(key AgentKey) ([]byte, error) {
+	return encodePkixPublicKey(key.publicKey())
+}
+
+// encodeEnvelopePublicKey encodes the key envelopes are encrypted to, or
+// returns nil if it is the public key itself.
+func encodeEnvelopePublicKey(key AgentKey) ([]byte, error) {
+	pub := key.envelopePublicKey()
+	if pub == nil {
+		return nil, nil
+	}
+	return encodePkixPublicKey(pub)
+}
+
+func encodePkixPublicKey(pub interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
 	if err != nil {
 		return nil, err
 	}
 	var pemBlock = &pem.Block{
 		Type:  "PUBLIC KEY",
-		Bytes: asn1Bytes,
+		Bytes: der,
 	}
 	return pem.EncodeToMemory(pemBlock), nil
 }
 
-func generateAndWritePrivateKey(conf *Config) (*rsa.PrivateKey, error) {
-	logger.Info("Generating an RSA private key")
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
+func generatePrivateKey(conf *Config) (AgentKey, error) {
+	return generateAgentKey(conf.KeyType)
+}
+
+// writePrivateKey writes the key as a PKCS#8 "PRIVATE KEY" PEM block, or
+// as an "ENCRYPTED PRIVATE KEY" one if the passphrase is not nil.
+func writePrivateKey(path string, key AgentKey, passphrase []byte) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.privateKey())
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer wipeBytes(der)
 	pemBlock := pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
+		Type:  "PRIVATE KEY",
+		Bytes: der,
 	}
-	certOut, err := os.Create(conf.PrivateKeyPath)
+	if passphrase != nil {
+		pemBlock.Type = "ENCRYPTED PRIVATE KEY"
+		if pemBlock.Bytes, err = encryptPkcs8(der, passphrase); err != nil {
+			return err
+		}
+	}
+	certOut, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer certOut.Close()
-	certOut.Chmod(0600)
-	err = pem.Encode(certOut, &pemBlock)
+	return pem.Encode(certOut, &pemBlock)
+}
+
+// writePublicKey writes the public key next to the private key, for the
+// tools that need it.
+func writePublicKey(conf *Config, key AgentKey) error {
+	encoded, err := encodePublicKey(key)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(conf.PublicKeyPath, encoded, 0644)
+}
+
+// writeKeyFiles writes the private key, encrypted if a passphrase is
+// configured, and the public key.
+func writeKeyFiles(conf *Config, key AgentKey) error {
+	passphrase, err := conf.keyPassphrase()
+	if err != nil {
+		return err
+	}
+	defer wipeBytes(passphrase)
+	if err = writePrivateKey(conf.PrivateKeyPath, key, passphrase); err != nil {
+		return err
+	}
+	return writePublicKey(conf, key)
+}
+
+func generateAndWritePrivateKey(conf *Config) (AgentKey, error) {
+	key, err := generatePrivateKey(conf)
 	if err != nil {
 		return nil, err
 	}
+	if err = writeKeyFiles(conf, key); err != nil {
+		return nil, err
+	}
 	return key, nil
 }
 
-func readPrivateKey(conf *Config) (*rsa.PrivateKey, error) {
-	data, err := ioutil.ReadFile(conf.PrivateKeyPath)
+// readPrivateKeyFile reads PKCS#8 keys, as well as the PKCS#1 RSA keys and
+// SEC 1 EC keys written by older agents and other tools. Encrypted keys are
+// either PKCS#8 ones, or PEM blocks with the legacy OpenSSL encryption
+// headers.
+func readPrivateKeyFile(path string, passphrase []byte) (AgentKey, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	defer wipeBytes(data)
 	pemBlock, _ := pem.Decode(data)
 	if pemBlock == nil {
 		return nil, errors.New("No PEM block could be decoded")
 	}
-	key, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	der := pemBlock.Bytes
+	blockType := pemBlock.Type
+	encrypted := blockType == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(pemBlock)
+	if encrypted && passphrase == nil {
+		return nil, errors.New("The private key is encrypted but no passphrase is configured")
+	}
+	if blockType == "ENCRYPTED PRIVATE KEY" {
+		if der, err = decryptPkcs8(der, passphrase); err != nil {
+			return nil, err
+		}
+		blockType = "PRIVATE KEY"
+	} else if encrypted {
+		if der, err = x509.DecryptPEMBlock(pemBlock, passphrase); err != nil {
+			return nil, errWrongPassphrase
+		}
+	}
+	if encrypted {
+		defer wipeBytes(der)
+	}
+	var key crypto.PrivateKey
+	switch blockType {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(der)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported PEM block: %s", blockType))
+	}
 	if err != nil {
+		if encrypted {
+			return nil, errWrongPassphrase
+		}
 		return nil, err
 	}
-	return key, nil
+	return newAgentKey(key)
 }
 
-func readOrGeneratePrivateKey(conf *Config) (*rsa.PrivateKey, error) {
-	if privateKeyFileExists(conf) {
-		return readPrivateKey(conf)
+func readPrivateKey(conf *Config) (AgentKey, error) {
+	return readKeyFile(conf, conf.PrivateKeyPath)
+}
+
+func readKeyFile(conf *Config, path string) (AgentKey, error) {
+	passphrase, err := conf.keyPassphrase()
+	if err != nil {
+		return nil, err
 	}
-	return generateAndWritePrivateKey(conf)
+	defer wipeBytes(passphrase)
+	return readPrivateKeyFile(path, passphrase)
 }
 
-func decryptPassword(app *Application, b64password string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(b64password)
+// generatePrivateKeyIfMissing generates the key on the first start. An
+// existing key is left for loadKeys to read, so that the passphrase command
+// or the signer only runs once.
+func generatePrivateKeyIfMissing(conf *Config) error {
+	if conf.KeySigner != "" || privateKeyFileExists(conf) {
+		return nil
+	}
+	key, err := generateAndWritePrivateKey(conf)
 	if err != nil {
-		return "", err
+		return err
+	}
+	key.wipe()
+	return nil
+}
+
+// decryptSecret tries the previous key as well while a key rotation is in
+// progress, since the server may not have re-encrypted everything yet. The
+// caller must wipe the secret once used.
+func decryptSecret(app *Application, envelope string) (*Secret, error) {
+	decrypted, err := openEnvelope(app.key, envelope)
+	if err != nil && app.previousKey != nil {
+		decrypted, err = openEnvelope(app.previousKey, envelope)
 	}
-	decrypted, err := app.key.Decrypt(rand.Reader, data, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return string(decrypted[:len(decrypted)-sha256.Size]), nil
+	return newSecret(decrypted), nil
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Secrets from the server are wrapped in envelopes. Legacy envelopes are
+// plain base64 of the PKCS#1 v1.5 encryption of the secret followed by its
+// SHA-256 digest. Newer envelopes are prefixed with their version and a
+// colon, which cannot appear in base64. Version 2 is the RSA-OAEP-SHA256
+// encryption of the secret, for short secrets. Version 3 is for secrets of
+// any length: a random AES-256 key encrypted with RSA-OAEP-SHA256 and
+// prefixed with its length as 2 big endian bytes, followed by a 12 byte
+// nonce and the AES-GCM encryption of the secret.
+//
+// Version 4 is for ECDH agent keys: the ephemeral public key of the server
+// (32 bytes for X25519, 65 uncompressed bytes for P-256), a 12 byte nonce
+// and the AES-GCM encryption of the secret. The AES key is derived from the
+// shared secret with HKDF-SHA256, salted with the ephemeral public key
+// followed by the public key of the agent.
+//
+// The OAEP label, the HKDF info and the GCM additional data are the version
+// tag, so that an envelope cannot be passed off as another version.
+const (
+	ENVELOPE_V1 = "v1"
+	ENVELOPE_V2 = "v2"
+	ENVELOPE_V3 = "v3"
+	ENVELOPE_V4 = "v4"
+)
+
+const AES_GCM_NONCE_SIZE = 12
+
+var errEnvelopeIntegrity = errors.New("The envelope failed its integrity check")
+
+func envelopeLabel(version string) []byte {
+	return []byte("dbrhino-envelope-" + version)
+}
+
+// splitEnvelope returns the version and the decoded payload of the
+// envelope.
+func splitEnvelope(envelope string) (string, []byte, error) {
+	version := ENVELOPE_V1
+	encoded := envelope
+	if idx := strings.Index(envelope, ":"); idx >= 0 {
+		version = envelope[:idx]
+		encoded = envelope[idx+1:]
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", nil, err
+	}
+	return version, data, nil
+}
+
+func openEnvelope(key AgentKey, envelope string) ([]byte, error) {
+	version, data, err := splitEnvelope(envelope)
+	if err != nil {
+		return nil, err
+	}
+	return key.openEnvelope(version, data)
+}
+
+// The envelopes are opened through crypto.Decrypter and ecdhAgreement, so
+// that the private key can be held outside of the agent.
+
+// ecdhAgreement is implemented by *ecdh.PrivateKey.
+type ecdhAgreement interface {
+	PublicKey() *ecdh.PublicKey
+	ECDH(remote *ecdh.PublicKey) ([]byte, error)
+}
+
+func oaepOptions(label []byte) *rsa.OAEPOptions {
+	return &rsa.OAEPOptions{Hash: crypto.SHA256, Label: label}
+}
+
+func openOaepEnvelope(key crypto.Decrypter, data []byte, label []byte) ([]byte, error) {
+	return key.Decrypt(rand.Reader, data, oaepOptions(label))
+}
+
+// openLegacyEnvelope checks the SHA-256 digest that follows the secret,
+// which older agents used to strip without looking at it.
+func openLegacyEnvelope(key crypto.Decrypter, data []byte) ([]byte, error) {
+	decrypted, err := key.Decrypt(rand.Reader, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(decrypted) < sha256.Size {
+		wipeBytes(decrypted)
+		return nil, errEnvelopeIntegrity
+	}
+	secret := decrypted[:len(decrypted)-sha256.Size]
+	digest := sha256.Sum256(secret)
+	if subtle.ConstantTimeCompare(digest[:], decrypted[len(secret):]) != 1 {
+		wipeBytes(decrypted)
+		return nil, errEnvelopeIntegrity
+	}
+	return secret, nil
+}
+
+func openHybridEnvelope(key crypto.Decrypter, data []byte, label []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, errEnvelopeIntegrity
+	}
+	keyLen := int(binary.BigEndian.Uint16(data))
+	rest := data[2:]
+	if len(rest) < keyLen+AES_GCM_NONCE_SIZE {
+		return nil, errEnvelopeIntegrity
+	}
+	aesKey, err := key.Decrypt(rand.Reader, rest[:keyLen], oaepOptions(label))
+	if err != nil {
+		return nil, err
+	}
+	nonce := rest[keyLen : keyLen+AES_GCM_NONCE_SIZE]
+	plaintext, err := openAesGcm(aesKey, nonce, rest[keyLen+AES_GCM_NONCE_SIZE:], label)
+	wipeBytes(aesKey)
+	return plaintext, err
+}
+
+func openEcdhEnvelope(key ecdhAgreement, data []byte, label []byte) ([]byte, error) {
+	pubLen := len(key.PublicKey().Bytes())
+	if len(data) < pubLen+AES_GCM_NONCE_SIZE {
+		return nil, errEnvelopeIntegrity
+	}
+	ephemeral, err := key.PublicKey().Curve().NewPublicKey(data[:pubLen])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte{}, data[:pubLen]...), key.PublicKey().Bytes()...)
+	aesKey, err := hkdf.Key(sha256.New, shared, salt, string(label), 32)
+	wipeBytes(shared)
+	if err != nil {
+		return nil, err
+	}
+	nonce := data[pubLen : pubLen+AES_GCM_NONCE_SIZE]
+	plaintext, err := openAesGcm(aesKey, nonce, data[pubLen+AES_GCM_NONCE_SIZE:], label)
+	wipeBytes(aesKey)
+	return plaintext, err
+}
+
+func openAesGcm(aesKey []byte, nonce []byte, ciphertext []byte, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, errEnvelopeIntegrity
+	}
+	return plaintext, nil
+}
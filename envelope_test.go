@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The seal functions do what the server does when sending secrets.
+
+// testAgentKey is the key of the applications of the database test suites,
+// whose passwords are sealed with sealTestPassword.
+var testAgentKey, _ = generateAgentKey(KEY_TYPE_RSA)
+
+func sealTestPassword(password string) string {
+	key := testAgentKey.(*RsaAgentKey).key
+	data, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &key.PublicKey, []byte(password),
+		envelopeLabel(ENVELOPE_V2))
+	if err != nil {
+		panic(err)
+	}
+	return ENVELOPE_V2 + ":" + base64.StdEncoding.EncodeToString(data)
+}
+
+func sealLegacyEnvelope(t *testing.T, key *rsa.PrivateKey, secret []byte) string {
+	digest := sha256.Sum256(secret)
+	data, err := rsa.EncryptPKCS1v15(rand.Reader, &key.PublicKey, append(secret, digest[:]...))
+	assert.Nil(t, err)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func sealOaepEnvelope(t *testing.T, key *rsa.PrivateKey, secret []byte) string {
+	data, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &key.PublicKey, secret,
+		envelopeLabel(ENVELOPE_V2))
+	assert.Nil(t, err)
+	return ENVELOPE_V2 + ":" + base64.StdEncoding.EncodeToString(data)
+}
+
+func sealHybridEnvelope(t *testing.T, key *rsa.PrivateKey, secret []byte) string {
+	label := envelopeLabel(ENVELOPE_V3)
+	aesKey := make([]byte, 32)
+	nonce := make([]byte, AES_GCM_NONCE_SIZE)
+	rand.Read(aesKey)
+	rand.Read(nonce)
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &key.PublicKey, aesKey, label)
+	assert.Nil(t, err)
+	block, _ := aes.NewCipher(aesKey)
+	gcm, _ := cipher.NewGCM(block)
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(len(wrapped)))
+	data = append(data, wrapped...)
+	data = append(data, nonce...)
+	data = append(data, gcm.Seal(nil, nonce, secret, label)...)
+	return ENVELOPE_V3 + ":" + base64.StdEncoding.EncodeToString(data)
+}
+
+// sealEcdhEnvelope encrypts to the ECDH key of the agent, which is its
+// envelope public key if it has one.
+func sealEcdhEnvelope(t *testing.T, key AgentKey, secret []byte) string {
+	label := envelopeLabel(ENVELOPE_V4)
+	recipient := key.(*EcdhAgentKey).ecdh.PublicKey()
+	ephemeral, err := recipient.Curve().GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	shared, err := ephemeral.ECDH(recipient)
+	assert.Nil(t, err)
+	salt := append(ephemeral.PublicKey().Bytes(), recipient.Bytes()...)
+	aesKey, err := hkdf.Key(sha256.New, shared, salt, string(label), 32)
+	assert.Nil(t, err)
+	nonce := make([]byte, AES_GCM_NONCE_SIZE)
+	rand.Read(nonce)
+	block, _ := aes.NewCipher(aesKey)
+	gcm, _ := cipher.NewGCM(block)
+	data := append(ephemeral.PublicKey().Bytes(), nonce...)
+	data = append(data, gcm.Seal(nil, nonce, secret, label)...)
+	return ENVELOPE_V4 + ":" + base64.StdEncoding.EncodeToString(data)
+}
+
+func TestOpenEnvelopes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	key := &RsaAgentKey{key: rsaKey}
+	secret := []byte("PasW';drop table `foo`")
+	long := []byte(strings.Repeat("x", 4096))
+
+	for _, envelope := range []string{
+		sealLegacyEnvelope(t, rsaKey, secret),
+		sealOaepEnvelope(t, rsaKey, secret),
+		sealHybridEnvelope(t, rsaKey, secret),
+	} {
+		opened, err := openEnvelope(key, envelope)
+		assert.Nil(t, err)
+		assert.Equal(t, secret, opened)
+	}
+	opened, err := openEnvelope(key, sealHybridEnvelope(t, rsaKey, long))
+	assert.Nil(t, err)
+	assert.Equal(t, long, opened)
+
+	_, err = openEnvelope(key, "v9:"+base64.StdEncoding.EncodeToString(secret))
+	assert.NotNil(t, err)
+}
+
+func TestOpenEcdhEnvelopes(t *testing.T) {
+	secret := []byte("PasW';drop table `foo`")
+	for _, keyType := range []string{KEY_TYPE_ECDSA, KEY_TYPE_ED25519, KEY_TYPE_X25519} {
+		key, err := generateAgentKey(keyType)
+		assert.Nil(t, err)
+		assert.Equal(t, keyType, key.keyType())
+		assert.Equal(t, []string{ENVELOPE_V4}, key.envelopeVersions())
+		opened, err := openEnvelope(key, sealEcdhEnvelope(t, key, secret))
+		assert.Nil(t, err, keyType)
+		assert.Equal(t, secret, opened)
+
+		envelope := sealEcdhEnvelope(t, key, secret)
+		raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(envelope, "v4:"))
+		raw[len(raw)-1] ^= 1
+		_, err = openEnvelope(key, "v4:"+base64.StdEncoding.EncodeToString(raw))
+		assert.Equal(t, errEnvelopeIntegrity, err)
+
+		_, err = openEnvelope(key, "v2:"+strings.TrimPrefix(envelope, "v4:"))
+		assert.NotNil(t, err)
+	}
+	// Only Ed25519 keys need a separate key for envelopes.
+	key, _ := generateAgentKey(KEY_TYPE_ED25519)
+	assert.NotNil(t, key.envelopePublicKey())
+	key, _ = generateAgentKey(KEY_TYPE_X25519)
+	assert.Nil(t, key.envelopePublicKey())
+}
+
+func TestTamperedEnvelopes(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	key := &RsaAgentKey{key: rsaKey}
+
+	data, err := rsa.EncryptPKCS1v15(rand.Reader, &rsaKey.PublicKey,
+		append([]byte("secret"), make([]byte, sha256.Size)...))
+	assert.Nil(t, err)
+	_, err = openEnvelope(key, base64.StdEncoding.EncodeToString(data))
+	assert.Equal(t, errEnvelopeIntegrity, err)
+
+	envelope := sealHybridEnvelope(t, rsaKey, []byte("secret"))
+	raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(envelope, "v3:"))
+	raw[len(raw)-1] ^= 1
+	_, err = openEnvelope(key, "v3:"+base64.StdEncoding.EncodeToString(raw))
+	assert.Equal(t, errEnvelopeIntegrity, err)
+
+	// A version 2 envelope cannot be opened as a version 3 one or the
+	// other way around, since the labels differ.
+	v2 := sealOaepEnvelope(t, rsaKey, []byte("secret"))
+	_, err = openEnvelope(key, "v3:"+strings.TrimPrefix(v2, "v2:"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"time"
+)
+
+// How often expired time-bound grants are looked for between grant cycles
+const EXPIRY_CHECK_INTERVAL = time.Duration(5) * time.Second
+
+// applyTimedGrant applies the grant if it is currently in effect. Outside of
+// its window, the privileges of the grantee are revoked instead.
+func applyTimedGrant(app *Application, grantsResponse *GrantsResponse,
+	connRegistry *ConnRegistry, grant *Grant) *GrantResult {
+	now := time.Now()
+	if grant.notYetValid(now) || grant.hasExpired(now) {
+		return revokeOutsideWindow(app, grantsResponse, connRegistry, grant, now)
+	}
+	grantRes := applyGrant(grantsResponse, connRegistry, grant)
+	if grant.ValidUntil == nil || grantRes.Result != RESULT_APPLIED {
+		return grantRes
+	}
+	err := app.state.trackTimedGrant(&TimedGrant{
+		GrantId:      grant.Id,
+		ConnectionId: grant.ConnectionId,
+		Grantee:      *grantsResponse.granteeFor(grant),
+		ValidUntil:   *grant.ValidUntil,
+	})
+	if err != nil {
+		return unknownErrorGrantResult(grant, err)
+	}
+	return grantRes
+}
+
+func revokeOutsideWindow(app *Application, grantsResponse *GrantsResponse,
+	connRegistry *ConnRegistry, grant *Grant, now time.Time) *GrantResult {
+	regItem := (*connRegistry)[grant.ConnectionId]
+	if regItem.Error != nil {
+		logger.Errorf("Connection issue %s", regItem.Error)
+		return newGrantResult(grant, RESULT_CONNECTION_ISSUE)
+	}
+	grantee := grantsResponse.granteeFor(grant)
+	if err := regItem.Impl.revokeEverything(grantee); err != nil {
+		return unknownErrorGrantResult(grant, err)
+	}
+	if grant.notYetValid(now) {
+		return newGrantResult(grant, RESULT_PENDING)
+	}
+	if app.state.isTimedGrantTracked(grant.Id) {
+		logger.Infof("(%s) Grant %d for %s expired", regItem.Impl.getName(),
+			grant.Id, grantee.Name)
+		err := app.state.recordExpiry(&ExpiryEvent{
+			GrantId:      grant.Id,
+			ConnectionId: grant.ConnectionId,
+			Username:     grantee.Name,
+			ValidUntil:   *grant.ValidUntil,
+			RevokedAt:    now,
+		})
+		if err != nil {
+			return unknownErrorGrantResult(grant, err)
+		}
+	}
+	return newGrantResult(grant, RESULT_EXPIRED)
+}
+
+// enforceExpiries revokes the time-bound grants whose window closed since
+// they were applied. Only the local state is used, so that access is removed
+// on time even when the server is unreachable. Grants that cannot be revoked
+// yet are retried on the next call.
+func (app *Application) enforceExpiries() {
+	now := time.Now()
+	for _, timed := range app.state.expiredTimedGrants(now) {
+		conn, ok := app.state.cachedConnection(timed.ConnectionId)
+		if !ok {
+			logger.Errorf("No cached connection %d to revoke grant %d",
+				timed.ConnectionId, timed.GrantId)
+			continue
+		}
+		regItem := openConnection(app, &conn)
+		if regItem.Error == nil {
+			err := regItem.Impl.revokeEverything(&timed.Grantee)
+			if err != nil {
+				regItem.setAndLogError(err)
+			}
+		}
+		regItem.close()
+		if regItem.Error != nil {
+			logger.Errorf("Could not revoke expired grant %d: %s", timed.GrantId, regItem.Error)
+			continue
+		}
+		logger.Infof("(%s) Grant %d for %s expired", regItem.Impl.getName(),
+			timed.GrantId, timed.Grantee.Name)
+		err := app.state.recordExpiry(&ExpiryEvent{
+			GrantId:      timed.GrantId,
+			ConnectionId: timed.ConnectionId,
+			Username:     timed.Grantee.Name,
+			ValidUntil:   timed.ValidUntil,
+			RevokedAt:    now,
+		})
+		if err != nil {
+			logger.Errorf("Could not record expiry of grant %d: %s", timed.GrantId, err)
+		}
+	}
+}
+
+// waitForNextCycle sleeps for the given duration, enforcing expiries every
+// EXPIRY_CHECK_INTERVAL in the meantime. It returns early when the watcher
+// reports a change.
+func (app *Application) waitForNextCycle(duration time.Duration) {
+	deadline := time.Now().Add(duration)
+	for {
+		app.enforceExpiries()
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return
+		}
+		if remaining > EXPIRY_CHECK_INTERVAL {
+			remaining = EXPIRY_CHECK_INTERVAL
+		}
+		if app.watcher == nil {
+			time.Sleep(remaining)
+			continue
+		}
+		select {
+		case <-app.watcher.changes:
+			return
+		case <-time.After(remaining):
+		}
+	}
+}
@@ -5,23 +5,49 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/flosch/pongo2"
 )
 
 type DatabaseImpl interface {
-	connect(*Connection) error
+	// connect calls password whenever it opens a new connection, and wipes
+	// the password once the connection is established.
+	connect(conn *Connection, password func() (*Secret, error)) error
 	getDB() *sql.DB
 	getName() string
 	userExists(*User) (bool, error)
 	dropUser(*User) error
-	updatePassword(*User) error
-	createUser(*User) error
+	updatePassword(*User, *Secret) error
+	createUser(*User, *Secret) error
+	setValidUntil(*User, *time.Time) error
+	lockUser(*User) error
+	unlockUser(*User) error
+	reassignOwned(*User, string) error
+	roleExists(*Role) (bool, error)
+	createRole(*Role) error
+	dropRole(*Role) error
+	roleMembers(*Role) ([]string, error)
+	grantRole(*Role, string) error
+	revokeRole(*Role, string) error
 	cacheGlobalContextData() error
-	createTemplateContext(string) *pongo2.Context
+	createTemplateContext(*Grantee) *pongo2.Context
 	filterGrants([]Grant, *Connection) []*Grant
-	revokeEverything(string) error
+	revokeEverything(*Grantee) error
+	// revokeConnectionPrivileges revokes the privileges of the grantee in
+	// the database of the connection only, leaving server-wide privileges
+	// and role memberships alone.
+	revokeConnectionPrivileges(*Grantee) error
+	applyColumnPrivileges(*Grantee, []ColumnPrivilege) error
+	applyPolicies(*Grantee, []Policy, *pongo2.Context) error
+	privilegeInventory() (*PrivilegeInventory, error)
+	listAccounts() ([]*DbAccount, error)
+	// inventoryGrantee returns the name of the grantee in the privilege
+	// inventory.
+	inventoryGrantee(*Grantee) string
+	lockAccount(*DbAccount) error
 }
 
 func splitSqlBlock(sqlBlock string) []string {
@@ -38,6 +64,10 @@ func splitSqlBlock(sqlBlock string) []string {
 
 func updateUser(app *Application, grantsResponse *GrantsResponse,
 	connRegistry *ConnRegistry, user *User) *UserResult {
+	if app.state.isTombstoned(user.DatabaseId, user.Username) {
+		logger.Infof("Leaving user %s alone because of its tombstone", user.Username)
+		return newUserResult(user, RESULT_TOMBSTONED)
+	}
 	conn, err := grantsResponse.defaultConnection(user.DatabaseId)
 	if err != nil {
 		return unknownErrorUserResult(user, err)
@@ -47,19 +77,10 @@ func updateUser(app *Application, grantsResponse *GrantsResponse,
 		logger.Errorf("Connection issue %s", regItem.Error)
 		return newUserResult(user, RESULT_CONNECTION_ISSUE)
 	}
-	var userPw string
-	err = nil
-	if user.DecryptedPassword != "" {
-		userPw = user.DecryptedPassword
-	} else if user.EncryptedPassword == "" {
+	localPasswords := app.conf.Passwords == PASSWORDS_AGENT
+	if !localPasswords && user.EncryptedPassword == "" {
 		return newUserResult(user, RESULT_NO_PASSWORD)
-	} else {
-		userPw, err = decryptPassword(app, user.EncryptedPassword)
-	}
-	if err != nil {
-		return unknownErrorUserResult(user, err)
 	}
-	user.DecryptedPassword = userPw
 	impl := &regItem.Impl
 	exists, err := (*impl).userExists(user)
 	if err != nil {
@@ -68,22 +89,208 @@ func updateUser(app *Application, grantsResponse *GrantsResponse,
 	if !exists && !user.Active {
 		return newUserResult(user, RESULT_APPLIED)
 	}
+	grantee := userGrantee(user.Username)
+	regItems := connRegistry.forDatabase(user.DatabaseId)
 	if !user.Active {
+		// Privileges are per database, so they have to be cleaned up on
+		// every connection before the user can be dropped.
+		if connectionIssue(regItems) {
+			return newUserResult(user, RESULT_CONNECTION_ISSUE)
+		}
+		for _, item := range regItems {
+			if err := item.Impl.revokeEverything(grantee); err != nil {
+				return unknownErrorUserResult(user, err)
+			}
+			if app.conf.DropStrategy != DROP_STRATEGY_REASSIGN {
+				continue
+			}
+			logger.Debugf("(%s) Reassigning objects owned by %s in %s",
+				item.Impl.getName(), user.Username, item.Conn.DbName)
+			if err := item.Impl.reassignOwned(user, app.conf.ReassignOwnedTo); err != nil {
+				return unknownErrorUserResult(user, err)
+			}
+		}
 		if err := (*impl).dropUser(user); err != nil {
+			if blocked, ok := err.(*DropBlockedError); ok {
+				return dropBlockedUserResult(user, blocked)
+			}
+			return unknownErrorUserResult(user, err)
+		}
+		forgetUndelivered(app, user.DatabaseId, user.Username)
+		if err := app.state.removeLocalPassword(user.DatabaseId, user.Username); err != nil {
+			return unknownErrorUserResult(user, err)
+		}
+		if err := app.state.setUserExpiry(user.DatabaseId, user.Username, nil); err != nil {
 			return unknownErrorUserResult(user, err)
 		}
 		return newUserResult(user, RESULT_REVOKED)
 	}
-	if exists {
-		if err := (*impl).updatePassword(user); err != nil {
+	var local *LocalPassword
+	if localPasswords {
+		if local, err = applyLocalPassword(app, conn, impl, user, exists); err != nil {
 			return unknownErrorUserResult(user, err)
 		}
-		return newUserResult(user, RESULT_APPLIED)
+	} else {
+		// The password is only decrypted now, and wiped as soon as it was
+		// set and delivered.
+		password, err := decryptSecret(app, user.EncryptedPassword)
+		if err == nil && exists {
+			err = (*impl).updatePassword(user, password)
+		} else if err == nil {
+			err = (*impl).createUser(user, password)
+		}
+		if err == nil {
+			err = deliverServerPassword(app, conn, user, password)
+		}
+		password.wipe()
+		if err != nil {
+			return unknownErrorUserResult(user, err)
+		}
+	}
+	if err := applyUserExpiry(app, impl, user, grantsResponse.userValidUntil(user)); err != nil {
+		return unknownErrorUserResult(user, err)
 	}
-	if err := (*impl).createUser(user); err != nil {
+	err = revokeOnUngrantedConnections(regItems, grantee,
+		func(connId int) bool { return grantsResponse.hasGrantOn(user.Id, 0, connId) })
+	if err != nil {
 		return unknownErrorUserResult(user, err)
 	}
-	return newUserResult(user, RESULT_APPLIED)
+	userResult := newUserResult(user, RESULT_APPLIED)
+	if local != nil {
+		userResult.PasswordFingerprint = local.Fingerprint
+	}
+	return userResult
+}
+
+// applyUserExpiry makes the user expire with its grants when they are all
+// time-bound. The expiry is only cleared if the agent set it, leaving alone
+// users it never set one on, such as those with an expiry set by a DBA.
+func applyUserExpiry(app *Application, impl *DatabaseImpl, user *User,
+	validUntil *time.Time) error {
+	if validUntil == nil && !app.state.hasUserExpiry(user.DatabaseId, user.Username) {
+		return nil
+	}
+	if err := (*impl).setValidUntil(user, validUntil); err != nil {
+		return err
+	}
+	return app.state.setUserExpiry(user.DatabaseId, user.Username, validUntil)
+}
+
+// revokeOnUngrantedConnections revokes the privileges of the grantee on
+// every connection it has no grant for, since those may be left over from a
+// grant that has since been removed. Connections with a grant are taken
+// care of when the grant is applied. Only the privileges in the database of
+// each connection are revoked, as server-wide ones and memberships would
+// otherwise be revoked and granted again on every cycle.
+func revokeOnUngrantedConnections(regItems []*RegistryItem, grantee *Grantee,
+	hasGrant func(int) bool) error {
+	for _, item := range regItems {
+		if item.Error != nil || hasGrant(item.Conn.Id) {
+			continue
+		}
+		logger.Debugf("(%s) Revoking privileges of %s in %s",
+			item.Impl.getName(), grantee.Name, item.Conn.DbName)
+		if err := item.Impl.revokeConnectionPrivileges(grantee); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func updateRole(grantsResponse *GrantsResponse, connRegistry *ConnRegistry,
+	role *Role) *RoleResult {
+	conn, err := grantsResponse.defaultConnection(role.DatabaseId)
+	if err != nil {
+		return unknownErrorRoleResult(role, err)
+	}
+	regItem := (*connRegistry)[conn.Id]
+	if regItem.Error != nil {
+		logger.Errorf("Connection issue %s", regItem.Error)
+		return newRoleResult(role, RESULT_CONNECTION_ISSUE)
+	}
+	impl := &regItem.Impl
+	exists, err := (*impl).roleExists(role)
+	if err != nil {
+		return unknownErrorRoleResult(role, err)
+	}
+	if !exists && !role.Active {
+		return newRoleResult(role, RESULT_APPLIED)
+	}
+	regItems := connRegistry.forDatabase(role.DatabaseId)
+	if !role.Active {
+		if connectionIssue(regItems) {
+			return newRoleResult(role, RESULT_CONNECTION_ISSUE)
+		}
+		for _, item := range regItems {
+			if err := item.Impl.revokeEverything(role.grantee()); err != nil {
+				return unknownErrorRoleResult(role, err)
+			}
+		}
+		if err := (*impl).dropRole(role); err != nil {
+			return unknownErrorRoleResult(role, err)
+		}
+		return newRoleResult(role, RESULT_REVOKED)
+	}
+	if !exists {
+		if err := (*impl).createRole(role); err != nil {
+			return unknownErrorRoleResult(role, err)
+		}
+	}
+	err = revokeOnUngrantedConnections(regItems, role.grantee(),
+		func(connId int) bool { return grantsResponse.hasGrantOn(0, role.Id, connId) })
+	if err != nil {
+		return unknownErrorRoleResult(role, err)
+	}
+	return newRoleResult(role, RESULT_APPLIED)
+}
+
+// reconcileRoleMembers grants the role to every listed member that does not
+// have it yet, and revokes it from DbRhino-managed users that are no longer
+// listed. Memberships of users DbRhino does not manage are left alone.
+func reconcileRoleMembers(app *Application, grantsResponse *GrantsResponse,
+	connRegistry *ConnRegistry, role *Role) *RoleResult {
+	conn, err := grantsResponse.defaultConnection(role.DatabaseId)
+	if err != nil {
+		return unknownErrorRoleResult(role, err)
+	}
+	regItem := (*connRegistry)[conn.Id]
+	if regItem.Error != nil {
+		return newRoleResult(role, RESULT_CONNECTION_ISSUE)
+	}
+	impl := &regItem.Impl
+	current, err := (*impl).roleMembers(role)
+	if err != nil {
+		return unknownErrorRoleResult(role, err)
+	}
+	isMember := map[string]bool{}
+	for _, member := range current {
+		isMember[member] = true
+	}
+	desired := map[string]bool{}
+	for _, member := range role.Members {
+		if app.state.isTombstoned(role.DatabaseId, member) {
+			continue
+		}
+		desired[member] = true
+		if isMember[member] {
+			continue
+		}
+		logger.Debugf("(%s) Granting role %s to %s", (*impl).getName(), role.Name, member)
+		if err := (*impl).grantRole(role, member); err != nil {
+			return unknownErrorRoleResult(role, err)
+		}
+	}
+	managed := grantsResponse.usernamesForDatabase(role.DatabaseId)
+	for _, member := range current {
+		if desired[member] || !managed[member] {
+			continue
+		}
+		logger.Debugf("(%s) Revoking role %s from %s", (*impl).getName(), role.Name, member)
+		if err := (*impl).revokeRole(role, member); err != nil {
+			return unknownErrorRoleResult(role, err)
+		}
+	}
+	return newRoleResult(role, RESULT_APPLIED)
 }
 
 var GRANT_REGEX = regexp.MustCompile(`(?i)^\s*grant\s+`)
@@ -92,56 +299,74 @@ func isGrantSql(sql string) bool {
 	return GRANT_REGEX.MatchString(sql)
 }
 
-func applyGrantStatements(impl *DatabaseImpl, grant *Grant) *GrantResult {
+// renderGrantStatements renders the statement templates of the grant into
+// the individual SQL statements to run.
+func renderGrantStatements(impl *DatabaseImpl, grantee *Grantee, grant *Grant) ([]string, *pongo2.Context, error) {
 	// SetAutoescape must be called in order for the templating engine to
 	// just treat this as a text template. This function call is global,
 	// but this repo never deals with HTML templates.
 	pongo2.SetAutoescape(false)
-	templateContext := (*impl).createTemplateContext(grant.Username)
+	templateContext := (*impl).createTemplateContext(grantee)
+	var sqls []string
 	for _, stmt := range grant.Statements {
 		compiled, err := pongo2.FromString(stmt)
 		if err != nil {
 			msg := fmt.Sprintf("Could not compile template << %s >> because: %s", stmt, err)
-			newErr := errors.New(msg)
-			return unknownErrorGrantResult(grant, newErr)
+			return nil, nil, errors.New(msg)
 		}
 		rendered, err := compiled.Execute(*templateContext)
 		if err != nil {
+			return nil, nil, err
+		}
+		sqls = append(sqls, splitSqlBlock(rendered)...)
+	}
+	return sqls, templateContext, nil
+}
+
+func applyGrantStatements(impl *DatabaseImpl, grantee *Grantee, grant *Grant) *GrantResult {
+	sqls, templateContext, err := renderGrantStatements(impl, grantee, grant)
+	if err != nil {
+		return unknownErrorGrantResult(grant, err)
+	}
+	for _, sql := range sqls {
+		logger.Debugf("(%s) SQL: %s", (*impl).getName(), sql)
+		if !isGrantSql(sql) {
+			err = errors.New("Non-grant statement found")
 			return unknownErrorGrantResult(grant, err)
 		}
-		sqls := splitSqlBlock(rendered)
-		for _, sql := range sqls {
-			logger.Debugf("(%s) SQL: %s", (*impl).getName(), sql)
-			if !isGrantSql(sql) {
-				err = errors.New("Non-grant statement found")
-				return unknownErrorGrantResult(grant, err)
-			}
-			if _, err := (*impl).getDB().Exec(sql); err != nil {
-				return unknownErrorGrantResult(grant, err)
-			}
+		if _, err := (*impl).getDB().Exec(sql); err != nil {
+			return unknownErrorGrantResult(grant, err)
 		}
 	}
+	if err := (*impl).applyColumnPrivileges(grantee, grant.ColumnPrivileges); err != nil {
+		return unknownErrorGrantResult(grant, err)
+	}
+	if err := (*impl).applyPolicies(grantee, grant.Policies, templateContext); err != nil {
+		return unknownErrorGrantResult(grant, err)
+	}
 	return newGrantResult(grant, RESULT_APPLIED)
 }
 
-func applyGrant(connRegistry *ConnRegistry, grant *Grant) *GrantResult {
+func applyGrant(grantsResponse *GrantsResponse, connRegistry *ConnRegistry,
+	grant *Grant) *GrantResult {
 	regItem := (*connRegistry)[grant.ConnectionId]
 	if regItem.Error != nil {
 		logger.Errorf("Connection issue %s", regItem.Error)
 		return newGrantResult(grant, RESULT_CONNECTION_ISSUE)
 	}
 	impl := &regItem.Impl
+	grantee := grantsResponse.granteeFor(grant)
 	txn, err := (*impl).getDB().Begin()
 	var grantRes *GrantResult = nil
 	if err != nil {
 		return unknownErrorGrantResult(grant, err)
 	}
-	if err = (*impl).revokeEverything(grant.Username); err != nil {
+	if err = (*impl).revokeEverything(grantee); err != nil {
 		txn.Rollback()
 		return unknownErrorGrantResult(grant, err)
 	}
 	logger.Debugf("(%s) Revoked everything for %s", (*impl).getName(), grant.Username)
-	grantRes = applyGrantStatements(impl, grant)
+	grantRes = applyGrantStatements(impl, grantee, grant)
 	if err := grantRes.Error; err != nil {
 		txn.Rollback()
 	} else if err := txn.Commit(); err != nil {
@@ -152,66 +377,143 @@ func applyGrant(connRegistry *ConnRegistry, grant *Grant) *GrantResult {
 }
 
 type RegistryItem struct {
+	Conn  *Connection
 	Error error
 	Impl  DatabaseImpl
 }
 
+func (ri *RegistryItem) close() {
+	if ri.Impl != nil && ri.Impl.getDB() != nil {
+		ri.Impl.getDB().Close()
+	}
+}
+
 func (ri *RegistryItem) setAndLogError(err error) {
 	ri.Error = err
 	logger.Errorf("registry item error: %s", err)
 }
 
+func newDatabaseImpl(db *Database) (DatabaseImpl, error) {
+	switch db.Type {
+	case "postgresql":
+		return NewPostgreSQL(db, PgFlavor(&PgNative{})), nil
+	case "redshift":
+		return NewPostgreSQL(db, PgFlavor(&Redshift{})), nil
+	case "mysql":
+		return NewMysql(db), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown database type: %s", db.Type))
+}
+
+// openConnection connects to the database of the connection and caches the
+// data needed to render templates. Any failure is recorded as the error of
+// the returned registry item, which the caller must close in any case.
+func openConnection(app *Application, conn *Connection) *RegistryItem {
+	regItem := &RegistryItem{Conn: conn}
+	db := conn.Database
+	impl, err := newDatabaseImpl(db)
+	if err != nil {
+		regItem.setAndLogError(err)
+		return regItem
+	}
+	regItem.Impl = impl
+	password := func() (*Secret, error) {
+		return decryptSecret(app, db.EncryptedPassword)
+	}
+	if err := regItem.Impl.connect(conn, password); err != nil {
+		regItem.setAndLogError(errors.New(fmt.Sprintf("Error connecting to database: %s", err)))
+		return regItem
+	}
+	if err := regItem.Impl.cacheGlobalContextData(); err != nil {
+		regItem.setAndLogError(err)
+	}
+	return regItem
+}
+
 type ConnRegistry map[int]*RegistryItem
 
-func handleGrantsResponse(app *Application, grantsResponse *GrantsResponse) *CheckinRequest {
-	connRegistry := ConnRegistry{}
-	for _, conn := range grantsResponse.Connections {
-		regItem := &RegistryItem{}
-		connRegistry[conn.Id] = regItem
-		db := conn.Database
-		switch db.Type {
-		case "postgresql":
-			regItem.Impl = NewPostgreSQL(db, PgFlavor(&PgNative{}))
-		case "redshift":
-			regItem.Impl = NewPostgreSQL(db, PgFlavor(&Redshift{}))
-		case "mysql":
-			regItem.Impl = NewMysql(db)
-		default:
-			regItem.setAndLogError(errors.New(fmt.Sprintf("Unknown database type: %s", db.Type)))
-			continue
-		}
-		var connPw string
-		var err error
-		if db.DecryptedPassword != "" {
-			connPw = db.DecryptedPassword
-		} else {
-			connPw, err = decryptPassword(app, db.EncryptedPassword)
-		}
-		if err != nil {
-			regItem.setAndLogError(err)
-			continue
+// forDatabase returns the registry items of every connection to the
+// database, ordered by connection id.
+func (cr *ConnRegistry) forDatabase(databaseId int) []*RegistryItem {
+	var items []*RegistryItem
+	for _, item := range *cr {
+		if item.Conn.Database.Id == databaseId {
+			items = append(items, item)
 		}
-		db.DecryptedPassword = connPw
-		if err := regItem.Impl.connect(&conn); err != nil {
-			regItem.setAndLogError(errors.New(fmt.Sprintf("Error connecting to database: %s", err)))
-			continue
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Conn.Id < items[j].Conn.Id
+	})
+	return items
+}
+
+func connectionIssue(regItems []*RegistryItem) bool {
+	for _, item := range regItems {
+		if item.Error != nil {
+			logger.Errorf("Connection issue %s", item.Error)
+			return true
 		}
-		defer regItem.Impl.getDB().Close()
-		if err := regItem.Impl.cacheGlobalContextData(); err != nil {
+	}
+	return false
+}
+
+func handleGrantsResponse(app *Application, grantsResponse *GrantsResponse) *CheckinRequest {
+	connRegistry := ConnRegistry{}
+	grantsResponse.markManagedRoles()
+	for i := range grantsResponse.Connections {
+		conn := &grantsResponse.Connections[i]
+		if err := grantsResponse.scopeErrors[conn.Database.Id]; err != nil {
+			regItem := &RegistryItem{Conn: conn}
 			regItem.setAndLogError(err)
+			connRegistry[conn.Id] = regItem
 			continue
 		}
+		regItem := openConnection(app, conn)
+		connRegistry[conn.Id] = regItem
+		defer regItem.close()
+	}
+	if err := app.state.cacheConnections(grantsResponse.Connections); err != nil {
+		logger.Errorf("Could not cache connections in the local state: %s", err)
 	}
 	checkin := newCheckinResult()
+	// Roles are created before anything else so that grants can reference
+	// them, but memberships are only reconciled once grants are applied
+	// since revokeEverything also revokes role memberships.
+	roleResults := map[int]*RoleResult{}
+	for _, role := range grantsResponse.Roles {
+		roleResults[role.Id] = updateRole(grantsResponse, &connRegistry, &role)
+	}
 	for _, user := range grantsResponse.Users {
 		userResult := updateUser(app, grantsResponse, &connRegistry, &user)
 		userResult.log()
 		checkin.UserResults = append(checkin.UserResults, userResult)
 	}
-	for _, grant := range grantsResponse.Grants {
-		grantResult := applyGrant(&connRegistry, &grant)
+	drift := newDriftChecker(app, grantsResponse, connRegistry)
+	for i := range grantsResponse.Grants {
+		grant := &grantsResponse.Grants[i]
+		var grantResult *GrantResult
+		if grant.RoleId == 0 && app.state.isTombstoned(grant.DatabaseId, grant.Username) {
+			grantResult = newGrantResult(grant, RESULT_TOMBSTONED)
+		} else if drift.canSkip(grant) {
+			logger.Debugf("Grant %d is unchanged, skipping it", grant.Id)
+			grantResult = newGrantResult(grant, RESULT_APPLIED)
+		} else {
+			grantResult = applyTimedGrant(app, grantsResponse, &connRegistry, grant)
+			drift.track(grant, grantResult)
+		}
 		grantResult.log()
 		checkin.GrantResults = append(checkin.GrantResults, grantResult)
 	}
+	for _, role := range grantsResponse.Roles {
+		roleResult := roleResults[role.Id]
+		if role.Active && roleResult.Result == RESULT_APPLIED {
+			roleResult = reconcileRoleMembers(app, grantsResponse, &connRegistry, &role)
+		}
+		roleResult.log()
+		checkin.RoleResults = append(checkin.RoleResults, roleResult)
+	}
+	drift.finish()
+	checkin.DriftReports = drift.Reports
+	checkin.UnmanagedUsers = findUnmanagedUsers(app, grantsResponse, connRegistry)
 	return checkin
 }
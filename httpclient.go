@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+const SPKI_PIN_PREFIX = "sha256/"
+
+// spkiPin returns the pin of the certificate, in the format used by HPKP
+// and printed by:
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der |
+//	  openssl dgst -sha256 -binary | base64
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return SPKI_PIN_PREFIX + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins accepts the connection if any certificate of the verified
+// chains matches one of the pins. Pinning an issuer keeps working across
+// renewals of the server certificate.
+func verifyPins(pins []string) func(tls.ConnectionState) error {
+	accepted := map[string]bool{}
+	for _, pin := range pins {
+		accepted[pin] = true
+	}
+	return func(state tls.ConnectionState) error {
+		for _, chain := range state.VerifiedChains {
+			for _, cert := range chain {
+				if accepted[spkiPin(cert)] {
+					return nil
+				}
+			}
+		}
+		return errors.New(fmt.Sprintf("The certificate of %s matches none of the pinned keys",
+			state.ServerName))
+	}
+}
+
+func newTlsConfig(conf *HttpConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if conf.CaBundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pemCerts, err := ioutil.ReadFile(conf.CaBundle)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pemCerts) {
+			return nil, errors.New(fmt.Sprintf("No certificate found in %s", conf.CaBundle))
+		}
+		tlsConf.RootCAs = pool
+	}
+	if conf.ClientCert != "" {
+		// The files are read on every handshake, so that renewed
+		// certificates are picked up without a restart.
+		tlsConf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey)
+			if err != nil {
+				logger.Errorf("Could not load the client certificate: %s", err)
+				return nil, err
+			}
+			return &cert, nil
+		}
+		if _, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey); err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.ServerPins) > 0 {
+		tlsConf.VerifyConnection = verifyPins(conf.ServerPins)
+	}
+	return tlsConf, nil
+}
+
+func newHttpClient(conf *HttpConfig) (*http.Client, error) {
+	tlsConf, err := newTlsConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	timeout := conf.Timeout
+	if timeout == 0 {
+		timeout = DEFAULT_HTTP_TIMEOUT
+	}
+	connectTimeout := conf.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = DEFAULT_HTTP_CONNECT_TIMEOUT
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConf,
+		TLSHandshakeTimeout: connectTimeout,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// dbrhinoClient returns the client shared by every request to the DbRhino
+// API, so that connections are reused across cycles.
+func (c *Config) dbrhinoClient() (*http.Client, error) {
+	if c.apiClient != nil {
+		return c.apiClient, nil
+	}
+	client, err := newHttpClient(&c.Http)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid HTTP client settings: %s", err))
+	}
+	c.apiClient = client
+	return client, nil
+}
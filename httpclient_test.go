@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "agent"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+	certPath := filepath.Join(dir, "client.crt")
+	keyPath := filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, certPath, keyPath
+}
+
+func TestHttpClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	clientCert, certPath, keyPath := writeTestClientCert(t, dir)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caPath := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0600)
+
+	get := func(httpConf HttpConfig) error {
+		app := &Application{conf: &Config{ServerUrl: server.URL, Http: httpConf}}
+		var result map[string]bool
+		return dbrhinoGetRequest(app, "/api/grants", &result)
+	}
+	full := HttpConfig{CaBundle: caPath, ClientCert: certPath, ClientKey: keyPath}
+	assert.Nil(t, get(full))
+
+	unknownCa := full
+	unknownCa.CaBundle = ""
+	assert.NotNil(t, get(unknownCa))
+	noCert := full
+	noCert.ClientCert = ""
+	assert.NotNil(t, get(noCert))
+
+	pinned := full
+	pinned.ServerPins = []string{"sha256/AAAA", spkiPin(server.Certificate())}
+	assert.Nil(t, get(pinned))
+	pinned.ServerPins = []string{"sha256/AAAA"}
+	err = get(pinned)
+	assert.Contains(t, err.Error(), "matches none of the pinned keys")
+
+	// The client is built once and shared.
+	conf := &Config{ServerUrl: server.URL, Http: full}
+	first, err := conf.dbrhinoClient()
+	assert.Nil(t, err)
+	second, _ := conf.dbrhinoClient()
+	assert.True(t, first == second)
+	assert.Equal(t, DEFAULT_HTTP_TIMEOUT, first.Timeout)
+}
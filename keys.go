@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"time"
+)
+
+// loadKeys reads the current key, and the previous one if a rotation is in
+// progress.
+func (app *Application) loadKeys() error {
+	if app.conf.KeySigner != "" {
+		key, err := newExternalAgentKey(app.conf.KeySigner)
+		if err != nil {
+			return err
+		}
+		app.key = key
+		app.warnIfUnsigned()
+		return nil
+	}
+	key, err := readPrivateKey(app.conf)
+	if err != nil {
+		return err
+	}
+	var previousKey AgentKey
+	if fileExists(app.conf.PreviousPrivateKeyPath) {
+		if previousKey, err = readKeyFile(app.conf, app.conf.PreviousPrivateKeyPath); err != nil {
+			return err
+		}
+	}
+	info, err := os.Stat(app.conf.PrivateKeyPath)
+	if err != nil {
+		return err
+	}
+	app.key = key
+	app.previousKey = previousKey
+	app.keyModTime = info.ModTime()
+	app.warnIfUnsigned()
+	return nil
+}
+
+func (app *Application) warnIfUnsigned() {
+	if app.conf.SignRequests && app.key.signer() == nil {
+		logger.Warningf("%s keys cannot sign, requests to DbRhino are not signed",
+			app.key.keyType())
+	}
+}
+
+// reloadKeysIfChanged picks up a rotation done by the rotate-key command
+// while the server was running.
+func (app *Application) reloadKeysIfChanged() error {
+	if app.conf.KeySigner != "" {
+		return nil
+	}
+	info, err := os.Stat(app.conf.PrivateKeyPath)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(app.keyModTime) {
+		return nil
+	}
+	logger.Info("The private key changed on disk, reloading it")
+	return app.loadKeys()
+}
+
+// savePreviousKeyFile copies the current key file to the previous key path.
+func savePreviousKeyFile(conf *Config) error {
+	data, err := ioutil.ReadFile(conf.PrivateKeyPath)
+	if err != nil {
+		return err
+	}
+	defer wipeBytes(data)
+	if err = ioutil.WriteFile(conf.PreviousPrivateKeyPath, data, 0600); err != nil {
+		os.Remove(conf.PreviousPrivateKeyPath)
+		return err
+	}
+	return nil
+}
+
+// rotateKey replaces the key with a new one, keeping the current one as the
+// previous key until the server confirms it re-encrypted everything.
+func (app *Application) rotateKey() error {
+	if app.conf.KeySigner != "" {
+		return errors.New("Keys held by an external signer must be rotated by the signer")
+	}
+	if app.previousKey != nil || fileExists(app.conf.PreviousPrivateKeyPath) {
+		return errors.New("A key rotation is already in progress")
+	}
+	key, err := generatePrivateKey(app.conf)
+	if err != nil {
+		return err
+	}
+	passphrase, err := app.conf.keyPassphrase()
+	if err != nil {
+		return err
+	}
+	defer wipeBytes(passphrase)
+	// The new key only replaces the current one once both are on disk, so
+	// that no key is lost if the agent stops halfway.
+	tmpPath := app.conf.PrivateKeyPath + ".tmp"
+	if err = writePrivateKey(tmpPath, key, passphrase); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = savePreviousKeyFile(app.conf); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, app.conf.PrivateKeyPath); err != nil {
+		return err
+	}
+	if err = writePublicKey(app.conf, key); err != nil {
+		return err
+	}
+	if err = app.loadKeys(); err != nil {
+		return err
+	}
+	return app.state.setKeyRotatedAt(time.Now())
+}
+
+// announceKeys sends the public keys to the server, and retires the
+// previous key once the server confirms it no longer needs it.
+func (app *Application) announceKeys() error {
+	response, err := sendPubkey(app)
+	if err != nil {
+		return err
+	}
+	if app.previousKey != nil && response.ReencryptionComplete {
+		return app.retirePreviousKey()
+	}
+	return nil
+}
+
+// retirePreviousKey overwrites the previous key file before removing it, and
+// clears the key from memory.
+func (app *Application) retirePreviousKey() error {
+	logger.Info("The server re-encrypted every secret, retiring the previous key")
+	if err := wipeFile(app.conf.PreviousPrivateKeyPath); err != nil {
+		return err
+	}
+	app.previousKey.wipe()
+	app.previousKey = nil
+	return nil
+}
+
+// rotateKeyIfDue rotates the key when the configured rotation period
+// elapsed, and keeps announcing the keys while a rotation is in progress.
+func (app *Application) rotateKeyIfDue() error {
+	if err := app.reloadKeysIfChanged(); err != nil {
+		return err
+	}
+	if app.previousKey != nil {
+		return app.announceKeys()
+	}
+	if app.conf.KeyRotation == 0 || app.conf.KeySigner != "" {
+		return nil
+	}
+	rotatedAt, err := app.state.keyRotatedAt()
+	if err != nil {
+		return err
+	}
+	if time.Since(rotatedAt) < app.conf.KeyRotation {
+		return nil
+	}
+	logger.Info("Rotating the private key as scheduled")
+	if err = app.rotateKey(); err != nil {
+		return err
+	}
+	return app.announceKeys()
+}
+
+// wipeFile overwrites the file with random data and syncs it before
+// removing it, so that the content is gone from the disk as far as the
+// filesystem allows.
+func wipeFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	noise := make([]byte, info.Size())
+	if _, err = rand.Read(noise); err == nil {
+		_, err = f.WriteAt(noise, 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// wipeRsaKey clears the private parts of the key in place.
+func wipeRsaKey(key *rsa.PrivateKey) {
+	wipeBigInt(key.D)
+	for _, prime := range key.Primes {
+		wipeBigInt(prime)
+	}
+	wipeBigInt(key.Precomputed.Dp)
+	wipeBigInt(key.Precomputed.Dq)
+	wipeBigInt(key.Precomputed.Qinv)
+}
+
+func wipeBigInt(n *big.Int) {
+	if n == nil {
+		return
+	}
+	words := n.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	n.SetInt64(0)
+}
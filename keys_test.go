@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	var announced []SendPubkeyRequest
+	complete := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request SendPubkeyRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		announced = append(announced, request)
+		json.NewEncoder(w).Encode(SendPubkeyResponse{ReencryptionComplete: complete})
+	}))
+	defer server.Close()
+	conf := &Config{
+		ServerUrl:              server.URL,
+		PrivateKeyPath:         filepath.Join(dir, "agent.pem"),
+		PublicKeyPath:          filepath.Join(dir, "agent.pub"),
+		KeyType:                KEY_TYPE_RSA,
+		PreviousPrivateKeyPath: filepath.Join(dir, "agent.previous.pem"),
+	}
+	_, err = generateAndWritePrivateKey(conf)
+	assert.Nil(t, err)
+	app := &Application{conf: conf, state: newAgentState("")}
+	assert.Nil(t, app.loadKeys())
+	oldKey := app.key
+	envelope := sealOaepEnvelope(t, oldKey.(*RsaAgentKey).key, []byte("secret"))
+
+	assert.Nil(t, app.rotateKey())
+	assert.NotNil(t, app.rotateKey())
+	assert.NotEqual(t, oldKey, app.key)
+	assert.False(t, fileExists(conf.PrivateKeyPath+".tmp"))
+	password, err := decryptSecret(app, envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("secret"), password.bytes())
+
+	assert.Nil(t, app.announceKeys())
+	assert.NotEmpty(t, announced[0].PreviousPubkey)
+	assert.NotNil(t, app.previousKey)
+
+	previousKey := app.previousKey
+	complete = true
+	assert.Nil(t, app.announceKeys())
+	assert.Nil(t, app.previousKey)
+	assert.False(t, fileExists(conf.PreviousPrivateKeyPath))
+	assert.Equal(t, 0, previousKey.(*RsaAgentKey).key.D.Sign())
+	_, err = decryptSecret(app, envelope)
+	assert.NotNil(t, err)
+}
+
+func TestKeyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf := &Config{
+		PrivateKeyPath: filepath.Join(dir, "agent.pem"),
+		PublicKeyPath:  filepath.Join(dir, "agent.pub"),
+	}
+
+	for _, keyType := range []string{KEY_TYPE_RSA, KEY_TYPE_ECDSA, KEY_TYPE_ED25519, KEY_TYPE_X25519} {
+		conf.KeyType = keyType
+		key, err := generateAndWritePrivateKey(conf)
+		assert.Nil(t, err)
+		data, _ := ioutil.ReadFile(conf.PrivateKeyPath)
+		block, _ := pem.Decode(data)
+		assert.Equal(t, "PRIVATE KEY", block.Type)
+		read, err := readPrivateKey(conf)
+		assert.Nil(t, err)
+		assert.Equal(t, keyType, read.keyType())
+		assert.Equal(t, key.publicKey(), read.publicKey())
+
+		data, _ = ioutil.ReadFile(conf.PublicKeyPath)
+		block, _ = pem.Decode(data)
+		assert.Equal(t, "PUBLIC KEY", block.Type)
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		assert.Nil(t, err)
+		assert.Equal(t, key.publicKey(), pub)
+	}
+
+	// Keys written by older agents are PKCS#1.
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+	})
+	assert.Nil(t, ioutil.WriteFile(conf.PrivateKeyPath, data, 0600))
+	read, err := readPrivateKey(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, KEY_TYPE_RSA, read.keyType())
+	assert.True(t, rsaKey.Equal(read.privateKey()))
+}
+
+func TestEncryptedKeyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	conf := &Config{
+		PrivateKeyPath:    filepath.Join(dir, "agent.pem"),
+		PublicKeyPath:     filepath.Join(dir, "agent.pub"),
+		KeyType:           KEY_TYPE_ECDSA,
+		KeyPassphraseFile: filepath.Join(dir, "passphrase"),
+	}
+	assert.Nil(t, ioutil.WriteFile(conf.KeyPassphraseFile, []byte("correct horse\n"), 0600))
+	key, err := generateAndWritePrivateKey(conf)
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadFile(conf.PrivateKeyPath)
+	block, _ := pem.Decode(data)
+	assert.Equal(t, "ENCRYPTED PRIVATE KEY", block.Type)
+
+	read, err := readPrivateKey(conf)
+	assert.Nil(t, err)
+	assert.Equal(t, key.publicKey(), read.publicKey())
+
+	conf.KeyPassphraseFile = ""
+	conf.KeyPassphraseCommand = "echo 'correct horse'"
+	_, err = readPrivateKey(conf)
+	assert.Nil(t, err)
+	conf.KeyPassphraseCommand = ""
+	conf.KeyPassphrase = "battery staple"
+	_, err = readPrivateKey(conf)
+	assert.Equal(t, errWrongPassphrase, err)
+	conf.KeyPassphrase = ""
+	_, err = readPrivateKey(conf)
+	assert.NotNil(t, err)
+
+	// Keys encrypted by OpenSSL, with PBES2 or the legacy PEM encryption.
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("openssl is not installed")
+	}
+	conf.KeyPassphrase = "correct horse"
+	for _, args := range [][]string{
+		{"genpkey", "-algorithm", "RSA", "-aes-256-cbc", "-pass", "pass:correct horse"},
+		{"genpkey", "-algorithm", "X25519", "-aes-128-cbc", "-pass", "pass:correct horse"},
+		{"genrsa", "-traditional", "-aes256", "-passout", "pass:correct horse"},
+	} {
+		args = append(args, "-out", conf.PrivateKeyPath)
+		output, err := exec.Command("openssl", args...).CombinedOutput()
+		assert.Nil(t, err, string(output))
+		_, err = readPrivateKey(conf)
+		assert.Nil(t, err, args[0])
+	}
+}
+
+func TestPassphraseCommandRunsOnceOnStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	runs := filepath.Join(dir, "runs")
+	conf := &Config{
+		PrivateKeyPath:         filepath.Join(dir, "agent.pem"),
+		PublicKeyPath:          filepath.Join(dir, "agent.pub"),
+		PreviousPrivateKeyPath: filepath.Join(dir, "agent.previous.pem"),
+		KeyType:                KEY_TYPE_ECDSA,
+		KeyPassphraseCommand:   "echo run >> " + runs + "; echo 'correct horse'",
+	}
+	countRuns := func() int {
+		data, _ := ioutil.ReadFile(runs)
+		return strings.Count(string(data), "run")
+	}
+	assert.Nil(t, generatePrivateKeyIfMissing(conf))
+	assert.Equal(t, 1, countRuns())
+
+	// Later starts only read the key, once.
+	assert.Nil(t, generatePrivateKeyIfMissing(conf))
+	app := &Application{conf: conf, state: newAgentState("")}
+	assert.Nil(t, app.loadKeys())
+	assert.Equal(t, 2, countRuns())
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+)
+
+const (
+	KEY_TYPE_RSA     = "rsa"
+	KEY_TYPE_ECDSA   = "ecdsa"
+	KEY_TYPE_ED25519 = "ed25519"
+	KEY_TYPE_X25519  = "x25519"
+)
+
+// AgentKey is the private key of the agent, which opens the envelopes of
+// the secrets sent by the server.
+type AgentKey interface {
+	keyType() string
+	// privateKey and publicKey return keys of the types the x509 package
+	// knows how to encode.
+	privateKey() crypto.PrivateKey
+	publicKey() crypto.PublicKey
+	// envelopePublicKey is the key the server encrypts envelopes to, when
+	// it is not the public key itself.
+	envelopePublicKey() crypto.PublicKey
+	envelopeVersions() []string
+	openEnvelope(version string, data []byte) ([]byte, error)
+	// signer signs requests to DbRhino, and is nil for keys that cannot
+	// sign such as X25519 ones.
+	signer() crypto.Signer
+	wipe()
+}
+
+// RsaAgentKey opens envelopes with RSA-OAEP or PKCS#1 v1.5 for legacy ones.
+type RsaAgentKey struct {
+	key *rsa.PrivateKey
+}
+
+func (rk *RsaAgentKey) keyType() string {
+	return KEY_TYPE_RSA
+}
+
+func (rk *RsaAgentKey) privateKey() crypto.PrivateKey {
+	return rk.key
+}
+
+func (rk *RsaAgentKey) publicKey() crypto.PublicKey {
+	return &rk.key.PublicKey
+}
+
+func (rk *RsaAgentKey) envelopePublicKey() crypto.PublicKey {
+	return nil
+}
+
+func (rk *RsaAgentKey) envelopeVersions() []string {
+	return []string{ENVELOPE_V1, ENVELOPE_V2, ENVELOPE_V3}
+}
+
+func (rk *RsaAgentKey) openEnvelope(version string, data []byte) ([]byte, error) {
+	switch version {
+	case ENVELOPE_V1:
+		return openLegacyEnvelope(rk.key, data)
+	case ENVELOPE_V2:
+		return openOaepEnvelope(rk.key, data, envelopeLabel(version))
+	case ENVELOPE_V3:
+		return openHybridEnvelope(rk.key, data, envelopeLabel(version))
+	}
+	return nil, errors.New(fmt.Sprintf("RSA keys cannot open %s envelopes", version))
+}
+
+func (rk *RsaAgentKey) signer() crypto.Signer {
+	return rk.key
+}
+
+func (rk *RsaAgentKey) wipe() {
+	wipeRsaKey(rk.key)
+}
+
+// EcdhAgentKey opens envelopes through ECDH. The key itself is an ECDSA
+// P-256, an Ed25519 or an X25519 key, and ecdh is its ECDH counterpart.
+type EcdhAgentKey struct {
+	key  crypto.PrivateKey
+	ecdh *ecdh.PrivateKey
+}
+
+func newEcdhAgentKey(key crypto.PrivateKey) (*EcdhAgentKey, error) {
+	var ecdhKey *ecdh.PrivateKey
+	var err error
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		ecdhKey, err = k.ECDH()
+	case ed25519.PrivateKey:
+		ecdhKey, err = ed25519ToX25519(k)
+	case *ecdh.PrivateKey:
+		if k.Curve() != ecdh.X25519() {
+			return nil, errors.New("Only X25519 is supported for raw ECDH keys")
+		}
+		ecdhKey = k
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported key type %T", key))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &EcdhAgentKey{key: key, ecdh: ecdhKey}, nil
+}
+
+// ed25519ToX25519 converts the key the same way as libsodium's
+// crypto_sign_ed25519_sk_to_curve25519, so that the server can derive the
+// X25519 public key from the Ed25519 one as well.
+func ed25519ToX25519(key ed25519.PrivateKey) (*ecdh.PrivateKey, error) {
+	digest := sha512.Sum512(key.Seed())
+	return ecdh.X25519().NewPrivateKey(digest[:32])
+}
+
+func (ek *EcdhAgentKey) keyType() string {
+	switch ek.key.(type) {
+	case *ecdsa.PrivateKey:
+		return KEY_TYPE_ECDSA
+	case ed25519.PrivateKey:
+		return KEY_TYPE_ED25519
+	}
+	return KEY_TYPE_X25519
+}
+
+func (ek *EcdhAgentKey) privateKey() crypto.PrivateKey {
+	return ek.key
+}
+
+func (ek *EcdhAgentKey) publicKey() crypto.PublicKey {
+	switch k := ek.key.(type) {
+	case *ecdsa.PrivateKey:
+		return &k.PublicKey
+	case ed25519.PrivateKey:
+		return k.Public()
+	}
+	return ek.ecdh.PublicKey()
+}
+
+// envelopePublicKey is only needed for Ed25519 keys, whose public key is not
+// usable for ECDH as is.
+func (ek *EcdhAgentKey) envelopePublicKey() crypto.PublicKey {
+	if _, ok := ek.key.(ed25519.PrivateKey); ok {
+		return ek.ecdh.PublicKey()
+	}
+	return nil
+}
+
+func (ek *EcdhAgentKey) envelopeVersions() []string {
+	return []string{ENVELOPE_V4}
+}
+
+func (ek *EcdhAgentKey) openEnvelope(version string, data []byte) ([]byte, error) {
+	if version != ENVELOPE_V4 {
+		return nil, errors.New(fmt.Sprintf("%s keys cannot open %s envelopes",
+			ek.keyType(), version))
+	}
+	return openEcdhEnvelope(ek.ecdh, data, envelopeLabel(version))
+}
+
+func (ek *EcdhAgentKey) signer() crypto.Signer {
+	if signer, ok := ek.key.(crypto.Signer); ok && ek.keyType() != KEY_TYPE_X25519 {
+		return signer
+	}
+	return nil
+}
+
+// wipe clears what it can reach: the crypto/ecdh keys do not expose their
+// memory, so they are only dropped.
+func (ek *EcdhAgentKey) wipe() {
+	switch k := ek.key.(type) {
+	case *ecdsa.PrivateKey:
+		wipeBigInt(k.D)
+	case ed25519.PrivateKey:
+		wipeBytes(k)
+	}
+	ek.ecdh = nil
+}
+
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func newAgentKey(key crypto.PrivateKey) (AgentKey, error) {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		return &RsaAgentKey{key: rsaKey}, nil
+	}
+	return newEcdhAgentKey(key)
+}
+
+func generateAgentKey(keyType string) (AgentKey, error) {
+	logger.Infof("Generating an %s private key", keyType)
+	var key crypto.PrivateKey
+	var err error
+	switch keyType {
+	case KEY_TYPE_RSA:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case KEY_TYPE_ECDSA:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KEY_TYPE_ED25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case KEY_TYPE_X25519:
+		key, err = ecdh.X25519().GenerateKey(rand.Reader)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown key type: %s", keyType))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newAgentKey(key)
+}
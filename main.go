@@ -2,7 +2,7 @@ package main
 
 import (
 	"bufio"
-	"crypto/rsa"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -69,17 +69,85 @@ func readAndHandleConfig() (*Config, error) {
 
 type Application struct {
 	conf *Config
-	key  *rsa.PrivateKey
+	key  AgentKey
+	// previousKey is only set while a key rotation is in progress.
+	previousKey AgentKey
+	keyModTime  time.Time
+	state       *AgentState
+	sinks       []CredentialSink
+	// undelivered holds the passwords set by the agent that some sink has
+	// not received yet, by user.
+	undelivered map[string]*Credential
+	// watcher is only set while long-polling for changes.
+	watcher *ChangeWatcher
+	// grantsEtag is the ETag of the grants last applied without failures,
+	// at lastFullCycle.
+	grantsEtag    string
+	lastFullCycle time.Time
+}
+
+// fullCycleDue tells whether the grants must be applied even if they did
+// not change, to reconcile the databases, look for drift or report expiries.
+func (app *Application) fullCycleDue() bool {
+	if app.grantsEtag == "" || len(app.state.pendingExpiryEvents()) > 0 {
+		return true
+	}
+	interval := app.conf.ReconcileInterval
+	if app.conf.Drift != "" && app.conf.Drift != DRIFT_OFF &&
+		app.conf.DriftCheckInterval < interval {
+		interval = app.conf.DriftCheckInterval
+	}
+	return interval <= 0 || time.Since(app.lastFullCycle) >= interval
+}
+
+// reloadState picks up the changes made to the state by the commands run
+// while the server was running, such as the tombstones of revoke-user. A
+// change of the tombstones calls for a full cycle.
+func (app *Application) reloadState() error {
+	before := strings.Join(app.state.tombstoneKeys(), ",")
+	if err := app.state.reload(); err != nil {
+		return err
+	}
+	if strings.Join(app.state.tombstoneKeys(), ",") != before {
+		app.grantsEtag = ""
+	}
+	return nil
 }
 
 func (app *Application) runGrantFetchAndApply() error {
-	grantsResponse, err := fetchGrants(app.conf)
+	if err := app.reloadState(); err != nil {
+		return err
+	}
+	if err := app.rotateKeyIfDue(); err != nil {
+		logger.Errorf("Could not rotate the private key: %s", err)
+	}
+	etag := ""
+	if !app.fullCycleDue() {
+		etag = app.grantsEtag
+	}
+	grantsResponse, newEtag, err := fetchGrants(app, etag)
+	if err == errNotModified {
+		logger.Debugf("The grants did not change, skipping the cycle")
+		return nil
+	}
 	if err != nil {
 		return err
 	}
+	if app.watcher != nil {
+		app.watcher.update(grantsResponse.Revision, app.key)
+	}
+	app.grantsEtag = ""
 	checkin := handleGrantsResponse(app, grantsResponse)
+	checkin.ExpiryEvents = app.state.pendingExpiryEvents()
 	_, err = sendCheckin(app, checkin)
-	return err
+	if err != nil {
+		return err
+	}
+	if checkin.settled() {
+		app.grantsEtag = newEtag
+		app.lastFullCycle = time.Now()
+	}
+	return app.state.clearExpiryEvents(len(checkin.ExpiryEvents))
 }
 
 func applicationInitialization() *Application {
@@ -88,30 +156,149 @@ func applicationInitialization() *Application {
 	if err != nil {
 		logger.Fatal(err)
 	}
-	key, err := readOrGeneratePrivateKey(conf)
+	if err := generatePrivateKeyIfMissing(conf); err != nil {
+		logger.Fatal(err)
+	}
+	state, err := loadAgentState(conf.StatePath)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	sinks, err := newCredentialSinks(conf)
 	if err != nil {
 		logger.Fatal(err)
 	}
 	app := &Application{
-		conf: conf,
-		key:  key,
+		conf:  conf,
+		state: state,
+		sinks: sinks,
 	}
-	_, err = sendPubkey(app)
-	if err != nil {
+	if err = app.loadKeys(); err != nil {
+		logger.Fatal(err)
+	}
+	if err = app.announceKeys(); err != nil {
 		logger.Fatal(err)
 	}
 	return app
 }
 
+// localInitialization prepares the application for commands that only use
+// local data, which must work without the server or an access token.
+func localInitialization() (*Application, error) {
+	configureLogging()
+	conf, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	if conf.KeySigner == "" && !privateKeyFileExists(conf) {
+		return nil, errors.New("No private key found, the agent must have run at least once")
+	}
+	state, err := loadAgentState(conf.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	app := &Application{
+		conf:  conf,
+		state: state,
+	}
+	if err = app.loadKeys(); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+func databaseAndUsernameArgs(c *cli.Context) (string, string, error) {
+	if c.NArg() != 2 {
+		return "", "", cli.NewExitError("Expected a database name and a username", 2)
+	}
+	return c.Args().Get(0), c.Args().Get(1), nil
+}
+
+func runRevokeUser(c *cli.Context) error {
+	database, username, err := databaseAndUsernameArgs(c)
+	if err != nil {
+		return err
+	}
+	app, err := localInitialization()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := revokeUserLocally(app, database, username, c.Bool("drop")); err != nil {
+		logger.Errorf("Could not revoke %s in %s: %s", username, database, err)
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("Revoked %s in %s, the tombstone stays until cleared\n", username, database)
+	return nil
+}
+
+func runClearTombstone(c *cli.Context) error {
+	database, username, err := databaseAndUsernameArgs(c)
+	if err != nil {
+		return err
+	}
+	app, err := localInitialization()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err := clearTombstone(app, database, username); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Printf("Cleared the tombstone of %s in %s\n", username, database)
+	return nil
+}
+
+func runAudit(c *cli.Context) error {
+	format := c.String("format")
+	if format != "json" && format != "csv" {
+		return cli.NewExitError("The format must be json or csv", 2)
+	}
+	app, err := localInitialization()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	out := os.Stdout
+	if path := c.String("output"); path != "" {
+		out, err = os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		defer out.Close()
+	}
+	records := auditConnections(app, auditTargets(app))
+	if err := writePrivilegeRecords(out, format, records); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+func runRotateKey(c *cli.Context) error {
+	app, err := localInitialization()
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if app.conf.AccessToken == "" {
+		return cli.NewExitError("An access token is needed to upload the new key", 1)
+	}
+	if err = app.rotateKey(); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	// The rotation stays in progress if the upload fails, and the server
+	// process keeps announcing both keys until it succeeds.
+	if err = app.announceKeys(); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println("Generated a new key, the previous one is kept until the server re-encrypts every secret")
+	return nil
+}
+
 func runServer(c *cli.Context) error {
 	app := applicationInitialization()
-	sleepDuration := time.Duration(30) * time.Second
+	app.startWatchingChanges()
 	for {
 		err := app.runGrantFetchAndApply()
 		if err != nil {
 			logger.Errorf("Unknown error during grant cycle: %s", err)
 		}
-		time.Sleep(sleepDuration)
+		app.waitForNextCycle(app.pollInterval())
 	}
 	return nil
 }
@@ -141,6 +328,45 @@ func main() {
 			Name:   "once",
 			Action: runOnce,
 		},
+		cli.Command{
+			Name:      "revoke-user",
+			Usage:     "Immediately revoke a user, without waiting for the server",
+			ArgsUsage: "DATABASE USERNAME",
+			Action:    runRevokeUser,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "drop",
+					Usage: "drop the user instead of disabling its login",
+				},
+			},
+		},
+		cli.Command{
+			Name:      "clear-tombstone",
+			Usage:     "Let the server manage a user revoked with revoke-user again",
+			ArgsUsage: "DATABASE USERNAME",
+			Action:    runClearTombstone,
+		},
+		cli.Command{
+			Name:   "rotate-key",
+			Usage:  "Replace the agent key and upload the new public key",
+			Action: runRotateKey,
+		},
+		cli.Command{
+			Name:   "audit",
+			Usage:  "Export the effective privileges of every user and role",
+			Action: runAudit,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: "json",
+					Usage: "json or csv",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "write to this file instead of stdout",
+				},
+			},
+		},
 	}
 	app.Run(os.Args)
 }
@@ -3,6 +3,8 @@ package main
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 )
 
 type Database struct {
@@ -13,8 +15,24 @@ type Database struct {
 	Port              int    `json:"port"`
 	Username          string `json:"master_username"`
 	EncryptedPassword string `json:"master_password"`
-	DecryptedPassword string `json:"-"`
 	DefaultDatabase   string `json:"default_database"`
+	// Tags are set on the database in DbRhino, and can scope agents.
+	Tags []string `json:"tags"`
+	// ManagedRoles are the roles of the database managed by DbRhino. They
+	// are filled in by the agent, and cached along with the connections so
+	// that the revoke-user command knows them too.
+	ManagedRoles []*Grantee `json:"managed_roles,omitempty"`
+}
+
+// managesRole tells whether the role or group is managed by DbRhino. Other
+// memberships are left for DBAs to manage.
+func (db *Database) managesRole(role *Grantee) bool {
+	for _, managed := range db.ManagedRoles {
+		if managed.Name == role.Name && managed.Kind == role.Kind {
+			return true
+		}
+	}
+	return false
 }
 
 type Connection struct {
@@ -26,35 +44,147 @@ type Connection struct {
 type User struct {
 	Id                int    `json:"id"`
 	EncryptedPassword string `json:"password"`
-	DecryptedPassword string `json:"-"`
 	Active            bool   `json:"active"`
 	Username          string `json:"username"`
 	DatabaseId        int    `json:"database_id"`
 }
 
+// Role is a NOLOGIN group role managed by DbRhino. Privileges are granted
+// to it through regular grants (with RoleId set), and Members lists the
+// usernames that should be granted membership in it. On Redshift a role of
+// kind "group" is managed as a user group rather than a role.
+type Role struct {
+	Id         int      `json:"id"`
+	Name       string   `json:"name"`
+	Kind       string   `json:"kind"`
+	Active     bool     `json:"active"`
+	DatabaseId int      `json:"database_id"`
+	Members    []string `json:"members"`
+}
+
+func (role *Role) grantee() *Grantee {
+	if role.Kind == GRANTEE_GROUP {
+		return &Grantee{Name: role.Name, Kind: GRANTEE_GROUP}
+	}
+	return &Grantee{Name: role.Name, Kind: GRANTEE_ROLE}
+}
+
+const (
+	GRANTEE_USER  = "user"
+	GRANTEE_ROLE  = "role"
+	GRANTEE_GROUP = "group"
+)
+
+// Grantee is whoever receives the privileges of a grant. Most databases
+// treat users and roles alike, but Redshift needs to know which one it is
+// dealing with.
+type Grantee struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+func userGrantee(username string) *Grantee {
+	return &Grantee{Name: username, Kind: GRANTEE_USER}
+}
+
+// ColumnPrivilege grants a privilege on some of the columns of a table
+// only.
+type ColumnPrivilege struct {
+	Schema    string   `json:"schema"`
+	Table     string   `json:"table"`
+	Privilege string   `json:"privilege"`
+	Columns   []string `json:"columns"`
+}
+
+// Policy is a row level security policy that restricts which rows of a
+// table the grantee can access. Using and WithCheck are SQL expressions,
+// rendered with the same template context as the grant statements.
+type Policy struct {
+	Name      string `json:"name"`
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	Command   string `json:"command"`
+	Using     string `json:"using"`
+	WithCheck string `json:"with_check"`
+}
+
 type Grant struct {
-	Id           int      `json:"id"`
-	DatabaseId   int      `json:"database_id"`
-	ConnectionId int      `json:"connection_id"`
-	UserId       int      `json:"database_user_id"`
-	Statements   []string `json:"statements"`
-	Version      string   `json:"version"`
-	Username     string   `json:"username"`
+	Id               int               `json:"id"`
+	DatabaseId       int               `json:"database_id"`
+	ConnectionId     int               `json:"connection_id"`
+	UserId           int               `json:"database_user_id"`
+	RoleId           int               `json:"database_role_id"`
+	Statements       []string          `json:"statements"`
+	ColumnPrivileges []ColumnPrivilege `json:"column_privileges"`
+	Policies         []Policy          `json:"policies"`
+	Version          string            `json:"version"`
+	Username         string            `json:"username"`
+	// ValidFrom and ValidUntil optionally bound the time window in which the
+	// grant is in effect.
+	ValidFrom  *time.Time `json:"valid_from"`
+	ValidUntil *time.Time `json:"valid_until"`
+}
+
+func (grant *Grant) isTimeBound() bool {
+	return grant.ValidFrom != nil || grant.ValidUntil != nil
+}
+
+func (grant *Grant) notYetValid(now time.Time) bool {
+	return grant.ValidFrom != nil && now.Before(*grant.ValidFrom)
+}
+
+func (grant *Grant) hasExpired(now time.Time) bool {
+	return grant.ValidUntil != nil && !now.Before(*grant.ValidUntil)
 }
 
 type GrantsResponse struct {
 	Connections []Connection `json:"connections"`
 	Users       []User       `json:"database_users"`
+	Roles       []Role       `json:"database_roles"`
 	Grants      []Grant      `json:"grants"`
+	// Revision changes whenever the grants do, and is what the agent waits
+	// on when long-polling.
+	Revision string `json:"revision"`
+	// scopeErrors are the reasons why the scope of some databases could not
+	// be checked, by database id.
+	scopeErrors map[int]error
 }
 
+// defaultConnection is the connection users and roles of a database are
+// created and dropped through. It is the connection to the default database
+// when there is one, and the first connection of the database otherwise.
 func (gr *GrantsResponse) defaultConnection(databaseId int) (*Connection, error) {
-	for _, conn := range gr.Connections {
-		if conn.Database.Id == databaseId {
-			return &conn, nil
+	var found *Connection
+	for i := range gr.Connections {
+		conn := &gr.Connections[i]
+		if conn.Database.Id != databaseId {
+			continue
+		}
+		if conn.DbName == conn.Database.DefaultDatabase {
+			return conn, nil
+		}
+		if found == nil {
+			found = conn
+		}
+	}
+	if found == nil {
+		return nil, errors.New(fmt.Sprintf("Default conn not found for DB %d", databaseId))
+	}
+	return found, nil
+}
+
+// hasGrantOn tells whether any grant for the grantee (a user or a role,
+// depending on which id is given) targets the connection.
+func (gr *GrantsResponse) hasGrantOn(userId int, roleId int, connId int) bool {
+	for _, grant := range gr.Grants {
+		if grant.ConnectionId != connId {
+			continue
+		}
+		if (userId != 0 && grant.UserId == userId) || (roleId != 0 && grant.RoleId == roleId) {
+			return true
 		}
 	}
-	return nil, errors.New(fmt.Sprintf("Default conn not found for DB %d", databaseId))
+	return false
 }
 
 func (gr *GrantsResponse) usersForDatabase(info *Database) []User {
@@ -67,6 +197,75 @@ func (gr *GrantsResponse) usersForDatabase(info *Database) []User {
 	return users
 }
 
+func (gr *GrantsResponse) granteeFor(grant *Grant) *Grantee {
+	if grant.RoleId != 0 {
+		for _, role := range gr.Roles {
+			if role.Id == grant.RoleId {
+				return role.grantee()
+			}
+		}
+		return &Grantee{Name: grant.Username, Kind: GRANTEE_ROLE}
+	}
+	return userGrantee(grant.Username)
+}
+
+// userValidUntil returns when the last grant of the user expires, if all of
+// its grants are time-bound. It returns nil if the user has any grant
+// without an end, or no grant at all.
+func (gr *GrantsResponse) userValidUntil(user *User) *time.Time {
+	var validUntil *time.Time
+	for i := range gr.Grants {
+		grant := &gr.Grants[i]
+		if grant.UserId != user.Id {
+			continue
+		}
+		if grant.ValidUntil == nil {
+			return nil
+		}
+		if validUntil == nil || grant.ValidUntil.After(*validUntil) {
+			validUntil = grant.ValidUntil
+		}
+	}
+	return validUntil
+}
+
+// databaseIds lists the id of every database with a connection, in order.
+func (gr *GrantsResponse) databaseIds() []int {
+	seen := map[int]bool{}
+	ids := []int{}
+	for _, conn := range gr.Connections {
+		if !seen[conn.Database.Id] {
+			seen[conn.Database.Id] = true
+			ids = append(ids, conn.Database.Id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// markManagedRoles sets the managed roles of the database of every
+// connection.
+func (gr *GrantsResponse) markManagedRoles() {
+	for _, conn := range gr.Connections {
+		conn.Database.ManagedRoles = []*Grantee{}
+		for _, role := range gr.Roles {
+			if role.DatabaseId == conn.Database.Id {
+				conn.Database.ManagedRoles = append(conn.Database.ManagedRoles, role.grantee())
+			}
+		}
+	}
+}
+
+func (gr *GrantsResponse) usernamesForDatabase(databaseId int) map[string]bool {
+	usernames := map[string]bool{}
+	for _, user := range gr.Users {
+		if user.DatabaseId == databaseId {
+			usernames[user.Username] = true
+		}
+	}
+	return usernames
+}
+
 type Result string
 
 const (
@@ -75,13 +274,33 @@ const (
 	RESULT_REVOKED                 = "revoked"
 	RESULT_NO_PASSWORD             = "no_user_password"
 	RESULT_CONNECTION_ISSUE        = "connection_issue"
+	RESULT_DROP_BLOCKED            = "drop_blocked"
+	RESULT_PENDING                 = "pending"
+	RESULT_EXPIRED                 = "expired"
+	RESULT_TOMBSTONED              = "tombstoned"
 )
 
+// DropBlockedError is returned when a user cannot be dropped because other
+// objects still depend on it.
+type DropBlockedError struct {
+	Username     string
+	Dependencies []string
+}
+
+func (e *DropBlockedError) Error() string {
+	return fmt.Sprintf("Cannot drop user %s, %d dependent objects remain",
+		e.Username, len(e.Dependencies))
+}
+
 type UserResult struct {
-	UserId   int    `json:"database_user_id"`
-	Result   Result `json:"result"`
-	Error    error  `json:"-"`
-	ErrorStr string `json:"error"`
+	UserId       int      `json:"database_user_id"`
+	Result       Result   `json:"result"`
+	Error        error    `json:"-"`
+	ErrorStr     string   `json:"error"`
+	Dependencies []string `json:"dependencies,omitempty"`
+	// PasswordFingerprint identifies the password generated by the agent,
+	// which the server never sees.
+	PasswordFingerprint string `json:"password_fingerprint,omitempty"`
 }
 
 func newUserResult(user *User, result Result) *UserResult {
@@ -95,6 +314,14 @@ func unknownErrorUserResult(user *User, err error) *UserResult {
 	return res
 }
 
+func dropBlockedUserResult(user *User, err *DropBlockedError) *UserResult {
+	res := newUserResult(user, RESULT_DROP_BLOCKED)
+	res.Error = err
+	res.ErrorStr = err.Error()
+	res.Dependencies = err.Dependencies
+	return res
+}
+
 func (ur *UserResult) log() {
 	if ur.Error != nil {
 		logger.Errorf("Error updating user %d: %s", ur.UserId, ur.Error)
@@ -103,6 +330,32 @@ func (ur *UserResult) log() {
 	}
 }
 
+type RoleResult struct {
+	RoleId   int    `json:"database_role_id"`
+	Result   Result `json:"result"`
+	Error    error  `json:"-"`
+	ErrorStr string `json:"error"`
+}
+
+func newRoleResult(role *Role, result Result) *RoleResult {
+	return &RoleResult{RoleId: role.Id, Result: result}
+}
+
+func unknownErrorRoleResult(role *Role, err error) *RoleResult {
+	res := newRoleResult(role, RESULT_UNKNOWN_ERROR)
+	res.Error = err
+	res.ErrorStr = err.Error()
+	return res
+}
+
+func (rr *RoleResult) log() {
+	if rr.Error != nil {
+		logger.Errorf("Error updating role %d: %s", rr.RoleId, rr.Error)
+	} else {
+		logger.Debugf("Role apply result for role %d: %s", rr.RoleId, rr.Result)
+	}
+}
+
 type GrantResult struct {
 	GrantId  int    `json:"grant_id"`
 	Version  string `json:"version"`
@@ -134,22 +387,102 @@ func (gr *GrantResult) log() {
 	}
 }
 
+// ExpiryEvent is reported when the agent revokes a time-bound grant because
+// its window closed.
+type ExpiryEvent struct {
+	GrantId      int       `json:"grant_id"`
+	ConnectionId int       `json:"connection_id"`
+	Username     string    `json:"username"`
+	ValidUntil   time.Time `json:"valid_until"`
+	RevokedAt    time.Time `json:"revoked_at"`
+}
+
+// DbAccount is an account able to log in to a database. Host is only set
+// on MySQL.
+type DbAccount struct {
+	Username string
+	Host     string
+}
+
+// UnmanagedUser is an account found on a database that DbRhino does not
+// manage and that is not ignored.
+type UnmanagedUser struct {
+	DatabaseId int    `json:"database_id"`
+	Username   string `json:"username"`
+	Host       string `json:"host,omitempty"`
+	Locked     bool   `json:"locked"`
+	ErrorStr   string `json:"error,omitempty"`
+}
+
+// DriftReport describes privileges of a grantee that changed on a connection
+// since the grant was last applied. Privileges are formatted as in the
+// grant fingerprints.
+type DriftReport struct {
+	GrantId      int      `json:"grant_id"`
+	ConnectionId int      `json:"connection_id"`
+	Username     string   `json:"username"`
+	Added        []string `json:"added"`
+	Removed      []string `json:"removed"`
+	Diff         string   `json:"diff"`
+}
+
 type CheckinRequest struct {
-	AgentVersion string         `json:"agent_version"`
-	UserResults  []*UserResult  `json:"user_results"`
-	GrantResults []*GrantResult `json:"grant_results"`
+	AgentVersion   string           `json:"agent_version"`
+	UserResults    []*UserResult    `json:"user_results"`
+	RoleResults    []*RoleResult    `json:"role_results"`
+	GrantResults   []*GrantResult   `json:"grant_results"`
+	ExpiryEvents   []*ExpiryEvent   `json:"expiry_events"`
+	UnmanagedUsers []*UnmanagedUser `json:"unmanaged_users"`
+	DriftReports   []*DriftReport   `json:"drift_reports"`
 }
 
 func newCheckinResult() *CheckinRequest {
 	return &CheckinRequest{
-		AgentVersion: AGENT_VERSION,
-		UserResults:  []*UserResult{},
-		GrantResults: []*GrantResult{},
+		AgentVersion:   AGENT_VERSION,
+		UserResults:    []*UserResult{},
+		RoleResults:    []*RoleResult{},
+		GrantResults:   []*GrantResult{},
+		ExpiryEvents:   []*ExpiryEvent{},
+		UnmanagedUsers: []*UnmanagedUser{},
+		DriftReports:   []*DriftReport{},
+	}
+}
+
+func isFinalResult(result Result) bool {
+	switch result {
+	case RESULT_APPLIED, RESULT_REVOKED, RESULT_EXPIRED, RESULT_TOMBSTONED:
+		return true
+	}
+	return false
+}
+
+// settled tells whether every result is final, in which case the same
+// grants need not be applied again until they change. Unmanaged users and
+// drift are left to the periodic full cycles.
+func (c *CheckinRequest) settled() bool {
+	for _, res := range c.UserResults {
+		if !isFinalResult(res.Result) {
+			return false
+		}
+	}
+	for _, res := range c.RoleResults {
+		if !isFinalResult(res.Result) {
+			return false
+		}
+	}
+	for _, res := range c.GrantResults {
+		if !isFinalResult(res.Result) {
+			return false
+		}
 	}
+	return true
 }
 
 type SendPubkeyResponse struct {
 	PubkeyUpdated bool `json:"pubkey_updated"`
+	// ReencryptionComplete is set once every secret sent to the agent is
+	// encrypted with the new key, so that the previous one can be retired.
+	ReencryptionComplete bool `json:"reencryption_complete"`
 }
 
 type SendCheckinResponse struct{}
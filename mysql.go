@@ -2,36 +2,49 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/flosch/pongo2"
 	"github.com/go-sql-driver/mysql"
 )
 
 type Mysql struct {
-	DB       *sql.DB
-	Database *Database
+	DB            *sql.DB
+	Database      *Database
+	DbName        string
+	SupportsRoles bool
+	CachedCatalog *MysqlCatalog
 }
 
 func NewMysql(db *Database) *Mysql {
 	return &Mysql{Database: db}
 }
 
-func (my *Mysql) connect(conn *Connection) error {
+func (my *Mysql) connect(conn *Connection, password func() (*Secret, error)) error {
+	// The user and password are added in front of the DSN of the rest of
+	// the configuration, the same way FormatDSN does.
 	conf := &mysql.Config{
-		User:              conn.Database.Username,
-		Passwd:            conn.Database.DecryptedPassword,
 		Net:               "tcp",
 		Addr:              fmt.Sprintf("%s:%d", conn.Database.Host, conn.Database.Port),
 		InterpolateParams: true,
 	}
-	connStr := conf.FormatDSN()
-	DB, err := sql.Open("mysql", connStr)
-	if err != nil {
-		return err
-	}
-	my.DB = DB
+	my.DbName = conn.DbName
+	user := conn.Database.Username + ":"
+	rest := "@" + conf.FormatDSN()
+	my.DB = sql.OpenDB(&secretConnector{
+		driver:   mysql.MySQLDriver{},
+		password: password,
+		dsn: func(password *Secret) *Secret {
+			dsn := make([]byte, 0, len(user)+len(password.bytes())+len(rest))
+			dsn = append(dsn, user...)
+			dsn = append(dsn, password.bytes()...)
+			return newSecret(append(dsn, rest...))
+		},
+	})
 	return nil
 }
 
@@ -45,6 +58,9 @@ func (my *Mysql) getName() string {
 
 const MYSQL_USER_HOST = "%" // FIXME make this configurable
 
+// Error raised when revoking privileges that were never granted
+const MYSQL_NONEXISTING_GRANT = 1141
+
 func (my *Mysql) userExists(user *User) (bool, error) {
 	sql := "SELECT user, host FROM mysql.user WHERE user = ? AND host = ?"
 	rows, err := my.DB.Query(sql, user.Username, MYSQL_USER_HOST)
@@ -67,10 +83,58 @@ func (my *Mysql) dropUser(user *User) error {
 	return err
 }
 
-func (my *Mysql) updatePassword(user *User) error {
+// reassignOwned does nothing since MySQL accounts do not own objects.
+func (my *Mysql) reassignOwned(user *User, target string) error {
+	return nil
+}
+
+func (my *Mysql) updatePassword(user *User, password *Secret) error {
 	sql := fmt.Sprintf("SET PASSWORD FOR %s = ?",
 		my.fullUsername(user.Username))
-	_, err := my.DB.Exec(sql, user.DecryptedPassword)
+	_, err := my.DB.Exec(sql, password.unsafeString())
+	return err
+}
+
+func (my *Mysql) lockUser(user *User) error {
+	sql := fmt.Sprintf("ALTER USER %s ACCOUNT LOCK", my.fullUsername(user.Username))
+	_, err := my.DB.Exec(sql)
+	return err
+}
+
+func (my *Mysql) unlockUser(user *User) error {
+	sql := fmt.Sprintf("ALTER USER %s ACCOUNT UNLOCK", my.fullUsername(user.Username))
+	_, err := my.DB.Exec(sql)
+	return err
+}
+
+// listAccounts skips locked accounts, which includes MySQL 8 roles. It needs
+// the account_locked column of MySQL 5.7.6 and later.
+func (my *Mysql) listAccounts() ([]*DbAccount, error) {
+	sql := "SELECT user, host FROM mysql.user WHERE account_locked = 'N'"
+	rows, err := my.DB.Query(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	accounts := []*DbAccount{}
+	for rows.Next() {
+		account := &DbAccount{}
+		if err = rows.Scan(&account.Username, &account.Host); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func (my *Mysql) inventoryGrantee(grantee *Grantee) string {
+	return grantee.Name + "@" + MYSQL_USER_HOST
+}
+
+func (my *Mysql) lockAccount(account *DbAccount) error {
+	sql := fmt.Sprintf("ALTER USER %s ACCOUNT LOCK",
+		my.fullRoleName(account.Username, account.Host))
+	_, err := my.DB.Exec(sql)
 	return err
 }
 
@@ -78,21 +142,172 @@ func mysqlQuoteIdent(ident string) string {
 	return "`" + strings.Replace(ident, "`", "``", -1) + "`"
 }
 
-func (my *Mysql) createUser(user *User) error {
+func (my *Mysql) createUser(user *User, password *Secret) error {
 	sql := fmt.Sprintf("CREATE USER %s IDENTIFIED BY ?",
 		my.fullUsername(user.Username))
-	_, err := my.DB.Exec(sql, user.DecryptedPassword)
+	_, err := my.DB.Exec(sql, password.unsafeString())
+	return err
+}
+
+var errMysqlRolesUnsupported = errors.New("Roles require MySQL 8.0 or later")
+
+func (my *Mysql) fullRoleName(name string, host string) string {
+	return mysqlQuoteIdent(name) + "@" + mysqlQuoteIdent(host)
+}
+
+func (my *Mysql) roleExists(role *Role) (bool, error) {
+	if !my.SupportsRoles {
+		return false, errMysqlRolesUnsupported
+	}
+	return my.userExists(&User{Username: role.Name})
+}
+
+func (my *Mysql) createRole(role *Role) error {
+	if !my.SupportsRoles {
+		return errMysqlRolesUnsupported
+	}
+	sql := fmt.Sprintf("CREATE ROLE %s", my.fullUsername(role.Name))
+	_, err := my.DB.Exec(sql)
+	return err
+}
+
+func (my *Mysql) dropRole(role *Role) error {
+	if !my.SupportsRoles {
+		return errMysqlRolesUnsupported
+	}
+	// Dropping a role also revokes it from every account it was granted to
+	sql := fmt.Sprintf("DROP ROLE %s", my.fullUsername(role.Name))
+	_, err := my.DB.Exec(sql)
+	return err
+}
+
+func (my *Mysql) roleMembers(role *Role) ([]string, error) {
+	if !my.SupportsRoles {
+		return nil, errMysqlRolesUnsupported
+	}
+	sql := `SELECT to_user FROM mysql.role_edges
+		WHERE from_user = ? AND from_host = ? AND to_host = ?`
+	rows, err := my.DB.Query(sql, role.Name, MYSQL_USER_HOST, MYSQL_USER_HOST)
+	var members []string
+	if err != nil {
+		return members, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var member string
+		if err = rows.Scan(&member); err != nil {
+			return members, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (my *Mysql) grantRole(role *Role, member string) error {
+	if !my.SupportsRoles {
+		return errMysqlRolesUnsupported
+	}
+	sql := fmt.Sprintf("GRANT %s TO %s", my.fullUsername(role.Name),
+		my.fullUsername(member))
+	if _, err := my.DB.Exec(sql); err != nil {
+		return err
+	}
+	// Granted roles are not active in a session unless they are default
+	// roles, so without this the member would not see any of its privileges.
+	sql = fmt.Sprintf("SET DEFAULT ROLE ALL TO %s", my.fullUsername(member))
+	_, err := my.DB.Exec(sql)
+	return err
+}
+
+func (my *Mysql) revokeRole(role *Role, member string) error {
+	if !my.SupportsRoles {
+		return errMysqlRolesUnsupported
+	}
+	sql := fmt.Sprintf("REVOKE %s FROM %s", my.fullUsername(role.Name),
+		my.fullUsername(member))
+	_, err := my.DB.Exec(sql)
 	return err
 }
 
+// revokeRoleGrants revokes the managed roles granted to the user, since
+// REVOKE ALL PRIVILEGES does not touch role grants. Other roles are left
+// for DBAs to manage.
+func (my *Mysql) revokeRoleGrants(username string) error {
+	sql := `SELECT from_user, from_host FROM mysql.role_edges
+		WHERE to_user = ? AND to_host = ?`
+	rows, err := my.DB.Query(sql, username, MYSQL_USER_HOST)
+	if err != nil {
+		return err
+	}
+	var roles []string
+	for rows.Next() {
+		var name, host string
+		if err = rows.Scan(&name, &host); err != nil {
+			rows.Close()
+			return err
+		}
+		if host == MYSQL_USER_HOST && my.Database.managesRole(&Grantee{Name: name, Kind: GRANTEE_ROLE}) {
+			roles = append(roles, my.fullRoleName(name, host))
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, role := range roles {
+		sql := fmt.Sprintf("REVOKE %s FROM %s", role, my.fullUsername(username))
+		if _, err := my.DB.Exec(sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (my *Mysql) discoverRoleSupport() (bool, error) {
+	var version string
+	if err := my.DB.QueryRow("SELECT VERSION()").Scan(&version); err != nil {
+		return false, err
+	}
+	if strings.Contains(strings.ToLower(version), "mariadb") {
+		return false, nil
+	}
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Could not parse MySQL version %s", version))
+	}
+	return major >= 8, nil
+}
+
+// setValidUntil does nothing, as MySQL has no equivalent of the account
+// expiry of PostgreSQL. Time-bound grants are still revoked on expiry.
+func (my *Mysql) setValidUntil(user *User, validUntil *time.Time) error {
+	return nil
+}
+
 func (my *Mysql) cacheGlobalContextData() error {
+	supportsRoles, err := my.discoverRoleSupport()
+	if err != nil {
+		return err
+	}
+	my.SupportsRoles = supportsRoles
+	catalog, err := my.discoverCatalog()
+	if err != nil {
+		return err
+	}
+	my.CachedCatalog = catalog
 	return nil
 }
 
-func (my *Mysql) createTemplateContext(username string) *pongo2.Context {
+func (my *Mysql) createTemplateContext(grantee *Grantee) *pongo2.Context {
+	databases := MapString(my.CachedCatalog.Databases, mysqlQuoteIdent)
 	return &pongo2.Context{
-		"type":     "mysql",
-		"username": my.fullUsername(username),
+		"type":      "mysql",
+		"databases": databases,
+		// schemas is an alias of databases, matching the PostgreSQL context
+		"schemas":  databases,
+		"tables":   mysqlTemplateObjects(my.CachedCatalog.Tables),
+		"routines": mysqlTemplateObjects(my.CachedCatalog.Routines),
+		"username": my.fullUsername(grantee.Name),
 	}
 }
 
@@ -106,9 +321,43 @@ func (my *Mysql) filterGrants(orig []Grant, conn *Connection) []*Grant {
 	return grants
 }
 
-func (my *Mysql) revokeEverything(username string) error {
+func (my *Mysql) revokeEverything(grantee *Grantee) error {
 	sql := fmt.Sprintf("REVOKE ALL PRIVILEGES, GRANT OPTION FROM %s",
-		my.fullUsername(username))
-	_, err := my.DB.Exec(sql)
-	return err
+		my.fullUsername(grantee.Name))
+	if _, err := my.DB.Exec(sql); err != nil {
+		return err
+	}
+	if !my.SupportsRoles {
+		return nil
+	}
+	return my.revokeRoleGrants(grantee.Name)
+}
+
+// revokeConnectionPrivileges revokes the privileges on the database of the
+// connection. Users can have privileges in several of them, while REVOKE
+// ALL PRIVILEGES also revokes the global ones.
+func (my *Mysql) revokeConnectionPrivileges(grantee *Grantee) error {
+	sql := fmt.Sprintf("REVOKE ALL PRIVILEGES, GRANT OPTION ON %s.* FROM %s",
+		mysqlQuoteIdent(my.DbName), my.fullUsername(grantee.Name))
+	if _, err := my.DB.Exec(sql); err != nil {
+		if myErr, ok := err.(*mysql.MySQLError); ok && myErr.Number == MYSQL_NONEXISTING_GRANT {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (my *Mysql) applyColumnPrivileges(grantee *Grantee, privileges []ColumnPrivilege) error {
+	if len(privileges) > 0 {
+		return errors.New("Column privileges are not supported for MySQL databases")
+	}
+	return nil
+}
+
+func (my *Mysql) applyPolicies(grantee *Grantee, policies []Policy, ctx *pongo2.Context) error {
+	if len(policies) > 0 {
+		return errors.New("Row level security policies are not supported for MySQL databases")
+	}
+	return nil
 }
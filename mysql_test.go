@@ -19,6 +19,7 @@ const MY_MASTER_USER = "root"
 const MY_MASTER_PASS = "password"
 const MY_TESTER_USER = "testUser123"
 const MY_TESTER_PASS = "PasW';drop table `foo`"
+const MY_TESTER_ROLE = "testRole123"
 
 func myTesterUri(username string, password string) string {
 	conf := &mysql.Config{
@@ -51,7 +52,7 @@ func mysqlTestGrantResponse(statements []string) *GrantsResponse {
 					Host:              "localhost",
 					Port:              3306,
 					Username:          MY_MASTER_USER,
-					DecryptedPassword: MY_MASTER_PASS,
+					EncryptedPassword: sealTestPassword(MY_MASTER_PASS),
 					DefaultDatabase:   "dbrhino_agent_tests",
 				},
 				DbName: "dbrhino_agent_tests",
@@ -60,7 +61,7 @@ func mysqlTestGrantResponse(statements []string) *GrantsResponse {
 		Users: []User{
 			User{
 				Id:                1,
-				DecryptedPassword: MY_TESTER_PASS,
+				EncryptedPassword: sealTestPassword(MY_TESTER_PASS),
 				Active:            true,
 				Username:          MY_TESTER_USER,
 				DatabaseId:        1,
@@ -82,10 +83,11 @@ func mysqlTestGrantResponse(statements []string) *GrantsResponse {
 
 func (suite *MysqlTestSuite) SetupTest() {
 	conf := &Config{}
-	app := &Application{conf, nil}
+	app := &Application{conf: conf, key: testAgentKey, state: newAgentState("")}
 	suite.App = app
 	withMysqlTestConnection(myTesterUri(MY_MASTER_USER, MY_MASTER_PASS), func(DB *sql.DB) {
 		DB.Exec("drop user " + MY_TESTER_USER)
+		DB.Exec("drop role " + MY_TESTER_ROLE)
 		tx, err := DB.Begin()
 		assert.Nil(suite.T(), err)
 		execShouldPass(suite.T(), DB, "drop schema if exists test_schema")
@@ -119,6 +121,80 @@ func (suite *MysqlTestSuite) TestBasicGrant() {
 	})
 }
 
+func (suite *MysqlTestSuite) TestCatalogTemplateContext() {
+	grantsResponse := mysqlTestGrantResponse([]string{
+		`{% for db in databases|like:"test\\_%" %}
+		GRANT SELECT ON {{ db }}.* TO {{username}};
+		{% endfor %}`,
+	})
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	grantResult := checkin.GrantResults[0]
+	assert.Equal(t, grantResult.Result, RESULT_APPLIED)
+	assert.Nil(t, grantResult.Error)
+	withMysqlTestConnection(myTesterUri(MY_TESTER_USER, MY_TESTER_PASS), func(DB *sql.DB) {
+		execShouldPass(t, DB, "select * from test_schema.abc")
+	})
+}
+
+func (suite *MysqlTestSuite) TestRoleMembership() {
+	grantsResponse := mysqlTestGrantResponse([]string{
+		"GRANT SELECT ON test_schema.* TO {{username}}",
+	})
+	grantsResponse.Roles = []Role{
+		Role{
+			Id:         1,
+			Name:       MY_TESTER_ROLE,
+			Active:     true,
+			DatabaseId: 1,
+			Members:    []string{MY_TESTER_USER},
+		},
+	}
+	grantsResponse.Grants[0].UserId = 0
+	grantsResponse.Grants[0].RoleId = 1
+	grantsResponse.Grants[0].Username = MY_TESTER_ROLE
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	assert.Len(t, checkin.RoleResults, 1)
+	roleResult := checkin.RoleResults[0]
+	assert.Equal(t, roleResult.RoleId, 1)
+	assert.Equal(t, roleResult.Result, RESULT_APPLIED)
+	assert.Nil(t, roleResult.Error)
+	withMysqlTestConnection(myTesterUri(MY_TESTER_USER, MY_TESTER_PASS), func(DB *sql.DB) {
+		execShouldPass(t, DB, "select * from test_schema.abc")
+	})
+
+	grantsResponse.Roles[0].Members = []string{}
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.RoleResults[0].Result, RESULT_APPLIED)
+	withMysqlTestConnection(myTesterUri(MY_TESTER_USER, MY_TESTER_PASS), func(DB *sql.DB) {
+		_, err := DB.Exec("select * from test_schema.abc")
+		assert.NotNil(t, err)
+	})
+}
+
+func (suite *MysqlTestSuite) TestUnmanagedRoleGrantIsKept() {
+	grantsResponse := mysqlTestGrantResponse([]string{
+		"GRANT SELECT ON test_schema.def TO {{username}}",
+	})
+	t := suite.T()
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+	withMysqlTestConnection(myTesterUri(MY_MASTER_USER, MY_MASTER_PASS), func(DB *sql.DB) {
+		execShouldPass(t, DB, "create role "+MY_TESTER_ROLE)
+		execShouldPass(t, DB, "grant "+MY_TESTER_ROLE+" to "+MY_TESTER_USER)
+	})
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+	withMysqlTestConnection(myTesterUri(MY_MASTER_USER, MY_MASTER_PASS), func(DB *sql.DB) {
+		var count int
+		err := DB.QueryRow(`SELECT count(*) FROM mysql.role_edges
+			WHERE from_user = ? AND to_user = ?`, MY_TESTER_ROLE, MY_TESTER_USER).Scan(&count)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, count)
+	})
+}
+
 func TestMysql(t *testing.T) {
 	suite.Run(t, new(MysqlTestSuite))
 }
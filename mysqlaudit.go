@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+)
+
+// Every query returns the grantee, object type, object, privilege and
+// whether it is grantable. information_schema only lists the privileges the
+// connected user is allowed to see.
+var mysqlPrivilegeQueries = []string{
+	`SELECT GRANTEE, 'global', '*.*', PRIVILEGE_TYPE, IS_GRANTABLE
+		FROM information_schema.USER_PRIVILEGES`,
+	`SELECT GRANTEE, 'database', TABLE_SCHEMA, PRIVILEGE_TYPE, IS_GRANTABLE
+		FROM information_schema.SCHEMA_PRIVILEGES`,
+	`SELECT GRANTEE, 'table', CONCAT(TABLE_SCHEMA, '.', TABLE_NAME),
+			PRIVILEGE_TYPE, IS_GRANTABLE
+		FROM information_schema.TABLE_PRIVILEGES`,
+	`SELECT GRANTEE, 'column',
+			CONCAT(TABLE_SCHEMA, '.', TABLE_NAME, '.', COLUMN_NAME),
+			PRIVILEGE_TYPE, IS_GRANTABLE
+		FROM information_schema.COLUMN_PRIVILEGES`,
+}
+
+// normalizeMysqlGrantee turns 'user'@'host' as found in information_schema
+// into user@host.
+func normalizeMysqlGrantee(grantee string) string {
+	parts := strings.SplitN(grantee, "@", 2)
+	for i, part := range parts {
+		parts[i] = strings.Trim(part, "'")
+	}
+	return strings.Join(parts, "@")
+}
+
+func (my *Mysql) queryPrivilegeRecords(query string) ([]*PrivilegeRecord, error) {
+	rows, err := my.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []*PrivilegeRecord{}
+	for rows.Next() {
+		rec := &PrivilegeRecord{}
+		var grantable string
+		err = rows.Scan(&rec.Grantee, &rec.ObjectType, &rec.Object, &rec.Privilege, &grantable)
+		if err != nil {
+			return nil, err
+		}
+		rec.Grantee = normalizeMysqlGrantee(rec.Grantee)
+		rec.Grantable = grantable == "YES"
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func (my *Mysql) queryRoleEdges() ([]RoleMembership, error) {
+	rows, err := my.DB.Query(`SELECT CONCAT(from_user, '@', from_host),
+			CONCAT(to_user, '@', to_host)
+		FROM mysql.role_edges`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	memberships := []RoleMembership{}
+	for rows.Next() {
+		var ms RoleMembership
+		if err = rows.Scan(&ms.Role, &ms.Member); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, ms)
+	}
+	return memberships, rows.Err()
+}
+
+// privilegeInventory covers the whole server, since MySQL privileges are
+// not scoped to the database of the connection.
+func (my *Mysql) privilegeInventory() (*PrivilegeInventory, error) {
+	inventory := &PrivilegeInventory{
+		Privileges:  []*PrivilegeRecord{},
+		Memberships: []RoleMembership{},
+		ServerWide:  true,
+	}
+	for _, query := range mysqlPrivilegeQueries {
+		records, err := my.queryPrivilegeRecords(query)
+		if err != nil {
+			return nil, err
+		}
+		inventory.Privileges = append(inventory.Privileges, records...)
+	}
+	supportsRoles, err := my.discoverRoleSupport()
+	if err != nil {
+		return nil, err
+	}
+	if supportsRoles {
+		memberships, err := my.queryRoleEdges()
+		if err != nil {
+			return nil, err
+		}
+		inventory.Memberships = memberships
+	}
+	return inventory, nil
+}
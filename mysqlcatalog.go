@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+)
+
+const (
+	MYSQL_KIND_TABLE     = "table"
+	MYSQL_KIND_VIEW      = "view"
+	MYSQL_KIND_FUNCTION  = "function"
+	MYSQL_KIND_PROCEDURE = "procedure"
+)
+
+var mysqlSystemSchemas = []string{
+	"information_schema",
+	"mysql",
+	"performance_schema",
+	"sys",
+}
+
+// MysqlObject is a table, view or routine found in one of the catalog
+// databases.
+type MysqlObject struct {
+	Database string
+	Name     string
+	Kind     string
+}
+
+func (obj *MysqlObject) qualifiedName() string {
+	return mysqlQuoteIdent(obj.Database) + "." + mysqlQuoteIdent(obj.Name)
+}
+
+// templateObject exposes the database under the "schema" key as well, so
+// that the same filters work for MySQL and PostgreSQL objects.
+func (obj *MysqlObject) templateObject() TemplateObject {
+	return TemplateObject{
+		"database":  obj.Database,
+		"schema":    obj.Database,
+		"name":      obj.Name,
+		"kind":      obj.Kind,
+		"qualified": obj.qualifiedName(),
+	}
+}
+
+type MysqlCatalog struct {
+	Databases []string
+	Tables    []*MysqlObject
+	Routines  []*MysqlObject
+}
+
+func mysqlTemplateObjects(objects []*MysqlObject) []TemplateObject {
+	templateObjects := make([]TemplateObject, len(objects))
+	for i, obj := range objects {
+		templateObjects[i] = obj.templateObject()
+	}
+	return templateObjects
+}
+
+func mysqlSystemSchemaFilter(column string) string {
+	quoted := MapString(mysqlSystemSchemas, func(schema string) string {
+		return "'" + schema + "'"
+	})
+	return column + " NOT IN (" + strings.Join(quoted, ", ") + ")"
+}
+
+func (my *Mysql) discoverCatalog() (*MysqlCatalog, error) {
+	catalog := &MysqlCatalog{
+		Databases: []string{},
+		Tables:    []*MysqlObject{},
+		Routines:  []*MysqlObject{},
+	}
+	sql := `SELECT schema_name FROM information_schema.schemata
+		WHERE ` + mysqlSystemSchemaFilter("schema_name") + `
+		ORDER BY schema_name`
+	rows, err := my.DB.Query(sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var database string
+		if err = rows.Scan(&database); err != nil {
+			return nil, err
+		}
+		catalog.Databases = append(catalog.Databases, database)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sql = `SELECT table_schema, table_name, table_type FROM information_schema.tables
+		WHERE ` + mysqlSystemSchemaFilter("table_schema") + `
+		ORDER BY table_schema, table_name`
+	catalog.Tables, err = my.queryObjects(sql, func(tableType string) string {
+		if tableType == "VIEW" {
+			return MYSQL_KIND_VIEW
+		}
+		return MYSQL_KIND_TABLE
+	})
+	if err != nil {
+		return nil, err
+	}
+	sql = `SELECT routine_schema, routine_name, routine_type FROM information_schema.routines
+		WHERE ` + mysqlSystemSchemaFilter("routine_schema") + `
+		ORDER BY routine_schema, routine_name`
+	catalog.Routines, err = my.queryObjects(sql, strings.ToLower)
+	if err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// queryObjects runs a query returning the database, name and type of
+// objects, mapping the type to one of the MYSQL_KIND constants with kindOf.
+func (my *Mysql) queryObjects(sql string, kindOf func(string) string) ([]*MysqlObject, error) {
+	objects := []*MysqlObject{}
+	rows, err := my.DB.Query(sql)
+	if err != nil {
+		return objects, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		obj := &MysqlObject{}
+		var objType string
+		if err = rows.Scan(&obj.Database, &obj.Name, &objType); err != nil {
+			return objects, err
+		}
+		obj.Kind = kindOf(objType)
+		objects = append(objects, obj)
+	}
+	return objects, rows.Err()
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	PASSWORD_LOWER  = "abcdefghijklmnopqrstuvwxyz"
+	PASSWORD_UPPER  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	PASSWORD_DIGITS = "0123456789"
+	// Quotes, backslashes, slashes, @ and spaces are left out as Redshift
+	// refuses them and they are a pain to quote in connection strings.
+	PASSWORD_SYMBOLS = "!#$%&()*+,-.:;<=>?[]^_{|}~"
+)
+
+// generatePassword returns a random password following the policy, with at
+// least one character of every class it allows.
+func generatePassword(policy *PasswordPolicy) (*Secret, error) {
+	classes := []string{PASSWORD_LOWER, PASSWORD_UPPER, PASSWORD_DIGITS}
+	if policy.Symbols {
+		classes = append(classes, PASSWORD_SYMBOLS)
+	}
+	alphabet := strings.Join(classes, "")
+	max := big.NewInt(int64(len(alphabet)))
+	for {
+		password := make([]byte, policy.Length)
+		for i := range password {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				wipeBytes(password)
+				return nil, err
+			}
+			password[i] = alphabet[n.Int64()]
+		}
+		complete := true
+		for _, class := range classes {
+			if !bytes.ContainsAny(password, class) {
+				complete = false
+			}
+		}
+		if complete {
+			return newSecret(password), nil
+		}
+		wipeBytes(password)
+	}
+}
+
+// passwordFingerprint identifies a password without revealing it, so that
+// it can be reported to the server.
+func passwordFingerprint(password *Secret) string {
+	sum := sha256.Sum256(password.bytes())
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// withNewline returns a copy of the secret followed by a newline, which the
+// caller must wipe.
+func withNewline(secret *Secret) *Secret {
+	line := make([]byte, 0, len(secret.bytes())+1)
+	line = append(line, secret.bytes()...)
+	return newSecret(append(line, '\n'))
+}
+
+// Credential is handed to the credential sinks whenever the agent sets the
+// password of a user.
+type Credential struct {
+	DatabaseId   int
+	DatabaseName string
+	Host         string
+	Port         int
+	// DbName is the default database of the connection, which applications
+	// connect to.
+	DbName   string
+	Username string
+	// Password belongs to the caller, which wipes it once delivered.
+	Password  *Secret
+	RotatedAt time.Time
+}
+
+func newCredential(conn *Connection, user *User, password *Secret,
+	rotatedAt time.Time) *Credential {
+	return &Credential{
+		DatabaseId:   conn.Database.Id,
+		DatabaseName: conn.Database.Name,
+		Host:         conn.Database.Host,
+		Port:         conn.Database.Port,
+		DbName:       conn.DbName,
+		Username:     user.Username,
+		Password:     password,
+		RotatedAt:    rotatedAt,
+	}
+}
+
+// CredentialSink delivers credentials to wherever the applications using
+// them can read them.
+type CredentialSink interface {
+	getName() string
+	deliver(*Credential) error
+}
+
+// FileSink writes the password of every user to its own file, named after
+// the database and the user, readable by the agent user only.
+type FileSink struct {
+	Dir string
+}
+
+func (fs *FileSink) getName() string {
+	return "file"
+}
+
+func (fs *FileSink) path(cred *Credential) string {
+	return filepath.Join(fs.Dir, url.PathEscape(cred.DatabaseName),
+		url.PathEscape(cred.Username))
+}
+
+func (fs *FileSink) deliver(cred *Credential) error {
+	path := fs.path(cred)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	line := withNewline(cred.Password)
+	defer line.wipe()
+	if err := ioutil.WriteFile(tmpPath, line.bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// CommandSink runs a shell command for every credential. The password is
+// written to its standard input, and never passed as an argument or an
+// environment variable where other processes could see it.
+type CommandSink struct {
+	Command string
+}
+
+func (cs *CommandSink) getName() string {
+	return "command"
+}
+
+func (cs *CommandSink) deliver(cred *Credential) error {
+	cmd := exec.Command("/bin/sh", "-c", cs.Command)
+	cmd.Env = append(os.Environ(),
+		"DBRHINO_DATABASE_ID="+strconv.Itoa(cred.DatabaseId),
+		"DBRHINO_DATABASE_NAME="+cred.DatabaseName,
+		"DBRHINO_USERNAME="+cred.Username,
+	)
+	line := withNewline(cred.Password)
+	defer line.wipe()
+	cmd.Stdin = bytes.NewReader(line.bytes())
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Credential command failed: %s: %s",
+			err, strings.TrimSpace(string(output))))
+	}
+	return nil
+}
+
+func newCredentialSinks(conf *Config) ([]CredentialSink, error) {
+	sinks := []CredentialSink{}
+	if conf.PasswordFileDir != "" {
+		sinks = append(sinks, &FileSink{Dir: conf.PasswordFileDir})
+	}
+	if conf.PasswordCommand != "" {
+		sinks = append(sinks, &CommandSink{Command: conf.PasswordCommand})
+	}
+	if conf.Vault.Addr != "" {
+		sink, err := newVaultSink(&conf.Vault)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// deliverCredential hands the credential to every sink, and fails if any of
+// them failed.
+func deliverCredential(app *Application, cred *Credential) error {
+	var failed []string
+	for _, sink := range app.sinks {
+		if err := sink.deliver(cred); err != nil {
+			logger.Errorf("Could not deliver the credentials of %s to the %s sink: %s",
+				cred.Username, sink.getName(), err)
+			failed = append(failed, sink.getName())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(fmt.Sprintf("Could not deliver credentials to the %s sinks",
+			strings.Join(failed, ", ")))
+	}
+	return nil
+}
+
+// applyLocalPassword sets a password generated by the agent when the user
+// is created or its password is due for rotation. The new password is
+// recorded as pending before it is set, and only as applied once every sink
+// received it. A failed delivery is retried on the next cycles with the same
+// password, which is kept in memory until then, as rotating again would
+// lock out whoever got it from the sinks that succeeded. The password is
+// only rotated again if the agent restarted in the meantime.
+func applyLocalPassword(app *Application, conn *Connection, impl *DatabaseImpl,
+	user *User, exists bool) (*LocalPassword, error) {
+	local := app.state.localPassword(user.DatabaseId, user.Username)
+	if exists && local != nil && local.PendingDelivery {
+		if cred := app.undelivered[userKey(user.DatabaseId, user.Username)]; cred != nil {
+			return completeDelivery(app, local, cred)
+		}
+		logger.Warningf("(%s) The password of %s was never delivered, rotating it again",
+			(*impl).getName(), user.Username)
+	} else if exists && local != nil && time.Since(local.RotatedAt) < app.conf.PasswordPolicy.Rotation {
+		return local, nil
+	}
+	password, err := generatePassword(&app.conf.PasswordPolicy)
+	if err != nil {
+		return nil, err
+	}
+	local = &LocalPassword{
+		DatabaseId:      user.DatabaseId,
+		Username:        user.Username,
+		Fingerprint:     passwordFingerprint(password),
+		RotatedAt:       time.Now(),
+		PendingDelivery: true,
+	}
+	if err = app.state.saveLocalPassword(local); err != nil {
+		password.wipe()
+		return nil, err
+	}
+	if exists {
+		logger.Infof("(%s) Rotating the password of %s", (*impl).getName(), user.Username)
+		err = (*impl).updatePassword(user, password)
+	} else {
+		err = (*impl).createUser(user, password)
+	}
+	if err != nil {
+		password.wipe()
+		return nil, err
+	}
+	cred := newCredential(conn, user, password, local.RotatedAt)
+	forgetUndelivered(app, user.DatabaseId, user.Username)
+	if app.undelivered == nil {
+		app.undelivered = map[string]*Credential{}
+	}
+	app.undelivered[userKey(user.DatabaseId, user.Username)] = cred
+	return completeDelivery(app, local, cred)
+}
+
+// completeDelivery delivers a password that was set in the database, and
+// records it as applied once every sink received it.
+func completeDelivery(app *Application, local *LocalPassword,
+	cred *Credential) (*LocalPassword, error) {
+	if err := deliverCredential(app, cred); err != nil {
+		return nil, err
+	}
+	forgetUndelivered(app, local.DatabaseId, local.Username)
+	delivered := *local
+	delivered.PendingDelivery = false
+	return &delivered, app.state.saveLocalPassword(&delivered)
+}
+
+// forgetUndelivered wipes the password of the user kept for another
+// delivery, if any.
+func forgetUndelivered(app *Application, databaseId int, username string) {
+	key := userKey(databaseId, username)
+	if cred := app.undelivered[key]; cred != nil {
+		cred.Password.wipe()
+		delete(app.undelivered, key)
+	}
+}
+
+// deliverServerPassword hands the password sent by the server to the sinks
+// after it was set, unless they already received it. The server sends the
+// password on every cycle, so its fingerprint is kept to tell whether it
+// changed.
+func deliverServerPassword(app *Application, conn *Connection, user *User,
+	password *Secret) error {
+	if len(app.sinks) == 0 {
+		return nil
+	}
+	fingerprint := passwordFingerprint(password)
+	local := app.state.localPassword(user.DatabaseId, user.Username)
+	if local != nil && local.Fingerprint == fingerprint {
+		return nil
+	}
+	now := time.Now()
+	if err := deliverCredential(app, newCredential(conn, user, password, now)); err != nil {
+		return err
+	}
+	return app.state.saveLocalPassword(&LocalPassword{
+		DatabaseId:  user.DatabaseId,
+		Username:    user.Username,
+		Fingerprint: fingerprint,
+		RotatedAt:   now,
+	})
+}
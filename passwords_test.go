@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeneratePassword(t *testing.T) {
+	policy := &PasswordPolicy{Length: 20}
+	password, err := generatePassword(policy)
+	assert.Nil(t, err)
+	assert.Len(t, password.bytes(), 20)
+	assert.True(t, bytes.ContainsAny(password.bytes(), PASSWORD_UPPER))
+	assert.True(t, bytes.ContainsAny(password.bytes(), PASSWORD_DIGITS))
+	assert.False(t, bytes.ContainsAny(password.bytes(), PASSWORD_SYMBOLS))
+
+	policy.Symbols = true
+	password, err = generatePassword(policy)
+	assert.Nil(t, err)
+	assert.True(t, bytes.ContainsAny(password.bytes(), PASSWORD_SYMBOLS))
+	longer := newSecret(append([]byte("x"), password.bytes()...))
+	assert.NotEqual(t, passwordFingerprint(password), passwordFingerprint(longer))
+}
+
+func TestCredentialSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sinks")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	outPath := filepath.Join(dir, "command-out")
+	app := &Application{sinks: []CredentialSink{
+		&FileSink{Dir: filepath.Join(dir, "files")},
+		&CommandSink{Command: `echo "$DBRHINO_USERNAME $(cat)" > ` + outPath},
+	}}
+	cred := &Credential{DatabaseId: 1, DatabaseName: "pg/test", Username: "bob", Password: newSecret([]byte("s3cret"))}
+	assert.Nil(t, deliverCredential(app, cred))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "files", "pg%2Ftest", "bob"))
+	assert.Nil(t, err)
+	assert.Equal(t, "s3cret\n", string(data))
+	data, err = ioutil.ReadFile(outPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "bob s3cret\n", string(data))
+
+	app.sinks = []CredentialSink{&CommandSink{Command: "exit 3"}}
+	assert.NotNil(t, deliverCredential(app, cred))
+}
+
+// passwordTestImpl records the passwords set, and must not be asked for
+// anything else.
+type passwordTestImpl struct {
+	DatabaseImpl
+	fingerprints []string
+}
+
+func (pi *passwordTestImpl) getName() string {
+	return "test"
+}
+
+func (pi *passwordTestImpl) createUser(user *User, password *Secret) error {
+	pi.fingerprints = append(pi.fingerprints, passwordFingerprint(password))
+	return nil
+}
+
+func (pi *passwordTestImpl) updatePassword(user *User, password *Secret) error {
+	return pi.createUser(user, password)
+}
+
+type flakySink struct {
+	fail         bool
+	fingerprints []string
+}
+
+func (fs *flakySink) getName() string {
+	return "flaky"
+}
+
+func (fs *flakySink) deliver(cred *Credential) error {
+	if fs.fail {
+		return errors.New("unavailable")
+	}
+	fs.fingerprints = append(fs.fingerprints, passwordFingerprint(cred.Password))
+	return nil
+}
+
+func TestFailedDeliveryIsRetried(t *testing.T) {
+	sink := &flakySink{fail: true}
+	app := &Application{
+		conf:  &Config{PasswordPolicy: PasswordPolicy{Length: 20, Rotation: time.Hour}},
+		state: newAgentState(""),
+		sinks: []CredentialSink{sink},
+	}
+	fake := &passwordTestImpl{}
+	var impl DatabaseImpl = fake
+	conn := &Connection{Id: 1, Database: &Database{Id: 1}}
+	user := &User{Username: "bob", DatabaseId: 1}
+
+	_, err := applyLocalPassword(app, conn, &impl, user, false)
+	assert.NotNil(t, err)
+	assert.Len(t, fake.fingerprints, 1)
+	local := app.state.localPassword(1, "bob")
+	assert.True(t, local.PendingDelivery)
+	assert.Equal(t, fake.fingerprints[0], local.Fingerprint)
+
+	// The same password is delivered again, without rotating it.
+	_, err = applyLocalPassword(app, conn, &impl, user, true)
+	assert.NotNil(t, err)
+	sink.fail = false
+	local, err = applyLocalPassword(app, conn, &impl, user, true)
+	assert.Nil(t, err)
+	assert.False(t, local.PendingDelivery)
+	assert.Len(t, fake.fingerprints, 1)
+	assert.Equal(t, fake.fingerprints, sink.fingerprints)
+	assert.False(t, app.state.localPassword(1, "bob").PendingDelivery)
+	assert.Len(t, app.undelivered, 0)
+
+	local, err = applyLocalPassword(app, conn, &impl, user, true)
+	assert.Nil(t, err)
+	assert.Len(t, fake.fingerprints, 1)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Grantee used in the privilege inventory for privileges granted to PUBLIC
+const PG_PUBLIC_GRANTEE = "PUBLIC"
+
+// pgAclPrivileges maps the letters used in the text form of an aclitem to
+// the privileges they stand for.
+var pgAclPrivileges = map[rune]string{
+	'r': "SELECT",
+	'w': "UPDATE",
+	'a': "INSERT",
+	'd': "DELETE",
+	'D': "TRUNCATE",
+	'x': "REFERENCES",
+	't': "TRIGGER",
+	'X': "EXECUTE",
+	'U': "USAGE",
+	'C': "CREATE",
+	'c': "CONNECT",
+	'T': "TEMPORARY",
+	'm': "MAINTAIN",
+	'R': "RULE",
+}
+
+type pgAclEntry struct {
+	Grantee   string
+	Privilege string
+	Grantable bool
+}
+
+// splitAclItems splits the text form of an aclitem array, as returned by
+// array_to_string, without breaking quoted role names apart.
+func splitAclItems(acl string) []string {
+	items := []string{}
+	quoted := false
+	start := 0
+	for i, r := range acl {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			items = append(items, acl[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(acl) {
+		items = append(items, acl[start:])
+	}
+	return items
+}
+
+// parseAclRole reads a possibly quoted role name at the start of the text
+// and returns it along with the rest of the text.
+func parseAclRole(text string) (string, string) {
+	if !strings.HasPrefix(text, `"`) {
+		end := strings.IndexAny(text, "=/")
+		if end < 0 {
+			return text, ""
+		}
+		return text[:end], text[end:]
+	}
+	var name strings.Builder
+	for i := 1; i < len(text); i++ {
+		if text[i] != '"' {
+			name.WriteByte(text[i])
+			continue
+		}
+		if i+1 < len(text) && text[i+1] == '"' {
+			name.WriteByte('"')
+			i++
+			continue
+		}
+		return name.String(), text[i+1:]
+	}
+	return name.String(), ""
+}
+
+// parseAclItem parses an aclitem of the form grantee=privileges/grantor. An
+// empty grantee stands for PUBLIC, and Redshift prefixes groups with
+// "group ".
+func parseAclItem(item string) ([]pgAclEntry, error) {
+	prefix := ""
+	if strings.HasPrefix(item, "group ") {
+		prefix = "group "
+		item = strings.TrimPrefix(item, "group ")
+	}
+	grantee, rest := parseAclRole(item)
+	if !strings.HasPrefix(rest, "=") {
+		return nil, errors.New(fmt.Sprintf("Invalid aclitem %s", item))
+	}
+	grantee = prefix + grantee
+	if grantee == "" {
+		grantee = PG_PUBLIC_GRANTEE
+	}
+	letters := strings.SplitN(rest[1:], "/", 2)[0]
+	entries := []pgAclEntry{}
+	for _, letter := range letters {
+		if letter == '*' {
+			if len(entries) > 0 {
+				entries[len(entries)-1].Grantable = true
+			}
+			continue
+		}
+		privilege, ok := pgAclPrivileges[letter]
+		if !ok {
+			privilege = string(letter)
+		}
+		entries = append(entries, pgAclEntry{Grantee: grantee, Privilege: privilege})
+	}
+	return entries, nil
+}
+
+// aclRecords builds the privilege records of an object from its owner and
+// ACL. A NULL ACL means the default privileges, where only the owner has
+// access. Objects without an owner of their own, such as columns, have an
+// empty one.
+func aclRecords(objectType, object, owner string, acl sql.NullString) ([]*PrivilegeRecord, error) {
+	records := []*PrivilegeRecord{}
+	if owner != "" {
+		records = append(records, &PrivilegeRecord{
+			Grantee:    owner,
+			ObjectType: objectType,
+			Object:     object,
+			Privilege:  PRIVILEGE_OWNER,
+			Grantable:  true,
+		})
+	}
+	if !acl.Valid {
+		return records, nil
+	}
+	for _, item := range splitAclItems(acl.String) {
+		entries, err := parseAclItem(item)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			records = append(records, &PrivilegeRecord{
+				Grantee:    entry.Grantee,
+				ObjectType: objectType,
+				Object:     object,
+				Privilege:  entry.Privilege,
+				Grantable:  entry.Grantable,
+			})
+		}
+	}
+	return records, nil
+}
+
+// Every query returns the kind, name, owner and ACL of the objects.
+var pgAclQueries = []string{
+	`SELECT 'database', datname, pg_get_userbyid(datdba),
+            array_to_string(datacl, ',')
+        FROM pg_catalog.pg_database
+        WHERE datname = current_database()`,
+	`SELECT 'schema', nspname, pg_get_userbyid(nspowner),
+            array_to_string(nspacl, ',')
+        FROM pg_catalog.pg_namespace
+        WHERE nspname NOT LIKE 'pg_%'
+        AND nspname != 'information_schema'`,
+	`SELECT c.relkind, n.nspname || '.' || c.relname, pg_get_userbyid(c.relowner),
+            array_to_string(c.relacl, ',')
+        FROM pg_catalog.pg_class c
+        JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+        WHERE c.relkind IN ('r', 'p', 'v', 'm', 'S')
+        AND n.nspname NOT LIKE 'pg_%'
+        AND n.nspname != 'information_schema'`,
+}
+
+// pgColumnAclQuery lists the columns with privileges of their own, which
+// belong to the owner of their table.
+const pgColumnAclQuery = `SELECT 'column', n.nspname || '.' || c.relname || '.' || a.attname, '',
+            array_to_string(a.attacl, ',')
+        FROM pg_catalog.pg_attribute a
+        JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+        JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+        WHERE a.attacl IS NOT NULL
+        AND a.attnum > 0
+        AND NOT a.attisdropped
+        AND n.nspname NOT LIKE 'pg_%'
+        AND n.nspname != 'information_schema'`
+
+// pgPolicyQuery lists the roles of every row level security policy, along
+// with the command it applies to.
+const pgPolicyQuery = `SELECT schemaname || '.' || tablename || '.' || policyname, cmd,
+            unnest(roles)::text
+        FROM pg_catalog.pg_policies`
+
+func (pg *PostgreSQL) queryAclRecords(query string) ([]*PrivilegeRecord, error) {
+	rows, err := pg.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []*PrivilegeRecord{}
+	for rows.Next() {
+		var kind, object, owner string
+		var acl sql.NullString
+		if err = rows.Scan(&kind, &object, &owner, &acl); err != nil {
+			return nil, err
+		}
+		if relkind, ok := pgRelkinds[kind]; ok {
+			kind = relkind
+		}
+		objectRecords, err := aclRecords(kind, object, owner, acl)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, objectRecords...)
+	}
+	return records, rows.Err()
+}
+
+// queryPolicyRecords returns a record for every role of every policy, with
+// the command of the policy as the privilege.
+func (pg *PostgreSQL) queryPolicyRecords() ([]*PrivilegeRecord, error) {
+	rows, err := pg.DB.Query(pgPolicyQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []*PrivilegeRecord{}
+	for rows.Next() {
+		rec := &PrivilegeRecord{ObjectType: "policy"}
+		if err = rows.Scan(&rec.Object, &rec.Privilege, &rec.Grantee); err != nil {
+			return nil, err
+		}
+		if rec.Grantee == "public" {
+			rec.Grantee = PG_PUBLIC_GRANTEE
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func (pg *PostgreSQL) queryMemberships(query string) ([]RoleMembership, error) {
+	rows, err := pg.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	memberships := []RoleMembership{}
+	for rows.Next() {
+		var ms RoleMembership
+		if err = rows.Scan(&ms.Role, &ms.Member); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, ms)
+	}
+	return memberships, rows.Err()
+}
+
+// privilegeInventory reads the ACLs of the connected database, its schemas,
+// relations and functions, and where supported those of columns and the
+// policies, along with every role membership of the cluster. It covers
+// everything a grant can give, so that drift of any of it is noticed.
+func (pg *PostgreSQL) privilegeInventory() (*PrivilegeInventory, error) {
+	inventory := &PrivilegeInventory{
+		Privileges:  []*PrivilegeRecord{},
+		Memberships: []RoleMembership{},
+	}
+	queries := append([]string{}, pgAclQueries...)
+	queries = append(queries, pg.Flavor.functionAclsSql())
+	if pg.Flavor.supportsFineGrainedAcls() {
+		queries = append(queries, pgColumnAclQuery)
+	}
+	for _, query := range queries {
+		records, err := pg.queryAclRecords(query)
+		if err != nil {
+			return nil, err
+		}
+		inventory.Privileges = append(inventory.Privileges, records...)
+	}
+	if pg.Flavor.supportsFineGrainedAcls() {
+		records, err := pg.queryPolicyRecords()
+		if err != nil {
+			return nil, err
+		}
+		inventory.Privileges = append(inventory.Privileges, records...)
+	}
+	for _, query := range pg.Flavor.membershipsSql() {
+		memberships, err := pg.queryMemberships(query)
+		if err != nil {
+			return nil, err
+		}
+		inventory.Memberships = append(inventory.Memberships, memberships...)
+	}
+	return inventory, nil
+}
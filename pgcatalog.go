@@ -0,0 +1,164 @@
+package main
+
+import (
+	pglib "github.com/lib/pq"
+)
+
+const (
+	PG_KIND_TABLE             = "table"
+	PG_KIND_VIEW              = "view"
+	PG_KIND_MATERIALIZED_VIEW = "materialized_view"
+	PG_KIND_SEQUENCE          = "sequence"
+	PG_KIND_FUNCTION          = "function"
+)
+
+var pgRelkinds = map[string]string{
+	"r": PG_KIND_TABLE,
+	"p": PG_KIND_TABLE,
+	"v": PG_KIND_VIEW,
+	"m": PG_KIND_MATERIALIZED_VIEW,
+	"S": PG_KIND_SEQUENCE,
+}
+
+// PgObject is a relation or a function found in one of the catalog schemas.
+type PgObject struct {
+	Schema  string
+	Name    string
+	Kind    string
+	Owner   string
+	Columns []string
+	// Arguments holds the identity arguments of functions, which are needed
+	// to reference them unambiguously.
+	Arguments string
+}
+
+func (obj *PgObject) qualifiedName() string {
+	qualified := pglib.QuoteIdentifier(obj.Schema) + "." + pglib.QuoteIdentifier(obj.Name)
+	if obj.Kind == PG_KIND_FUNCTION {
+		qualified += "(" + obj.Arguments + ")"
+	}
+	return qualified
+}
+
+func (obj *PgObject) templateObject() TemplateObject {
+	return TemplateObject{
+		"schema":    obj.Schema,
+		"name":      obj.Name,
+		"kind":      obj.Kind,
+		"owner":     obj.Owner,
+		"columns":   obj.Columns,
+		"arguments": obj.Arguments,
+		"qualified": obj.qualifiedName(),
+	}
+}
+
+type PgCatalog struct {
+	Database        string
+	Schemas         []string
+	ExternalSchemas []string
+	// Objects maps the name of every schema in Schemas to the relations and
+	// functions it contains.
+	Objects map[string][]*PgObject
+}
+
+// templateObjects lists the objects of the given kind, ordered by schema
+// and then by name.
+func (catalog *PgCatalog) templateObjects(kind string) []TemplateObject {
+	objects := []TemplateObject{}
+	for _, schema := range catalog.Schemas {
+		for _, obj := range catalog.Objects[schema] {
+			if obj.Kind == kind {
+				objects = append(objects, obj.templateObject())
+			}
+		}
+	}
+	return objects
+}
+
+type pgRelationKey struct {
+	schema string
+	name   string
+}
+
+func (pg *PostgreSQL) discoverObjects(catalog *PgCatalog) error {
+	catalog.Objects = map[string][]*PgObject{}
+	for _, schema := range catalog.Schemas {
+		catalog.Objects[schema] = []*PgObject{}
+	}
+	relations := map[pgRelationKey]*PgObject{}
+	sql := `SELECT n.nspname, c.relname, c.relkind, pg_get_userbyid(c.relowner)
+        FROM pg_catalog.pg_class c
+        JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+        WHERE c.relkind IN ('r', 'p', 'v', 'm', 'S')
+        ORDER BY n.nspname, c.relname`
+	rows, err := pg.DB.Query(sql)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		obj := &PgObject{Columns: []string{}}
+		var relkind string
+		if err = rows.Scan(&obj.Schema, &obj.Name, &relkind, &obj.Owner); err != nil {
+			return err
+		}
+		if _, ok := catalog.Objects[obj.Schema]; !ok {
+			continue
+		}
+		obj.Kind = pgRelkinds[relkind]
+		catalog.Objects[obj.Schema] = append(catalog.Objects[obj.Schema], obj)
+		relations[pgRelationKey{obj.Schema, obj.Name}] = obj
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if err = pg.discoverColumns(relations); err != nil {
+		return err
+	}
+	return pg.discoverFunctions(catalog)
+}
+
+func (pg *PostgreSQL) discoverColumns(relations map[pgRelationKey]*PgObject) error {
+	sql := `SELECT n.nspname, c.relname, a.attname
+        FROM pg_catalog.pg_attribute a
+        JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+        JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+        WHERE c.relkind IN ('r', 'p', 'v', 'm')
+        AND a.attnum > 0
+        AND NOT a.attisdropped
+        ORDER BY n.nspname, c.relname, a.attnum`
+	rows, err := pg.DB.Query(sql)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var schema, relation, column string
+		if err = rows.Scan(&schema, &relation, &column); err != nil {
+			return err
+		}
+		if obj, ok := relations[pgRelationKey{schema, relation}]; ok {
+			obj.Columns = append(obj.Columns, column)
+		}
+	}
+	return rows.Err()
+}
+
+func (pg *PostgreSQL) discoverFunctions(catalog *PgCatalog) error {
+	rows, err := pg.DB.Query(pg.Flavor.functionsSql())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		obj := &PgObject{Kind: PG_KIND_FUNCTION, Columns: []string{}}
+		if err = rows.Scan(&obj.Schema, &obj.Name, &obj.Arguments, &obj.Owner); err != nil {
+			return err
+		}
+		if _, ok := catalog.Objects[obj.Schema]; !ok {
+			continue
+		}
+		catalog.Objects[obj.Schema] = append(catalog.Objects[obj.Schema], obj)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	pglib "github.com/lib/pq"
+)
+
+// Policies created by the agent are named with this prefix followed by the
+// grantee and the policy name, which is how they are found again when the
+// grantee's privileges are revoked.
+const PG_POLICY_PREFIX = "dbrhino_"
+
+var pgColumnPrivileges = map[string]bool{
+	"SELECT":     true,
+	"INSERT":     true,
+	"UPDATE":     true,
+	"REFERENCES": true,
+}
+
+var pgPolicyCommands = map[string]bool{
+	"ALL":    true,
+	"SELECT": true,
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+}
+
+type pgColumnAcl struct {
+	schema    string
+	table     string
+	column    string
+	privilege string
+}
+
+func pgQualifiedTable(schema string, table string) string {
+	return pglib.QuoteIdentifier(schema) + "." + pglib.QuoteIdentifier(table)
+}
+
+func (pg *PostgreSQL) currentColumnAcls(grantee *Grantee) (map[pgColumnAcl]bool, error) {
+	sql := `SELECT n.nspname, c.relname, a.attname, acl.privilege_type
+        FROM pg_catalog.pg_attribute a
+        JOIN pg_catalog.pg_class c ON c.oid = a.attrelid
+        JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+        CROSS JOIN LATERAL pg_catalog.aclexplode(a.attacl) acl
+        JOIN pg_catalog.pg_roles r ON r.oid = acl.grantee
+        WHERE a.attacl IS NOT NULL
+        AND NOT a.attisdropped
+        AND r.rolname = $1`
+	rows, err := pg.DB.Query(sql, grantee.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	acls := map[pgColumnAcl]bool{}
+	for rows.Next() {
+		acl := pgColumnAcl{}
+		if err = rows.Scan(&acl.schema, &acl.table, &acl.column, &acl.privilege); err != nil {
+			return nil, err
+		}
+		acls[acl] = true
+	}
+	return acls, rows.Err()
+}
+
+// execColumnAcls runs one statement per table and privilege, covering all
+// of the given columns at once. The format must take the privilege, the
+// column list, the table and the grantee, in that order.
+func (pg *PostgreSQL) execColumnAcls(format string, grantee *Grantee, acls []pgColumnAcl) error {
+	type tablePrivilege struct {
+		schema    string
+		table     string
+		privilege string
+	}
+	var order []tablePrivilege
+	columns := map[tablePrivilege][]string{}
+	for _, acl := range acls {
+		key := tablePrivilege{acl.schema, acl.table, acl.privilege}
+		if _, ok := columns[key]; !ok {
+			order = append(order, key)
+		}
+		columns[key] = append(columns[key], pglib.QuoteIdentifier(acl.column))
+	}
+	for _, key := range order {
+		sql := fmt.Sprintf(format, key.privilege, strings.Join(columns[key], ", "),
+			pgQualifiedTable(key.schema, key.table), pg.Flavor.quoteGrantee(grantee))
+		logger.Debugf("(%s) SQL: %s", pg.getName(), sql)
+		if _, err := pg.DB.Exec(sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyColumnPrivileges grants the column privileges that are missing from
+// pg_attribute.attacl. Those no longer wanted were already revoked along
+// with everything else before the grant was applied, and revoking them here
+// would also undo the column grants made by the statements of the grant.
+func (pg *PostgreSQL) applyColumnPrivileges(grantee *Grantee, privileges []ColumnPrivilege) error {
+	if !pg.Flavor.supportsFineGrainedAcls() {
+		if len(privileges) > 0 {
+			return errors.New(fmt.Sprintf("Column privileges are not supported for %s",
+				pg.Flavor.getDbtype()))
+		}
+		return nil
+	}
+	if len(privileges) == 0 {
+		return nil
+	}
+	desired := map[pgColumnAcl]bool{}
+	var desiredOrder []pgColumnAcl
+	for _, priv := range privileges {
+		privilege := strings.ToUpper(strings.TrimSpace(priv.Privilege))
+		if !pgColumnPrivileges[privilege] {
+			return errors.New(fmt.Sprintf("Invalid column privilege: %s", priv.Privilege))
+		}
+		for _, column := range priv.Columns {
+			acl := pgColumnAcl{priv.Schema, priv.Table, column, privilege}
+			if !desired[acl] {
+				desired[acl] = true
+				desiredOrder = append(desiredOrder, acl)
+			}
+		}
+	}
+	current, err := pg.currentColumnAcls(grantee)
+	if err != nil {
+		return err
+	}
+	var missing []pgColumnAcl
+	for _, acl := range desiredOrder {
+		if !current[acl] {
+			missing = append(missing, acl)
+		}
+	}
+	return pg.execColumnAcls("GRANT %s (%s) ON %s TO %s", grantee, missing)
+}
+
+// revokeColumnPrivileges revokes every column privilege of the grantee,
+// which REVOKE ALL ON ALL TABLES leaves in place.
+func (pg *PostgreSQL) revokeColumnPrivileges(grantee *Grantee) error {
+	current, err := pg.currentColumnAcls(grantee)
+	if err != nil {
+		return err
+	}
+	var acls []pgColumnAcl
+	for acl := range current {
+		acls = append(acls, acl)
+	}
+	sort.Slice(acls, func(i, j int) bool {
+		a, b := acls[i], acls[j]
+		if a.schema != b.schema {
+			return a.schema < b.schema
+		}
+		if a.table != b.table {
+			return a.table < b.table
+		}
+		if a.privilege != b.privilege {
+			return a.privilege < b.privilege
+		}
+		return a.column < b.column
+	})
+	return pg.execColumnAcls("REVOKE %s (%s) ON %s FROM %s", grantee, acls)
+}
+
+func pgPolicyName(grantee *Grantee, policy *Policy) string {
+	return PG_POLICY_PREFIX + grantee.Name + "_" + policy.Name
+}
+
+func (pg *PostgreSQL) rowSecurityEnabled(schema string, table string) (bool, error) {
+	sql := `SELECT c.relrowsecurity
+        FROM pg_catalog.pg_class c
+        JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+        WHERE n.nspname = $1 AND c.relname = $2`
+	var enabled bool
+	if err := pg.DB.QueryRow(sql, schema, table).Scan(&enabled); err != nil {
+		return false, err
+	}
+	return enabled, nil
+}
+
+// validatePolicyExpression makes sure the expression cannot end the
+// parenthesis it is placed in, nor start another statement, since unlike
+// the statements of grants it is not checked with isGrantSql.
+func validatePolicyExpression(expr string) error {
+	if strings.Contains(expr, ";") || strings.Contains(expr, "--") ||
+		strings.Contains(expr, "/*") || strings.Contains(expr, "*/") {
+		return errors.New(fmt.Sprintf("Policy expressions cannot contain ; or comments: %s", expr))
+	}
+	depth := 0
+	var quote rune
+	for _, c := range expr {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return errors.New(fmt.Sprintf("Unbalanced parentheses in policy expression: %s", expr))
+			}
+		}
+	}
+	if quote != 0 {
+		return errors.New(fmt.Sprintf("Unterminated quote in policy expression: %s", expr))
+	}
+	if depth != 0 {
+		return errors.New(fmt.Sprintf("Unbalanced parentheses in policy expression: %s", expr))
+	}
+	return nil
+}
+
+func renderPolicyExpression(expr string, ctx *pongo2.Context) (string, error) {
+	compiled, err := pongo2.FromString(expr)
+	if err != nil {
+		return "", err
+	}
+	rendered, err := compiled.Execute(*ctx)
+	if err != nil {
+		return "", err
+	}
+	return rendered, validatePolicyExpression(rendered)
+}
+
+// applyPolicies creates a policy scoped to the grantee for each of the given
+// policies. Row level security is deliberately not enabled by the agent, as
+// that would cut off every other user of the table, so the table must
+// already have it enabled.
+func (pg *PostgreSQL) applyPolicies(grantee *Grantee, policies []Policy, ctx *pongo2.Context) error {
+	if !pg.Flavor.supportsFineGrainedAcls() {
+		if len(policies) > 0 {
+			return errors.New(fmt.Sprintf("Row level security policies are not supported for %s",
+				pg.Flavor.getDbtype()))
+		}
+		return nil
+	}
+	for _, policy := range policies {
+		command := strings.ToUpper(strings.TrimSpace(policy.Command))
+		if command == "" {
+			command = "ALL"
+		}
+		if !pgPolicyCommands[command] {
+			return errors.New(fmt.Sprintf("Invalid policy command: %s", policy.Command))
+		}
+		enabled, err := pg.rowSecurityEnabled(policy.Schema, policy.Table)
+		if err != nil {
+			return err
+		}
+		table := pgQualifiedTable(policy.Schema, policy.Table)
+		if !enabled {
+			return errors.New(fmt.Sprintf("Row level security is not enabled on %s", table))
+		}
+		sql := fmt.Sprintf("CREATE POLICY %s ON %s FOR %s TO %s",
+			pglib.QuoteIdentifier(pgPolicyName(grantee, &policy)), table, command,
+			pg.Flavor.quoteGrantee(grantee))
+		if policy.Using != "" {
+			using, err := renderPolicyExpression(policy.Using, ctx)
+			if err != nil {
+				return err
+			}
+			sql += fmt.Sprintf(" USING (%s)", using)
+		}
+		if policy.WithCheck != "" {
+			withCheck, err := renderPolicyExpression(policy.WithCheck, ctx)
+			if err != nil {
+				return err
+			}
+			sql += fmt.Sprintf(" WITH CHECK (%s)", withCheck)
+		}
+		logger.Debugf("(%s) SQL: %s", pg.getName(), sql)
+		// Prepared statements cannot hold more than one statement.
+		stmt, err := pg.DB.Prepare(sql)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec()
+		stmt.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropAgentPolicies drops the policies the agent created for the grantee.
+// REVOKE statements do not affect policies, and a role cannot be dropped
+// while policies still refer to it.
+func (pg *PostgreSQL) dropAgentPolicies(grantee *Grantee) error {
+	sql := `SELECT schemaname, tablename, policyname
+        FROM pg_catalog.pg_policies
+        WHERE policyname LIKE $1
+        AND $2::name = ANY(roles)`
+	prefix := strings.Replace(PG_POLICY_PREFIX, "_", `\_`, -1)
+	rows, err := pg.DB.Query(sql, prefix+"%", grantee.Name)
+	if err != nil {
+		return err
+	}
+	var sqls []string
+	for rows.Next() {
+		var schema, table, policy string
+		if err = rows.Scan(&schema, &table, &policy); err != nil {
+			rows.Close()
+			return err
+		}
+		sqls = append(sqls, fmt.Sprintf("DROP POLICY %s ON %s",
+			pglib.QuoteIdentifier(policy), pgQualifiedTable(schema, table)))
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, sql := range sqls {
+		logger.Debugf("(%s) SQL: %s", pg.getName(), sql)
+		if _, err := pg.DB.Exec(sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/flosch/pongo2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyExpressions(t *testing.T) {
+	for _, expr := range []string{
+		"x = 1",
+		"owner = current_user AND (region IN ('eu', 'us(east)'))",
+		`"Tenant Id" = 3`,
+	} {
+		assert.Nil(t, validatePolicyExpression(expr), expr)
+	}
+	for _, expr := range []string{
+		"true); DROP TABLE abc",
+		"true) TO PUBLIC USING (true",
+		"x = 1 -- comment",
+		"x = /* comment */ 1",
+		"(x = 1",
+		"x = 'unterminated",
+	} {
+		assert.NotNil(t, validatePolicyExpression(expr), expr)
+	}
+
+	ctx := pongo2.Context{"username": "bob'); DROP TABLE abc; --"}
+	_, err := renderPolicyExpression("owner = '{{ username }}'", &ctx)
+	assert.NotNil(t, err)
+	ctx = pongo2.Context{"username": "bob"}
+	rendered, err := renderPolicyExpression("owner = '{{ username }}'", &ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, "owner = 'bob'", rendered)
+}
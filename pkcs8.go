@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"hash"
+)
+
+// Private keys protected by a passphrase are written as PKCS#8
+// "ENCRYPTED PRIVATE KEY" blocks with PBES2, using PBKDF2-HMAC-SHA256 and
+// AES-256-CBC, which is what OpenSSL writes by default. Any PBES2 key with
+// PBKDF2 and AES-CBC can be read.
+const PBKDF2_ITERATIONS = 100000
+
+var (
+	oidPbes2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPbkdf2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHmacWithSha1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHmacWithSha256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAes128Cbc      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAes192Cbc      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAes256Cbc      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+var errWrongPassphrase = errors.New("The private key could not be decrypted, the passphrase may be wrong")
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	Prf        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+func aesCbcKeyLength(oid asn1.ObjectIdentifier) int {
+	switch {
+	case oid.Equal(oidAes128Cbc):
+		return 16
+	case oid.Equal(oidAes192Cbc):
+		return 24
+	case oid.Equal(oidAes256Cbc):
+		return 32
+	}
+	return 0
+}
+
+func pbkdf2Hash(prf pkix.AlgorithmIdentifier) func() hash.Hash {
+	switch {
+	case len(prf.Algorithm) == 0 || prf.Algorithm.Equal(oidHmacWithSha1):
+		return sha1.New
+	case prf.Algorithm.Equal(oidHmacWithSha256):
+		return sha256.New
+	}
+	return nil
+}
+
+// encryptPkcs8 wraps the DER of a PKCS#8 private key into an
+// EncryptedPrivateKeyInfo.
+func encryptPkcs8(der []byte, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, PBKDF2_ITERATIONS, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	padded := append(append([]byte{}, der...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	defer wipeBytes(padded)
+	encrypted := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, padded)
+
+	kdfParams, err := asn1.Marshal(pbkdf2Params{
+		Salt:       salt,
+		Iterations: PBKDF2_ITERATIONS,
+		Prf:        pkix.AlgorithmIdentifier{Algorithm: oidHmacWithSha256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPbkdf2,
+			Parameters: asn1.RawValue{FullBytes: kdfParams},
+		},
+		EncryptionScheme: pkix.AlgorithmIdentifier{
+			Algorithm:  oidAes256Cbc,
+			Parameters: asn1.RawValue{FullBytes: ivParam},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPbes2,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: encrypted,
+	})
+}
+
+// decryptPkcs8 returns the DER of the PKCS#8 private key wrapped in the
+// EncryptedPrivateKeyInfo.
+func decryptPkcs8(der []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPbes2) {
+		return nil, errors.New("Only PBES2 encrypted private keys are supported")
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPbkdf2) {
+		return nil, errors.New("Only PBKDF2 is supported to derive private key encryption keys")
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	hashFunc := pbkdf2Hash(kdf.Prf)
+	if hashFunc == nil {
+		return nil, errors.New("Unsupported PBKDF2 pseudorandom function")
+	}
+	keyLen := aesCbcKeyLength(params.EncryptionScheme.Algorithm)
+	if keyLen == 0 {
+		return nil, errors.New("Only AES-CBC encrypted private keys are supported")
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	encrypted := info.EncryptedData
+	if len(iv) != aes.BlockSize || len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 {
+		return nil, errors.New("The encrypted private key is malformed")
+	}
+	key, err := pbkdf2.Key(hashFunc, string(passphrase), kdf.Salt, kdf.Iterations, keyLen)
+	if err != nil {
+		return nil, err
+	}
+	defer wipeBytes(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		wipeBytes(decrypted)
+		return nil, errWrongPassphrase
+	}
+	for _, b := range decrypted[len(decrypted)-padding:] {
+		if int(b) != padding {
+			wipeBytes(decrypted)
+			return nil, errWrongPassphrase
+		}
+	}
+	return decrypted[:len(decrypted)-padding], nil
+}
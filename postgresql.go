@@ -4,24 +4,60 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"net/url"
 	"strings"
+	"time"
 
 	"github.com/flosch/pongo2"
 	pglib "github.com/lib/pq"
 )
 
-type PgCatalog struct {
-	Database string
-	Schemas  []string
-}
-
 type PgFlavor interface {
-	createUserSql(*User) string
-	updatePasswordSql(*User) string
+	createUserSql(*User, *Secret) *Secret
+	updatePasswordSql(*User, *Secret) *Secret
+	lockUserSql(*User) string
+	unlockUserSql(*User) string
 	getDbtype() string
+	quoteGrantee(*Grantee) string
+	schemasSql() string
+	// externalSchemasSql returns an empty string if the flavor has no
+	// notion of external schemas.
+	externalSchemasSql() string
+	roleExistsSql(kind string) string
+	createRoleSql(*Grantee) string
+	dropRoleSql(*Grantee) string
+	grantRoleSql(role *Grantee, member string) string
+	revokeRoleSql(role *Grantee, member string) string
+	// roleMembersSql returns a query listing the members of the role given
+	// as $1, and memberOfSql one listing the roles granted to the member
+	// given as $1.
+	roleMembersSql(kind string) string
+	memberOfSql(kind string) string
+	// membershipsSql returns queries listing every role and member pair,
+	// naming roles the way they appear in ACLs.
+	membershipsSql() []string
+	// memberOfKinds lists the kinds of roles the grantee can be a member of.
+	memberOfKinds(*Grantee) []string
+	// functionsSql returns a query listing the schema, name, identity
+	// arguments and owner of every function.
+	functionsSql() string
+	// functionAclsSql returns a query listing the kind, signature, owner
+	// and ACL of every function outside of the system schemas.
+	functionAclsSql() string
+	// aclGrantee returns the name of the grantee as it appears in ACLs.
+	aclGrantee(*Grantee) string
+	// loginUsersSql returns a query listing every role able to log in.
+	loginUsersSql() string
+	// supportsFineGrainedAcls tells whether column privileges and row level
+	// security policies can be managed.
+	supportsFineGrainedAcls() bool
+	// supportsReassignOwned tells whether REASSIGN OWNED and DROP OWNED are
+	// available.
+	supportsReassignOwned() bool
 }
 
+// SQLSTATE raised when dropping a role that other objects depend on
+const PG_DEPENDENT_OBJECTS_STILL_EXIST = "2BP01"
+
 type PostgreSQL struct {
 	Flavor        PgFlavor
 	DB            *sql.DB
@@ -39,6 +75,28 @@ func PgQuoteLiteral(value string) string {
 	return prefix + "'" + value + "'"
 }
 
+// pgPasswordSql appends the password to the statement as a literal quoted
+// the same way as PgQuoteLiteral does, without copying it into strings.
+func pgPasswordSql(statement string, password *Secret) *Secret {
+	value := password.bytes()
+	sql := make([]byte, 0, len(statement)+2*len(value)+3)
+	sql = append(sql, statement...)
+	for _, c := range value {
+		if c == '\\' {
+			sql = append(sql, 'E')
+			break
+		}
+	}
+	sql = append(sql, '\'')
+	for _, c := range value {
+		if c == '\'' || c == '\\' {
+			sql = append(sql, c)
+		}
+		sql = append(sql, c)
+	}
+	return newSecret(append(sql, '\''))
+}
+
 func NewPostgreSQL(db *Database, flavor PgFlavor) *PostgreSQL {
 	return &PostgreSQL{
 		Flavor:   flavor,
@@ -46,22 +104,41 @@ func NewPostgreSQL(db *Database, flavor PgFlavor) *PostgreSQL {
 	}
 }
 
-func (pg *PostgreSQL) connect(conn *Connection) error {
+func (pg *PostgreSQL) connect(conn *Connection, password func() (*Secret, error)) error {
 	// TODO support sslmode and other options as needed
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable",
-		url.PathEscape(conn.Database.Username),
-		url.PathEscape(conn.Database.DecryptedPassword),
-		url.PathEscape(conn.Database.Host),
-		conn.Database.Port,
-		url.PathEscape(conn.DbName))
-	DB, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return err
-	}
-	pg.DB = DB
+	options := fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable",
+		pgConnValue(conn.Database.Host), conn.Database.Port,
+		pgConnValue(conn.Database.Username), pgConnValue(conn.DbName))
+	pg.DB = sql.OpenDB(&secretConnector{
+		driver:   &pglib.Driver{},
+		password: password,
+		dsn: func(password *Secret) *Secret {
+			// The capacity covers the escapes, so that no copy of the
+			// password is left behind by append.
+			dsn := make([]byte, 0, len(options)+2*len(password.bytes())+12)
+			dsn = append(dsn, options+" password="...)
+			return newSecret(appendPgConnValue(dsn, password.bytes()))
+		},
+	})
 	return nil
 }
 
+// pgConnValue quotes a value of a key=value connection string.
+func pgConnValue(value string) string {
+	return string(appendPgConnValue(nil, []byte(value)))
+}
+
+func appendPgConnValue(buf []byte, value []byte) []byte {
+	buf = append(buf, '\'')
+	for _, c := range value {
+		if c == '\'' || c == '\\' {
+			buf = append(buf, '\\')
+		}
+		buf = append(buf, c)
+	}
+	return append(buf, '\'')
+}
+
 func (pg *PostgreSQL) getDB() *sql.DB {
 	return pg.DB
 }
@@ -88,24 +165,15 @@ func (pg *PostgreSQL) discoverCurrentDb() (string, error) {
 }
 
 func (pg *PostgreSQL) discoverAllSchemas() ([]string, error) {
-	sql := `SELECT schema_name
-        FROM information_schema.schemata
-        WHERE schema_name NOT LIKE 'pg_%'
-        AND schema_name != 'information_schema'`
-	rows, err := pg.DB.Query(sql)
-	var schemas []string
-	if err != nil {
-		return schemas, err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var schemaName string
-		if err = rows.Scan(&schemaName); err != nil {
-			return schemas, err
-		}
-		schemas = append(schemas, schemaName)
+	return pg.queryNames(pg.Flavor.schemasSql())
+}
+
+func (pg *PostgreSQL) discoverExternalSchemas() ([]string, error) {
+	sql := pg.Flavor.externalSchemasSql()
+	if sql == "" {
+		return []string{}, nil
 	}
-	return schemas, nil
+	return pg.queryNames(sql)
 }
 
 func (pg *PostgreSQL) cacheGlobalContextData() error {
@@ -117,19 +185,35 @@ func (pg *PostgreSQL) cacheGlobalContextData() error {
 	if err != nil {
 		return err
 	}
-	pg.CachedCatalog = &PgCatalog{
-		Database: db,
-		Schemas:  schemas,
+	externalSchemas, err := pg.discoverExternalSchemas()
+	if err != nil {
+		return err
+	}
+	catalog := &PgCatalog{
+		Database:        db,
+		Schemas:         schemas,
+		ExternalSchemas: externalSchemas,
+	}
+	if err := pg.discoverObjects(catalog); err != nil {
+		return err
 	}
+	pg.CachedCatalog = catalog
 	return nil
 }
 
-func (pg *PostgreSQL) createTemplateContext(username string) *pongo2.Context {
+func (pg *PostgreSQL) createTemplateContext(grantee *Grantee) *pongo2.Context {
+	catalog := pg.CachedCatalog
 	return &pongo2.Context{
-		"type":     pg.Flavor.getDbtype(),
-		"database": pglib.QuoteIdentifier(pg.CachedCatalog.Database),
-		"schemas":  MapString(pg.CachedCatalog.Schemas, pglib.QuoteIdentifier),
-		"username": pglib.QuoteIdentifier(username),
+		"type":               pg.Flavor.getDbtype(),
+		"database":           pglib.QuoteIdentifier(catalog.Database),
+		"schemas":            MapString(catalog.Schemas, pglib.QuoteIdentifier),
+		"external_schemas":   MapString(catalog.ExternalSchemas, pglib.QuoteIdentifier),
+		"tables":             catalog.templateObjects(PG_KIND_TABLE),
+		"views":              catalog.templateObjects(PG_KIND_VIEW),
+		"materialized_views": catalog.templateObjects(PG_KIND_MATERIALIZED_VIEW),
+		"sequences":          catalog.templateObjects(PG_KIND_SEQUENCE),
+		"functions":          catalog.templateObjects(PG_KIND_FUNCTION),
+		"username":           pg.Flavor.quoteGrantee(grantee),
 	}
 }
 
@@ -143,34 +227,218 @@ func (pg *PostgreSQL) userExists(user *User) (bool, error) {
 	return rows.Next(), nil
 }
 
-func (pg *PostgreSQL) updatePassword(user *User) error {
-	sql := pg.Flavor.updatePasswordSql(user)
-	if _, err := pg.DB.Exec(sql); err != nil {
+func (pg *PostgreSQL) updatePassword(user *User, password *Secret) error {
+	sql := pg.Flavor.updatePasswordSql(user, password)
+	defer sql.wipe()
+	if _, err := pg.DB.Exec(sql.unsafeString()); err != nil {
 		return err
 	}
 	return nil
 }
 
+// dropUser expects the privileges of the user to have been revoked on every
+// connection of the database beforehand.
 func (pg *PostgreSQL) dropUser(user *User) error {
-	if err := pg.revokeEverything(user.Username); err != nil {
+	quoted_uname := pglib.QuoteIdentifier(user.Username)
+	sql := fmt.Sprintf("DROP USER %s", quoted_uname)
+	if _, err := pg.DB.Exec(sql); err != nil {
+		if pqErr, ok := err.(*pglib.Error); ok && pqErr.Code == PG_DEPENDENT_OBJECTS_STILL_EXIST {
+			return &DropBlockedError{
+				Username:     user.Username,
+				Dependencies: strings.Split(pqErr.Detail, "\n"),
+			}
+		}
 		return err
 	}
+	return nil
+}
+
+// reassignOwned gives the objects owned by the user in the current database
+// to the target role, or to the master user if no target is given, and then
+// drops the privileges the user still holds in it.
+func (pg *PostgreSQL) reassignOwned(user *User, target string) error {
+	if !pg.Flavor.supportsReassignOwned() {
+		return errors.New(fmt.Sprintf("Reassigning owned objects is not supported for %s, "+
+			"the objects of %s must be transferred by hand", pg.Flavor.getDbtype(), user.Username))
+	}
+	if target == "" {
+		target = pg.Database.Username
+	}
 	quoted_uname := pglib.QuoteIdentifier(user.Username)
-	sql := fmt.Sprintf("DROP USER %s", quoted_uname)
+	sqls := []string{
+		fmt.Sprintf("REASSIGN OWNED BY %s TO %s", quoted_uname, pglib.QuoteIdentifier(target)),
+		fmt.Sprintf("DROP OWNED BY %s", quoted_uname),
+	}
+	for _, sql := range sqls {
+		if _, err := pg.DB.Exec(sql); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setValidUntil makes the password of the user expire at the given time, so
+// that logging in is impossible past it even if the agent is not running,
+// or never if no time is given.
+func (pg *PostgreSQL) setValidUntil(user *User, validUntil *time.Time) error {
+	expiry := "infinity"
+	if validUntil != nil {
+		expiry = validUntil.UTC().Format("2006-01-02 15:04:05+00")
+	}
+	sql := fmt.Sprintf("ALTER USER %s VALID UNTIL %s",
+		pglib.QuoteIdentifier(user.Username), PgQuoteLiteral(expiry))
+	if _, err := pg.DB.Exec(sql); err != nil {
+		return err
+	}
+	return nil
+}
+
+// lockUser prevents the user from logging in, without touching anything
+// else about it.
+func (pg *PostgreSQL) lockUser(user *User) error {
+	if _, err := pg.DB.Exec(pg.Flavor.lockUserSql(user)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (pg *PostgreSQL) listAccounts() ([]*DbAccount, error) {
+	names, err := pg.queryNames(pg.Flavor.loginUsersSql())
+	if err != nil {
+		return nil, err
+	}
+	accounts := make([]*DbAccount, len(names))
+	for i, name := range names {
+		accounts[i] = &DbAccount{Username: name}
+	}
+	return accounts, nil
+}
+
+func (pg *PostgreSQL) inventoryGrantee(grantee *Grantee) string {
+	return pg.Flavor.aclGrantee(grantee)
+}
+
+func (pg *PostgreSQL) lockAccount(account *DbAccount) error {
+	return pg.lockUser(&User{Username: account.Username})
+}
+
+func (pg *PostgreSQL) unlockUser(user *User) error {
+	sql := pg.Flavor.unlockUserSql(user)
+	if sql == "" {
+		return nil
+	}
 	if _, err := pg.DB.Exec(sql); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (pg *PostgreSQL) createUser(user *User) error {
-	sql := pg.Flavor.createUserSql(user)
+func (pg *PostgreSQL) createUser(user *User, password *Secret) error {
+	sql := pg.Flavor.createUserSql(user, password)
+	defer sql.wipe()
+	if _, err := pg.DB.Exec(sql.unsafeString()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (pg *PostgreSQL) roleExists(role *Role) (bool, error) {
+	grantee := role.grantee()
+	rows, err := pg.DB.Query(pg.Flavor.roleExistsSql(grantee.Kind), grantee.Name)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), nil
+}
+
+func (pg *PostgreSQL) createRole(role *Role) error {
+	sql := pg.Flavor.createRoleSql(role.grantee())
 	if _, err := pg.DB.Exec(sql); err != nil {
 		return err
 	}
 	return nil
 }
 
+// dropRole expects the privileges of the role to have been revoked on every
+// connection of the database beforehand.
+func (pg *PostgreSQL) dropRole(role *Role) error {
+	members, err := pg.roleMembers(role)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if err := pg.revokeRole(role, member); err != nil {
+			return err
+		}
+	}
+	sql := pg.Flavor.dropRoleSql(role.grantee())
+	if _, err := pg.DB.Exec(sql); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (pg *PostgreSQL) queryNames(sql string, args ...interface{}) ([]string, error) {
+	rows, err := pg.DB.Query(sql, args...)
+	var names []string
+	if err != nil {
+		return names, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+func (pg *PostgreSQL) roleMembers(role *Role) ([]string, error) {
+	grantee := role.grantee()
+	return pg.queryNames(pg.Flavor.roleMembersSql(grantee.Kind), grantee.Name)
+}
+
+func (pg *PostgreSQL) grantRole(role *Role, member string) error {
+	sql := pg.Flavor.grantRoleSql(role.grantee(), member)
+	if _, err := pg.DB.Exec(sql); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (pg *PostgreSQL) revokeRole(role *Role, member string) error {
+	sql := pg.Flavor.revokeRoleSql(role.grantee(), member)
+	if _, err := pg.DB.Exec(sql); err != nil {
+		return err
+	}
+	return nil
+}
+
+// revokeMemberships revokes the managed roles the grantee is a member of.
+// Memberships are cluster-wide, and those of other roles are left alone.
+func (pg *PostgreSQL) revokeMemberships(grantee *Grantee) error {
+	for _, kind := range pg.Flavor.memberOfKinds(grantee) {
+		roles, err := pg.queryNames(pg.Flavor.memberOfSql(kind), grantee.Name)
+		if err != nil {
+			return err
+		}
+		for _, name := range roles {
+			role := &Grantee{Name: name, Kind: kind}
+			if !pg.Database.managesRole(role) {
+				continue
+			}
+			sql := pg.Flavor.revokeRoleSql(role, grantee.Name)
+			if _, err := pg.DB.Exec(sql); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (pg *PostgreSQL) filterGrants(orig []Grant, conn *Connection) []*Grant {
 	var grants []*Grant
 	for _, grant := range orig {
@@ -181,8 +449,15 @@ func (pg *PostgreSQL) filterGrants(orig []Grant, conn *Connection) []*Grant {
 	return grants
 }
 
-func (pg *PostgreSQL) revokeEverything(username string) error {
-	quoted_uname := pglib.QuoteIdentifier(username)
+func (pg *PostgreSQL) revokeEverything(grantee *Grantee) error {
+	if err := pg.revokeConnectionPrivileges(grantee); err != nil {
+		return err
+	}
+	return pg.revokeMemberships(grantee)
+}
+
+func (pg *PostgreSQL) revokeConnectionPrivileges(grantee *Grantee) error {
+	quoted_uname := pg.Flavor.quoteGrantee(grantee)
 	quoted_db := pglib.QuoteIdentifier(pg.CachedCatalog.Database)
 	sql := fmt.Sprintf("REVOKE ALL ON DATABASE %s FROM %s", quoted_db, quoted_uname)
 	if _, err := pg.DB.Exec(sql); err != nil {
@@ -203,49 +478,156 @@ func (pg *PostgreSQL) revokeEverything(username string) error {
 			}
 		}
 	}
+	// REVOKE ALL ON ALL TABLES is not supported for external schemas, and
+	// USAGE is the only privilege that can be granted on them.
+	for _, schema := range pg.CachedCatalog.ExternalSchemas {
+		quoted_schema := pglib.QuoteIdentifier(schema)
+		sql = fmt.Sprintf("REVOKE USAGE ON SCHEMA %s FROM %s", quoted_schema, quoted_uname)
+		if _, err := pg.DB.Exec(sql); err != nil {
+			return err
+		}
+	}
+	if pg.Flavor.supportsFineGrainedAcls() {
+		if err := pg.revokeColumnPrivileges(grantee); err != nil {
+			return err
+		}
+		if err := pg.dropAgentPolicies(grantee); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 type PgNative struct {
 }
 
-func (pg *PgNative) createUserSql(user *User) string {
+func (pg *PgNative) createUserSql(user *User, password *Secret) *Secret {
 	quoted_uname := pglib.QuoteIdentifier(user.Username)
-	return fmt.Sprintf("CREATE USER %s PASSWORD %s", quoted_uname,
-		// See the notes in updatePasswordSql around security and why the
-		// password is injected directly into this string
-		PgQuoteLiteral(user.DecryptedPassword))
+	// See the notes in updatePasswordSql around security and why the
+	// password is injected directly into this string
+	return pgPasswordSql(fmt.Sprintf("CREATE USER %s PASSWORD ", quoted_uname), password)
 }
 
-func (pg *PgNative) updatePasswordSql(user *User) string {
+func (pg *PgNative) updatePasswordSql(user *User, password *Secret) *Secret {
 	quoted_uname := pglib.QuoteIdentifier(user.Username)
-	return fmt.Sprintf("ALTER USER %s WITH ENCRYPTED PASSWORD %s", quoted_uname,
-		// The password is injected directly into the SQL statement rather than
-		// using bindings because of https://github.com/lib/pq/issues/708.
-		PgQuoteLiteral(user.DecryptedPassword))
+	// The password is injected directly into the SQL statement rather than
+	// using bindings because of https://github.com/lib/pq/issues/708.
+	return pgPasswordSql(fmt.Sprintf("ALTER USER %s WITH ENCRYPTED PASSWORD ", quoted_uname),
+		password)
+}
+
+func (pg *PgNative) lockUserSql(user *User) string {
+	return fmt.Sprintf("ALTER ROLE %s NOLOGIN", pglib.QuoteIdentifier(user.Username))
+}
+
+func (pg *PgNative) unlockUserSql(user *User) string {
+	return fmt.Sprintf("ALTER ROLE %s LOGIN", pglib.QuoteIdentifier(user.Username))
 }
 
 func (pg *PgNative) getDbtype() string {
 	return "postgresql"
 }
 
-type Redshift struct {
+func (pg *PgNative) quoteGrantee(grantee *Grantee) string {
+	return pglib.QuoteIdentifier(grantee.Name)
 }
 
-func (rd *Redshift) createUserSql(user *User) string {
-	quoted_uname := pglib.QuoteIdentifier(user.Username)
-	return fmt.Sprintf("CREATE USER %s PASSWORD %s", quoted_uname,
-		// See notes above about password being injected directly here.
-		PgQuoteLiteral(user.DecryptedPassword))
+func (pg *PgNative) schemasSql() string {
+	return `SELECT schema_name
+        FROM information_schema.schemata
+        WHERE schema_name NOT LIKE 'pg_%'
+        AND schema_name != 'information_schema'`
 }
 
-func (rd *Redshift) updatePasswordSql(user *User) string {
-	quoted_uname := pglib.QuoteIdentifier(user.Username)
-	return fmt.Sprintf("ALTER USER %s PASSWORD %s", quoted_uname,
-		// See notes above about password being injected directly here.
-		PgQuoteLiteral(user.DecryptedPassword))
+func (pg *PgNative) externalSchemasSql() string {
+	return ""
+}
+
+// Groups are just roles in PostgreSQL, so the kind of the role is ignored
+// throughout the role related methods below.
+
+func (pg *PgNative) roleExistsSql(kind string) string {
+	return "SELECT rolname FROM pg_catalog.pg_roles WHERE rolname = $1"
+}
+
+func (pg *PgNative) createRoleSql(role *Grantee) string {
+	return fmt.Sprintf("CREATE ROLE %s NOLOGIN", pglib.QuoteIdentifier(role.Name))
+}
+
+func (pg *PgNative) dropRoleSql(role *Grantee) string {
+	return fmt.Sprintf("DROP ROLE %s", pglib.QuoteIdentifier(role.Name))
+}
+
+func (pg *PgNative) grantRoleSql(role *Grantee, member string) string {
+	return fmt.Sprintf("GRANT %s TO %s", pglib.QuoteIdentifier(role.Name),
+		pglib.QuoteIdentifier(member))
+}
+
+func (pg *PgNative) revokeRoleSql(role *Grantee, member string) string {
+	return fmt.Sprintf("REVOKE %s FROM %s", pglib.QuoteIdentifier(role.Name),
+		pglib.QuoteIdentifier(member))
+}
+
+func (pg *PgNative) roleMembersSql(kind string) string {
+	return `SELECT DISTINCT m.rolname
+        FROM pg_catalog.pg_auth_members am
+        JOIN pg_catalog.pg_roles r ON r.oid = am.roleid
+        JOIN pg_catalog.pg_roles m ON m.oid = am.member
+        WHERE r.rolname = $1`
+}
+
+func (pg *PgNative) memberOfSql(kind string) string {
+	return `SELECT DISTINCT r.rolname
+        FROM pg_catalog.pg_auth_members am
+        JOIN pg_catalog.pg_roles r ON r.oid = am.roleid
+        JOIN pg_catalog.pg_roles m ON m.oid = am.member
+        WHERE m.rolname = $1`
+}
+
+func (pg *PgNative) membershipsSql() []string {
+	return []string{`SELECT r.rolname, m.rolname
+        FROM pg_catalog.pg_auth_members am
+        JOIN pg_catalog.pg_roles r ON r.oid = am.roleid
+        JOIN pg_catalog.pg_roles m ON m.oid = am.member`}
+}
+
+func (pg *PgNative) memberOfKinds(grantee *Grantee) []string {
+	return []string{GRANTEE_ROLE}
+}
+
+func (pg *PgNative) aclGrantee(grantee *Grantee) string {
+	return grantee.Name
+}
+
+func (pg *PgNative) loginUsersSql() string {
+	return "SELECT rolname FROM pg_catalog.pg_roles WHERE rolcanlogin"
+}
+
+func (pg *PgNative) supportsFineGrainedAcls() bool {
+	return true
+}
+
+func (pg *PgNative) supportsReassignOwned() bool {
+	return true
+}
+
+func (pg *PgNative) functionAclsSql() string {
+	return `SELECT 'function',
+            n.nspname || '.' || p.proname || '(' ||
+                pg_catalog.pg_get_function_identity_arguments(p.oid) || ')',
+            pg_catalog.pg_get_userbyid(p.proowner),
+            array_to_string(p.proacl, ',')
+        FROM pg_catalog.pg_proc p
+        JOIN pg_catalog.pg_namespace n ON n.oid = p.pronamespace
+        WHERE n.nspname NOT LIKE 'pg_%'
+        AND n.nspname != 'information_schema'`
 }
 
-func (pg *Redshift) getDbtype() string {
-	return "redshift"
+func (pg *PgNative) functionsSql() string {
+	return `SELECT n.nspname, p.proname,
+            pg_catalog.pg_get_function_identity_arguments(p.oid),
+            pg_catalog.pg_get_userbyid(p.proowner)
+        FROM pg_catalog.pg_proc p
+        JOIN pg_catalog.pg_namespace n ON n.oid = p.pronamespace
+        ORDER BY n.nspname, p.proname`
 }
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
@@ -20,6 +21,8 @@ const PG_MASTER_USER = "buck"
 const PG_MASTER_PASS = "password"
 const PG_TESTER_USER = "testUser123"
 const PG_TESTER_PASS = "PasW';drop table `foo`"
+const PG_TESTER_ROLE = "testRole123"
+const PG_ROGUE_USER = "rogueUser123"
 
 func pgTesterUri(username string, password string) string {
 	return fmt.Sprintf("postgres://%s:%s@localhost:5432/dbrhino_agent_tests?sslmode=disable",
@@ -47,7 +50,7 @@ func postgresqlTestGrantResponse(statements []string) *GrantsResponse {
 					Host:              "localhost",
 					Port:              5432,
 					Username:          PG_MASTER_USER,
-					DecryptedPassword: PG_MASTER_PASS,
+					EncryptedPassword: sealTestPassword(PG_MASTER_PASS),
 					DefaultDatabase:   "dbrhino_agent_tests",
 				},
 				DbName: "dbrhino_agent_tests",
@@ -56,7 +59,7 @@ func postgresqlTestGrantResponse(statements []string) *GrantsResponse {
 		Users: []User{
 			User{
 				Id:                1,
-				DecryptedPassword: PG_TESTER_PASS,
+				EncryptedPassword: sealTestPassword(PG_TESTER_PASS),
 				Active:            true,
 				Username:          PG_TESTER_USER,
 				DatabaseId:        1,
@@ -84,10 +87,13 @@ func execShouldPass(t *testing.T, DB *sql.DB, sql string) *sql.Result {
 
 func (suite *PostgresqlTestSuite) SetupTest() {
 	conf := &Config{}
-	app := &Application{conf, nil}
+	app := &Application{conf: conf, key: testAgentKey, state: newAgentState("")}
 	suite.App = app
 	withPostgresqlTestConnection(pgTesterUri(PG_MASTER_USER, PG_MASTER_PASS), func(DB *sql.DB) {
 		DB.Exec("drop role " + PG_TESTER_USER)
+		DB.Exec("drop owned by " + PG_TESTER_ROLE)
+		DB.Exec("drop role " + PG_TESTER_ROLE)
+		DB.Exec("drop role " + PG_ROGUE_USER)
 		tx, err := DB.Begin()
 		assert.Nil(suite.T(), err)
 		execShouldPass(suite.T(), DB, "drop schema if exists test_schema cascade")
@@ -122,6 +128,357 @@ func (suite *PostgresqlTestSuite) TestBasicGrant() {
 	})
 }
 
+func (suite *PostgresqlTestSuite) TestRemovedGrantIsRevoked() {
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE ON SCHEMA test_schema TO {{username}}",
+		"GRANT SELECT ON ALL TABLES IN SCHEMA test_schema TO {{username}}",
+	})
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+	grantsResponse.Grants = []Grant{}
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.UserResults[0].Result, RESULT_APPLIED)
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		_, err := DB.Exec("select * from test_schema.abc")
+		assert.NotNil(t, err)
+	})
+}
+
+func (suite *PostgresqlTestSuite) TestTimeBoundGrant() {
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE ON SCHEMA test_schema TO {{username}}",
+		"GRANT SELECT ON ALL TABLES IN SCHEMA test_schema TO {{username}}",
+	})
+	validFrom := time.Now().Add(time.Hour)
+	grantsResponse.Grants[0].ValidFrom = &validFrom
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_PENDING)
+
+	validFrom = time.Now().Add(-time.Hour)
+	validUntil := time.Now().Add(2 * time.Second)
+	grantsResponse.Grants[0].ValidUntil = &validUntil
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		execShouldPass(t, DB, "select * from test_schema.abc")
+	})
+
+	time.Sleep(2 * time.Second)
+	suite.App.enforceExpiries()
+	events := suite.App.state.pendingExpiryEvents()
+	assert.Len(t, events, 1)
+	assert.Equal(t, events[0].GrantId, 1)
+	withPostgresqlTestConnection(pgTesterUri(PG_MASTER_USER, PG_MASTER_PASS), func(DB *sql.DB) {
+		var canSelect bool
+		err := DB.QueryRow("select has_table_privilege($1, 'test_schema.abc', 'select')",
+			PG_TESTER_USER).Scan(&canSelect)
+		assert.Nil(t, err)
+		assert.False(t, canSelect)
+	})
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_EXPIRED)
+	assert.Len(t, suite.App.state.pendingExpiryEvents(), 1)
+}
+
+func (suite *PostgresqlTestSuite) TestRevokeUserLocally() {
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE ON SCHEMA test_schema TO {{username}}",
+		"GRANT SELECT ON ALL TABLES IN SCHEMA test_schema TO {{username}}",
+	})
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+
+	assert.Nil(t, revokeUserLocally(suite.App, "pg_test", PG_TESTER_USER, false))
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		assert.NotNil(t, DB.Ping())
+	})
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.UserResults[0].Result, RESULT_TOMBSTONED)
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_TOMBSTONED)
+
+	assert.Nil(t, clearTombstone(suite.App, "pg_test", PG_TESTER_USER))
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		execShouldPass(t, DB, "select * from test_schema.abc")
+	})
+}
+
+func (suite *PostgresqlTestSuite) TestObjectTemplateContext() {
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE ON SCHEMA test_schema TO {{username}}",
+		`{% for t in tables|in_schema:"test\\_%"|not_like:"def" %}
+		GRANT SELECT ({{ t.columns|quote_ident|join:", " }}) ON {{ t.qualified }} TO {{username}};
+		{% endfor %}`,
+	})
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	grantResult := checkin.GrantResults[0]
+	assert.Equal(t, grantResult.Result, RESULT_APPLIED)
+	assert.Nil(t, grantResult.Error)
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		execShouldPass(t, DB, "select * from test_schema.abc")
+		_, err := DB.Exec("select * from test_schema.def")
+		assert.NotNil(t, err)
+	})
+}
+
+func (suite *PostgresqlTestSuite) TestColumnPrivilegesAndPolicies() {
+	withPostgresqlTestConnection(pgTesterUri(PG_MASTER_USER, PG_MASTER_PASS), func(DB *sql.DB) {
+		execShouldPass(suite.T(), DB, "alter table test_schema.abc enable row level security")
+	})
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE ON SCHEMA test_schema TO {{username}}",
+	})
+	grantsResponse.Grants[0].ColumnPrivileges = []ColumnPrivilege{
+		ColumnPrivilege{Schema: "test_schema", Table: "abc", Privilege: "select", Columns: []string{"x"}},
+	}
+	grantsResponse.Grants[0].Policies = []Policy{
+		Policy{Name: "first_row", Schema: "test_schema", Table: "abc", Command: "select", Using: "x = 1"},
+	}
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	grantResult := checkin.GrantResults[0]
+	assert.Equal(t, grantResult.Result, RESULT_APPLIED)
+	assert.Nil(t, grantResult.Error)
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		var count int
+		assert.Nil(t, DB.QueryRow("select count(x) from test_schema.abc").Scan(&count))
+		assert.Equal(t, count, 1)
+		_, err := DB.Exec("select y from test_schema.abc")
+		assert.NotNil(t, err)
+	})
+
+	grantsResponse.Users[0].Active = false
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.UserResults[0].Result, RESULT_REVOKED)
+}
+
+func (suite *PostgresqlTestSuite) TestTemplatedColumnGrant() {
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE ON SCHEMA test_schema TO {{username}}",
+		"GRANT SELECT (x) ON test_schema.abc TO {{username}}",
+	})
+	t := suite.T()
+	// The column grant of the statements survives every cycle.
+	for i := 0; i < 2; i++ {
+		checkin := handleGrantsResponse(suite.App, grantsResponse)
+		assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+		withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+			execShouldPass(t, DB, "select x from test_schema.abc")
+			_, err := DB.Exec("select y from test_schema.abc")
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func (suite *PostgresqlTestSuite) TestDropUserOwningObjects() {
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE, CREATE ON SCHEMA test_schema TO {{username}}",
+	})
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		execShouldPass(t, DB, "create table test_schema.owned (x integer)")
+	})
+	grantsResponse.Users[0].Active = false
+	grantsResponse.Grants = []Grant{}
+
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	userResult := checkin.UserResults[0]
+	assert.Equal(t, userResult.Result, RESULT_DROP_BLOCKED)
+	assert.Contains(t, userResult.Dependencies, "owner of table test_schema.owned")
+
+	suite.App.conf.DropStrategy = DROP_STRATEGY_REASSIGN
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.UserResults[0].Result, RESULT_REVOKED)
+	assert.Nil(t, checkin.UserResults[0].Error)
+}
+
+func (suite *PostgresqlTestSuite) TestRoleMembership() {
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE ON SCHEMA test_schema TO {{username}}",
+		"GRANT SELECT ON test_schema.abc TO {{username}}",
+	})
+	grantsResponse.Roles = []Role{
+		Role{
+			Id:         1,
+			Name:       PG_TESTER_ROLE,
+			Active:     true,
+			DatabaseId: 1,
+			Members:    []string{PG_TESTER_USER},
+		},
+	}
+	grantsResponse.Grants[0].UserId = 0
+	grantsResponse.Grants[0].RoleId = 1
+	grantsResponse.Grants[0].Username = PG_TESTER_ROLE
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	assert.Len(t, checkin.RoleResults, 1)
+	roleResult := checkin.RoleResults[0]
+	assert.Equal(t, roleResult.RoleId, 1)
+	assert.Equal(t, roleResult.Result, RESULT_APPLIED)
+	assert.Nil(t, roleResult.Error)
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		execShouldPass(t, DB, "select * from test_schema.abc")
+	})
+
+	grantsResponse.Roles[0].Members = []string{}
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.RoleResults[0].Result, RESULT_APPLIED)
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		_, err := DB.Exec("select * from test_schema.abc")
+		assert.NotNil(t, err)
+	})
+}
+
+func (suite *PostgresqlTestSuite) TestUnmanagedRoleMembershipIsKept() {
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE ON SCHEMA test_schema TO {{username}}",
+	})
+	t := suite.T()
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+	withPostgresqlTestConnection(pgTesterUri(PG_MASTER_USER, PG_MASTER_PASS), func(DB *sql.DB) {
+		execShouldPass(t, DB, "create role "+PG_TESTER_ROLE)
+		execShouldPass(t, DB, "grant select on test_schema.abc to "+PG_TESTER_ROLE)
+		execShouldPass(t, DB, "grant "+PG_TESTER_ROLE+" to "+PG_TESTER_USER)
+	})
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		execShouldPass(t, DB, "select * from test_schema.abc")
+	})
+}
+
+func (suite *PostgresqlTestSuite) TestUnmanagedUsers() {
+	withPostgresqlTestConnection(pgTesterUri(PG_MASTER_USER, PG_MASTER_PASS), func(DB *sql.DB) {
+		execShouldPass(suite.T(), DB, "create user "+PG_ROGUE_USER+" password 'rogue'")
+	})
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE ON SCHEMA test_schema TO {{username}}",
+	})
+	unmanagedUsernames := func(checkin *CheckinRequest) []string {
+		var usernames []string
+		for _, user := range checkin.UnmanagedUsers {
+			usernames = append(usernames, user.Username)
+		}
+		return usernames
+	}
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	assert.Contains(t, unmanagedUsernames(checkin), PG_ROGUE_USER)
+	assert.NotContains(t, unmanagedUsernames(checkin), PG_TESTER_USER)
+	assert.NotContains(t, unmanagedUsernames(checkin), PG_MASTER_USER)
+
+	suite.App.conf.UnmanagedUsers = UNMANAGED_USERS_LOCK
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	for _, user := range checkin.UnmanagedUsers {
+		if user.Username == PG_ROGUE_USER {
+			assert.True(t, user.Locked)
+		}
+	}
+	withPostgresqlTestConnection(pgTesterUri(PG_ROGUE_USER, "rogue"), func(DB *sql.DB) {
+		assert.NotNil(t, DB.Ping())
+	})
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.NotContains(t, unmanagedUsernames(checkin), PG_ROGUE_USER)
+}
+
+func (suite *PostgresqlTestSuite) TestDriftIsReportedAndHealed() {
+	suite.App.conf.Drift = DRIFT_HEAL
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE ON SCHEMA test_schema TO {{username}}",
+		"GRANT SELECT ON test_schema.abc TO {{username}}",
+	})
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+	assert.NotNil(t, suite.App.state.grantFingerprint(1))
+
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Len(t, checkin.DriftReports, 0)
+
+	withPostgresqlTestConnection(pgTesterUri(PG_MASTER_USER, PG_MASTER_PASS), func(DB *sql.DB) {
+		execShouldPass(t, DB, `grant select on test_schema.def to "`+PG_TESTER_USER+`"`)
+	})
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Len(t, checkin.DriftReports, 1)
+	assert.Equal(t, checkin.DriftReports[0].Added, []string{"SELECT on table test_schema.def"})
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		_, err := DB.Exec("select * from test_schema.def")
+		assert.NotNil(t, err)
+	})
+}
+
+func (suite *PostgresqlTestSuite) TestColumnAndPolicyDriftIsHealed() {
+	suite.App.conf.Drift = DRIFT_HEAL
+	withPostgresqlTestConnection(pgTesterUri(PG_MASTER_USER, PG_MASTER_PASS), func(DB *sql.DB) {
+		execShouldPass(suite.T(), DB, "alter table test_schema.abc enable row level security")
+	})
+	grantsResponse := postgresqlTestGrantResponse([]string{
+		"GRANT USAGE ON SCHEMA test_schema TO {{username}}",
+	})
+	grantsResponse.Grants[0].ColumnPrivileges = []ColumnPrivilege{
+		ColumnPrivilege{Schema: "test_schema", Table: "abc", Privilege: "select", Columns: []string{"x"}},
+	}
+	grantsResponse.Grants[0].Policies = []Policy{
+		Policy{Name: "first_row", Schema: "test_schema", Table: "abc", Command: "select", Using: "x = 1"},
+	}
+	checkin := handleGrantsResponse(suite.App, grantsResponse)
+	t := suite.T()
+	assert.Equal(t, checkin.GrantResults[0].Result, RESULT_APPLIED)
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Len(t, checkin.DriftReports, 0)
+
+	withPostgresqlTestConnection(pgTesterUri(PG_MASTER_USER, PG_MASTER_PASS), func(DB *sql.DB) {
+		var policy string
+		err := DB.QueryRow(`select policyname from pg_policies
+			where schemaname = 'test_schema' and tablename = 'abc'`).Scan(&policy)
+		assert.Nil(t, err)
+		execShouldPass(t, DB, `drop policy "`+policy+`" on test_schema.abc`)
+		execShouldPass(t, DB, `revoke select (x) on test_schema.abc from "`+PG_TESTER_USER+`"`)
+	})
+	checkin = handleGrantsResponse(suite.App, grantsResponse)
+	assert.Len(t, checkin.DriftReports, 1)
+	assert.Len(t, checkin.DriftReports[0].Removed, 2)
+	withPostgresqlTestConnection(pgTesterUri(PG_TESTER_USER, PG_TESTER_PASS), func(DB *sql.DB) {
+		var count int
+		assert.Nil(t, DB.QueryRow("select count(x) from test_schema.abc").Scan(&count))
+		assert.Equal(t, count, 1)
+	})
+}
+
+func TestManagedRoles(t *testing.T) {
+	redshift := &Database{Id: 1, Type: "redshift"}
+	other := &Database{Id: 2, Type: "redshift"}
+	grantsResponse := &GrantsResponse{
+		Connections: []Connection{{Id: 1, Database: redshift}, {Id: 2, Database: other}},
+		Roles: []Role{
+			{Id: 1, Name: "analysts", Kind: GRANTEE_GROUP, DatabaseId: 1},
+			{Id: 2, Name: "loaders", Kind: GRANTEE_ROLE, DatabaseId: 1},
+			{Id: 3, Name: "admins", DatabaseId: 2},
+		},
+	}
+	grantsResponse.markManagedRoles()
+	assert.True(t, redshift.managesRole(&Grantee{Name: "analysts", Kind: GRANTEE_GROUP}))
+	assert.False(t, redshift.managesRole(&Grantee{Name: "analysts", Kind: GRANTEE_ROLE}))
+	assert.True(t, redshift.managesRole(&Grantee{Name: "loaders", Kind: GRANTEE_ROLE}))
+	assert.False(t, redshift.managesRole(&Grantee{Name: "loaders", Kind: GRANTEE_GROUP}))
+	assert.False(t, redshift.managesRole(&Grantee{Name: "admins", Kind: GRANTEE_ROLE}))
+	assert.True(t, other.managesRole(&Grantee{Name: "admins", Kind: GRANTEE_ROLE}))
+}
+
+func TestRedshiftReassignOwned(t *testing.T) {
+	pg := &PostgreSQL{Flavor: &Redshift{}, Database: &Database{Username: "master"}}
+	err := pg.reassignOwned(&User{Username: "bob"}, "")
+	assert.NotNil(t, err)
+}
+
 func TestPostgresql(t *testing.T) {
 	suite.Run(t, new(PostgresqlTestSuite))
 }
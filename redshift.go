@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+
+	pglib "github.com/lib/pq"
+)
+
+type Redshift struct {
+}
+
+func (rd *Redshift) createUserSql(user *User, password *Secret) *Secret {
+	quoted_uname := pglib.QuoteIdentifier(user.Username)
+	// See the notes in PgNative.updatePasswordSql about the password being
+	// injected directly here.
+	return pgPasswordSql(fmt.Sprintf("CREATE USER %s PASSWORD ", quoted_uname), password)
+}
+
+func (rd *Redshift) updatePasswordSql(user *User, password *Secret) *Secret {
+	quoted_uname := pglib.QuoteIdentifier(user.Username)
+	// See the notes in PgNative.updatePasswordSql about the password being
+	// injected directly here.
+	return pgPasswordSql(fmt.Sprintf("ALTER USER %s PASSWORD ", quoted_uname), password)
+}
+
+// lockUserSql disables password authentication, as Redshift users cannot be
+// made NOLOGIN.
+func (rd *Redshift) lockUserSql(user *User) string {
+	return fmt.Sprintf("ALTER USER %s PASSWORD DISABLE", pglib.QuoteIdentifier(user.Username))
+}
+
+// unlockUserSql returns nothing to run since the password, and with it the
+// ability to log in, is set again by the next grant cycle.
+func (rd *Redshift) unlockUserSql(user *User) string {
+	return ""
+}
+
+func (pg *Redshift) getDbtype() string {
+	return "redshift"
+}
+
+// quoteGrantee prefixes roles and groups with the keyword Redshift requires
+// for them in GRANT and REVOKE statements.
+func (rd *Redshift) quoteGrantee(grantee *Grantee) string {
+	quoted := pglib.QuoteIdentifier(grantee.Name)
+	switch grantee.Kind {
+	case GRANTEE_ROLE:
+		return "ROLE " + quoted
+	case GRANTEE_GROUP:
+		return "GROUP " + quoted
+	}
+	return quoted
+}
+
+// schemasSql reads pg_namespace rather than information_schema, which only
+// lists the schemas the current user has privileges on. External (Spectrum)
+// schemas are discovered separately because most privileges cannot be
+// granted or revoked on them.
+func (rd *Redshift) schemasSql() string {
+	return `SELECT nspname
+        FROM pg_catalog.pg_namespace
+        WHERE nspname NOT LIKE 'pg_%'
+        AND nspname != 'information_schema'
+        AND nspname NOT IN (SELECT schemaname FROM svv_external_schemas)`
+}
+
+func (rd *Redshift) externalSchemasSql() string {
+	return "SELECT schemaname FROM svv_external_schemas"
+}
+
+func (rd *Redshift) roleExistsSql(kind string) string {
+	if kind == GRANTEE_GROUP {
+		return "SELECT groname FROM pg_group WHERE groname = $1"
+	}
+	return "SELECT role_name FROM svv_roles WHERE role_name = $1"
+}
+
+func (rd *Redshift) createRoleSql(role *Grantee) string {
+	if role.Kind == GRANTEE_GROUP {
+		return fmt.Sprintf("CREATE GROUP %s", pglib.QuoteIdentifier(role.Name))
+	}
+	return fmt.Sprintf("CREATE ROLE %s", pglib.QuoteIdentifier(role.Name))
+}
+
+func (rd *Redshift) dropRoleSql(role *Grantee) string {
+	if role.Kind == GRANTEE_GROUP {
+		return fmt.Sprintf("DROP GROUP %s", pglib.QuoteIdentifier(role.Name))
+	}
+	return fmt.Sprintf("DROP ROLE %s", pglib.QuoteIdentifier(role.Name))
+}
+
+func (rd *Redshift) grantRoleSql(role *Grantee, member string) string {
+	if role.Kind == GRANTEE_GROUP {
+		return fmt.Sprintf("ALTER GROUP %s ADD USER %s",
+			pglib.QuoteIdentifier(role.Name), pglib.QuoteIdentifier(member))
+	}
+	return fmt.Sprintf("GRANT ROLE %s TO %s", pglib.QuoteIdentifier(role.Name),
+		pglib.QuoteIdentifier(member))
+}
+
+func (rd *Redshift) revokeRoleSql(role *Grantee, member string) string {
+	if role.Kind == GRANTEE_GROUP {
+		return fmt.Sprintf("ALTER GROUP %s DROP USER %s",
+			pglib.QuoteIdentifier(role.Name), pglib.QuoteIdentifier(member))
+	}
+	return fmt.Sprintf("REVOKE ROLE %s FROM %s", pglib.QuoteIdentifier(role.Name),
+		pglib.QuoteIdentifier(member))
+}
+
+func (rd *Redshift) roleMembersSql(kind string) string {
+	if kind == GRANTEE_GROUP {
+		return `SELECT u.usename
+            FROM pg_group g, pg_user u
+            WHERE u.usesysid = ANY(g.grolist)
+            AND g.groname = $1`
+	}
+	return "SELECT DISTINCT user_name FROM svv_user_grants WHERE role_name = $1"
+}
+
+func (rd *Redshift) memberOfSql(kind string) string {
+	if kind == GRANTEE_GROUP {
+		return `SELECT g.groname
+            FROM pg_group g, pg_user u
+            WHERE u.usesysid = ANY(g.grolist)
+            AND u.usename = $1`
+	}
+	return "SELECT DISTINCT role_name FROM svv_user_grants WHERE user_name = $1"
+}
+
+// membershipsSql prefixes groups with "group " as Redshift does in ACLs.
+func (rd *Redshift) membershipsSql() []string {
+	return []string{
+		`SELECT 'group ' || g.groname, u.usename
+            FROM pg_group g, pg_user u
+            WHERE u.usesysid = ANY(g.grolist)`,
+		"SELECT DISTINCT role_name, user_name FROM svv_user_grants",
+	}
+}
+
+// memberOfKinds only reports memberships of users. Groups cannot be nested,
+// and roles granted to other roles are left for DBAs to manage. Of those,
+// only the memberships of managed roles and groups are revoked, looked up
+// by kind since a group and a role can share a name.
+func (rd *Redshift) memberOfKinds(grantee *Grantee) []string {
+	if grantee.Kind == GRANTEE_USER {
+		return []string{GRANTEE_ROLE, GRANTEE_GROUP}
+	}
+	return []string{}
+}
+
+// functionsSql uses oidvectortypes since Redshift does not have
+// pg_get_function_identity_arguments.
+func (rd *Redshift) functionsSql() string {
+	return `SELECT n.nspname, p.proname,
+            oidvectortypes(p.proargtypes),
+            pg_get_userbyid(p.proowner)
+        FROM pg_proc p
+        JOIN pg_namespace n ON n.oid = p.pronamespace
+        ORDER BY n.nspname, p.proname`
+}
+
+func (rd *Redshift) functionAclsSql() string {
+	return `SELECT 'function',
+            n.nspname || '.' || p.proname || '(' || oidvectortypes(p.proargtypes) || ')',
+            pg_get_userbyid(p.proowner),
+            array_to_string(p.proacl, ',')
+        FROM pg_proc p
+        JOIN pg_namespace n ON n.oid = p.pronamespace
+        WHERE n.nspname NOT LIKE 'pg_%'
+        AND n.nspname != 'information_schema'`
+}
+
+func (rd *Redshift) aclGrantee(grantee *Grantee) string {
+	if grantee.Kind == GRANTEE_GROUP {
+		return "group " + grantee.Name
+	}
+	return grantee.Name
+}
+
+// loginUsersSql lists every user, since locked users keep showing up in
+// pg_user with their password disabled.
+func (rd *Redshift) loginUsersSql() string {
+	return "SELECT usename FROM pg_user"
+}
+
+// Redshift has neither pg_attribute.attacl nor PostgreSQL style row level
+// security policies.
+func (rd *Redshift) supportsFineGrainedAcls() bool {
+	return false
+}
+
+// Redshift has neither REASSIGN OWNED nor DROP OWNED.
+func (rd *Redshift) supportsReassignOwned() bool {
+	return false
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Scope restricts an agent to some of the databases of the account, so that
+// several agents can share it, each reaching its own databases. A database
+// is in scope if it matches every criterion that is set, and a criterion if
+// it matches any of its values. An empty scope includes everything.
+type Scope struct {
+	DatabaseIds   map[int]bool
+	DatabaseNames map[string]bool
+	DatabaseTypes map[string]bool
+	Tags          map[string]bool
+	// Hosts are matched against the address of the database, which is
+	// looked up if it is a hostname.
+	Hosts []*net.IPNet
+	// lookup resolves hostnames, and is only replaced by tests.
+	lookup func(host string) ([]net.IP, error)
+}
+
+func splitList(value string) []string {
+	values := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+func stringSet(value string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range splitList(value) {
+		set[item] = true
+	}
+	return set
+}
+
+func parseScope(ids string, names string, types string, tags string, hosts string) (*Scope, error) {
+	scope := &Scope{
+		DatabaseIds:   map[int]bool{},
+		DatabaseNames: stringSet(names),
+		DatabaseTypes: stringSet(types),
+		Tags:          stringSet(tags),
+		Hosts:         []*net.IPNet{},
+		lookup:        net.LookupIP,
+	}
+	for _, item := range splitList(ids) {
+		id, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid database id: %s", item))
+		}
+		scope.DatabaseIds[id] = true
+	}
+	for _, item := range splitList(hosts) {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("Invalid host CIDR: %s", item))
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			scope.Hosts = append(scope.Hosts, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid host CIDR: %s", item))
+		}
+		scope.Hosts = append(scope.Hosts, network)
+	}
+	return scope, nil
+}
+
+func (s *Scope) isEmpty() bool {
+	return s == nil || (len(s.DatabaseIds) == 0 && len(s.DatabaseNames) == 0 &&
+		len(s.DatabaseTypes) == 0 && len(s.Tags) == 0 && len(s.Hosts) == 0)
+}
+
+// matchesHost fails if the host cannot be resolved, in which case it is
+// not known whether the database is in scope.
+func (s *Scope) matchesHost(host string) (bool, error) {
+	ips := []net.IP{}
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		resolved, err := s.lookup(host)
+		if err != nil {
+			return false, errors.New(fmt.Sprintf("Could not resolve %s to check the scope: %s", host, err))
+		}
+		ips = resolved
+	}
+	for _, ip := range ips {
+		for _, network := range s.Hosts {
+			if network.Contains(ip) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (s *Scope) includes(db *Database) (bool, error) {
+	if s.isEmpty() {
+		return true, nil
+	}
+	if len(s.DatabaseIds) > 0 && !s.DatabaseIds[db.Id] {
+		return false, nil
+	}
+	if len(s.DatabaseNames) > 0 && !s.DatabaseNames[db.Name] {
+		return false, nil
+	}
+	if len(s.DatabaseTypes) > 0 && !s.DatabaseTypes[db.Type] {
+		return false, nil
+	}
+	if len(s.Tags) > 0 {
+		tagged := false
+		for _, tag := range db.Tags {
+			tagged = tagged || s.Tags[tag]
+		}
+		if !tagged {
+			return false, nil
+		}
+	}
+	if len(s.Hosts) == 0 {
+		return true, nil
+	}
+	return s.matchesHost(db.Host)
+}
+
+// filter returns the part of the grants response in scope. Connections,
+// users, roles and grants of other databases are left out, so that they are
+// neither worked on nor reported in the checkin. Databases whose host could
+// not be resolved are kept with the error, and reported as connection
+// issues until it resolves again.
+func (s *Scope) filter(gr *GrantsResponse) *GrantsResponse {
+	if s.isEmpty() {
+		return gr
+	}
+	filtered := &GrantsResponse{
+		Connections: []Connection{},
+		Users:       []User{},
+		Roles:       []Role{},
+		Grants:      []Grant{},
+		Revision:    gr.Revision,
+		scopeErrors: map[int]error{},
+	}
+	databases := map[int]bool{}
+	connections := map[int]bool{}
+	for _, conn := range gr.Connections {
+		included, seen := databases[conn.Database.Id]
+		if !seen {
+			var err error
+			included, err = s.includes(conn.Database)
+			if err != nil {
+				logger.Warningf("Database %d (%s): %s", conn.Database.Id, conn.Database.Name, err)
+				filtered.scopeErrors[conn.Database.Id] = err
+				included = true
+			}
+			databases[conn.Database.Id] = included
+			if !included {
+				logger.Debugf("Database %d (%s) is out of scope", conn.Database.Id, conn.Database.Name)
+			}
+		}
+		if included {
+			connections[conn.Id] = true
+			filtered.Connections = append(filtered.Connections, conn)
+		}
+	}
+	for _, user := range gr.Users {
+		if databases[user.DatabaseId] {
+			filtered.Users = append(filtered.Users, user)
+		}
+	}
+	for _, role := range gr.Roles {
+		if databases[role.DatabaseId] {
+			filtered.Roles = append(filtered.Roles, role)
+		}
+	}
+	for _, grant := range gr.Grants {
+		if connections[grant.ConnectionId] {
+			filtered.Grants = append(filtered.Grants, grant)
+		}
+	}
+	return filtered
+}
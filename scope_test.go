@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scopeTestResponse() *GrantsResponse {
+	eu := &Database{Id: 1, Name: "eu-main", Type: "postgresql", Host: "10.1.0.5", Tags: []string{"eu", "prod"}}
+	us := &Database{Id: 2, Name: "us-main", Type: "mysql", Host: "db.us.example.com", Tags: []string{"us", "prod"}}
+	return &GrantsResponse{
+		Connections: []Connection{
+			{Id: 10, Database: eu, DbName: "app"},
+			{Id: 11, Database: eu, DbName: "reports"},
+			{Id: 20, Database: us, DbName: "app"},
+		},
+		Users: []User{{Id: 100, DatabaseId: 1}, {Id: 200, DatabaseId: 2}},
+		Roles: []Role{{Id: 300, DatabaseId: 2}},
+		Grants: []Grant{
+			{Id: 1000, DatabaseId: 1, ConnectionId: 10},
+			{Id: 1001, DatabaseId: 1, ConnectionId: 11},
+			{Id: 2000, DatabaseId: 2, ConnectionId: 20},
+		},
+		Revision: "7",
+	}
+}
+
+func scopedIds(t *testing.T, ids string, names string, types string, tags string, hosts string) []int {
+	scope, err := parseScope(ids, names, types, tags, hosts)
+	assert.Nil(t, err)
+	scope.lookup = func(host string) ([]net.IP, error) {
+		if host == "db.us.example.com" {
+			return []net.IP{net.ParseIP("10.2.0.7")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	return scope.filter(scopeTestResponse()).databaseIds()
+}
+
+func TestScope(t *testing.T) {
+	assert.Equal(t, []int{1, 2}, scopedIds(t, "", "", "", "", ""))
+	assert.Equal(t, []int{2}, scopedIds(t, "2, 3", "", "", "", ""))
+	assert.Equal(t, []int{1}, scopedIds(t, "", "eu-main", "", "", ""))
+	assert.Equal(t, []int{2}, scopedIds(t, "", "", "mysql,redshift", "", ""))
+	assert.Equal(t, []int{1, 2}, scopedIds(t, "", "", "", "prod", ""))
+	assert.Equal(t, []int{1}, scopedIds(t, "", "", "", "eu,staging", ""))
+	assert.Equal(t, []int{1}, scopedIds(t, "", "", "", "", "10.1.0.0/16"))
+	assert.Equal(t, []int{2}, scopedIds(t, "", "", "", "", "10.2.0.7"))
+	assert.Equal(t, []int{1, 2}, scopedIds(t, "", "", "", "", "10.0.0.0/8,fd00::/8"))
+	// Every criterion must match.
+	assert.Equal(t, []int{}, scopedIds(t, "1", "", "mysql", "", ""))
+	assert.Equal(t, []int{2}, scopedIds(t, "", "", "", "prod", "10.2.0.0/16"))
+
+	for _, hosts := range []string{"10.0.0.0/33", "db.example.com"} {
+		_, err := parseScope("", "", "", "", hosts)
+		assert.NotNil(t, err, hosts)
+	}
+	_, err := parseScope("one", "", "", "", "")
+	assert.NotNil(t, err)
+}
+
+func TestScopeFilter(t *testing.T) {
+	scope, err := parseScope("", "", "", "eu", "")
+	assert.Nil(t, err)
+	filtered := scope.filter(scopeTestResponse())
+	assert.Equal(t, 2, len(filtered.Connections))
+	assert.Equal(t, []User{{Id: 100, DatabaseId: 1}}, filtered.Users)
+	assert.Equal(t, []Role{}, filtered.Roles)
+	assert.Equal(t, 2, len(filtered.Grants))
+	for _, grant := range filtered.Grants {
+		assert.Equal(t, 1, grant.DatabaseId)
+	}
+	assert.Equal(t, "7", filtered.Revision)
+
+	var none *Scope
+	response := scopeTestResponse()
+	assert.True(t, none.filter(response) == response)
+}
+
+func TestScopeUnresolvedHost(t *testing.T) {
+	scope, err := parseScope("", "", "", "", "10.2.0.0/16")
+	assert.Nil(t, err)
+	scope.lookup = func(host string) ([]net.IP, error) {
+		return nil, errors.New("no such host")
+	}
+	filtered := scope.filter(scopeTestResponse())
+	assert.Equal(t, []int{2}, filtered.databaseIds())
+	assert.NotNil(t, filtered.scopeErrors[2])
+
+	// The database is not known to be out of scope, so the checkin does not
+	// settle.
+	app := &Application{conf: &Config{}, state: newAgentState("")}
+	checkin := handleGrantsResponse(app, filtered)
+	assert.Equal(t, Result(RESULT_CONNECTION_ISSUE), checkin.UserResults[0].Result)
+	assert.Equal(t, Result(RESULT_CONNECTION_ISSUE), checkin.GrantResults[0].Result)
+	assert.False(t, checkin.settled())
+}
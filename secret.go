@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+const SECRET_REDACTED = "[REDACTED]"
+
+// Secret holds a decrypted password, or anything containing one such as a
+// DSN or a statement. Unlike a string, it can be wiped once used, and it is
+// redacted whenever it is formatted, including by the logger. The nil
+// Secret is empty.
+//
+// Drivers and the standard library copy what they are given, and those
+// copies are out of reach. Secrets keep them to the statement or connection
+// being handled, rather than the whole cycle.
+type Secret struct {
+	data []byte
+}
+
+func newSecret(data []byte) *Secret {
+	return &Secret{data: data}
+}
+
+func (s *Secret) isEmpty() bool {
+	return s == nil || len(s.data) == 0
+}
+
+func (s *Secret) bytes() []byte {
+	if s == nil {
+		return nil
+	}
+	return s.data
+}
+
+// unsafeString returns a string sharing the memory of the secret, so that
+// no copy is made. The string must not be used once the secret is wiped.
+func (s *Secret) unsafeString() string {
+	if s.isEmpty() {
+		return ""
+	}
+	return unsafe.String(unsafe.SliceData(s.data), len(s.data))
+}
+
+func (s *Secret) wipe() {
+	if s == nil {
+		return
+	}
+	wipeBytes(s.data)
+	s.data = nil
+}
+
+func (s *Secret) String() string {
+	return SECRET_REDACTED
+}
+
+func (s *Secret) GoString() string {
+	return SECRET_REDACTED
+}
+
+// Format redacts the secret with every verb, %x and %q included.
+func (s *Secret) Format(f fmt.State, verb rune) {
+	io.WriteString(f, SECRET_REDACTED)
+}
+
+// secretConnector opens database connections with a password decrypted
+// for each new connection and wiped once it is established, so that the
+// connection pool never holds the password or a DSN containing it.
+type secretConnector struct {
+	driver   driver.Driver
+	password func() (*Secret, error)
+	dsn      func(password *Secret) *Secret
+}
+
+func (sc *secretConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	password, err := sc.password()
+	if err != nil {
+		return nil, err
+	}
+	defer password.wipe()
+	dsn := sc.dsn(password)
+	defer dsn.wipe()
+	return sc.driver.Open(dsn.unsafeString())
+}
+
+func (sc *secretConnector) Driver() driver.Driver {
+	return sc.driver
+}
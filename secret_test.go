@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretFormatting(t *testing.T) {
+	secret := newSecret([]byte("s3cret"))
+	user := struct {
+		Name     string
+		Password *Secret
+	}{"bob", secret}
+	for _, format := range []string{"%s", "%v", "%+v", "%#v", "%q", "%x"} {
+		assert.NotContains(t, fmt.Sprintf(format, secret), "s3cret", format)
+		assert.NotContains(t, fmt.Sprintf(format, user), "s3cret", format)
+	}
+	assert.Equal(t, SECRET_REDACTED, fmt.Sprint(secret))
+
+	data := secret.bytes()
+	assert.Equal(t, "s3cret", secret.unsafeString())
+	secret.wipe()
+	assert.Equal(t, make([]byte, 6), data)
+	assert.True(t, secret.isEmpty())
+	var none *Secret
+	none.wipe()
+	assert.Equal(t, "", none.unsafeString())
+}
+
+func TestPgPasswordSql(t *testing.T) {
+	for _, password := range []string{"simple", "PasW';drop table `foo`", `back\slash'`} {
+		sql := pgPasswordSql("ALTER USER x PASSWORD ", newSecret([]byte(password)))
+		assert.Equal(t, "ALTER USER x PASSWORD "+PgQuoteLiteral(password), sql.unsafeString())
+	}
+}
+
+type fakeDriver struct {
+	dsns []string
+}
+
+func (fd *fakeDriver) Open(dsn string) (driver.Conn, error) {
+	// A copy is kept, as the DSN is wiped once the connection is opened.
+	fd.dsns = append(fd.dsns, string([]byte(dsn)))
+	return nil, errors.New("fake driver")
+}
+
+func TestSecretConnector(t *testing.T) {
+	fake := &fakeDriver{}
+	var passwords []*Secret
+	db := sql.OpenDB(&secretConnector{
+		driver: fake,
+		password: func() (*Secret, error) {
+			password := newSecret([]byte("s3cret"))
+			passwords = append(passwords, password)
+			return password, nil
+		},
+		dsn: func(password *Secret) *Secret {
+			return newSecret(append([]byte("password="), password.bytes()...))
+		},
+	})
+	defer db.Close()
+	assert.NotNil(t, db.Ping())
+	assert.NotNil(t, db.Ping())
+	assert.Equal(t, []string{"password=s3cret", "password=s3cret"}, fake.dsns[:2])
+	for _, password := range passwords {
+		assert.True(t, password.isEmpty())
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// The external signer holds the private key of the agent, which then never
+// touches the disk or the memory of the agent. It listens on a unix socket
+// and answers a single JSON request per connection, one line each way:
+//
+//	{"op": "public_key"}
+//	    -> {"public_key": "<PKIX PEM>"}
+//	{"op": "decrypt", "algorithm": "rsa-pkcs1v15" | "rsa-oaep-sha256", "label": "<base64>", "data": "<base64>"}
+//	    -> {"data": "<base64>"}
+//	{"op": "ecdh", "public_key": "<base64 of the raw peer key>"}
+//	    -> {"data": "<base64 of the shared secret>"}
+//	{"op": "sign", "algorithm": "rsa-pss-sha256" | "ecdsa-sha256", "data": "<base64 of the SHA-256 digest>"}
+//	    -> {"data": "<base64 of the signature, ASN.1 DER for ECDSA>"}
+//
+// Failures are answered with {"error": "..."}. The key must be an RSA, an
+// ECDSA P-256 or an X25519 key. These operations are the ones offered by
+// PKCS#11 tokens (C_Decrypt, C_DeriveKey and C_Sign), so that an HSM, or SoftHSM
+// for testing, can be used through a small bridge. The agent itself is
+// built without cgo and cannot load PKCS#11 modules.
+const (
+	SIGNER_OP_PUBLIC_KEY = "public_key"
+	SIGNER_OP_DECRYPT    = "decrypt"
+	SIGNER_OP_ECDH       = "ecdh"
+	SIGNER_OP_SIGN       = "sign"
+
+	SIGNER_ALGORITHM_RSA_PKCS1V15 = "rsa-pkcs1v15"
+	SIGNER_ALGORITHM_RSA_OAEP     = "rsa-oaep-sha256"
+
+	SIGNER_DIAL_TIMEOUT    = 5 * time.Second
+	SIGNER_REQUEST_TIMEOUT = 30 * time.Second
+)
+
+type SignerRequest struct {
+	Op        string `json:"op"`
+	Algorithm string `json:"algorithm,omitempty"`
+	Label     []byte `json:"label,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+	PublicKey []byte `json:"public_key,omitempty"`
+}
+
+type SignerResponse struct {
+	PublicKey string `json:"public_key,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type SignerClient struct {
+	Socket string
+}
+
+func (sc *SignerClient) call(request *SignerRequest) (*SignerResponse, error) {
+	conn, err := net.DialTimeout("unix", sc.Socket, SIGNER_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(SIGNER_REQUEST_TIMEOUT))
+	if err = json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, err
+	}
+	response := &SignerResponse{}
+	if err = json.NewDecoder(conn).Decode(response); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("The signer closed the connection without answering")
+		}
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, errors.New(fmt.Sprintf("The signer failed to %s: %s", request.Op, response.Error))
+	}
+	return response, nil
+}
+
+// ExternalAgentKey is an AgentKey held by the external signer.
+type ExternalAgentKey struct {
+	client *SignerClient
+	public crypto.PublicKey
+	// ecdhPublic is only set for ECDH keys.
+	ecdhPublic *ecdh.PublicKey
+}
+
+func newExternalAgentKey(socket string) (*ExternalAgentKey, error) {
+	client := &SignerClient{Socket: socket}
+	response, err := client.call(&SignerRequest{Op: SIGNER_OP_PUBLIC_KEY})
+	if err != nil {
+		return nil, err
+	}
+	pemBlock, _ := pem.Decode([]byte(response.PublicKey))
+	if pemBlock == nil {
+		return nil, errors.New("The signer did not send a PEM public key")
+	}
+	public, err := x509.ParsePKIXPublicKey(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key := &ExternalAgentKey{client: client, public: public}
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+	case *ecdsa.PublicKey:
+		if key.ecdhPublic, err = pub.ECDH(); err != nil {
+			return nil, err
+		}
+	case *ecdh.PublicKey:
+		if pub.Curve() != ecdh.X25519() {
+			return nil, errors.New("Only X25519 is supported for raw ECDH keys")
+		}
+		key.ecdhPublic = pub
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported signer key type %T", public))
+	}
+	return key, nil
+}
+
+func (xk *ExternalAgentKey) keyType() string {
+	switch xk.public.(type) {
+	case *rsa.PublicKey:
+		return KEY_TYPE_RSA
+	case *ecdsa.PublicKey:
+		return KEY_TYPE_ECDSA
+	}
+	return KEY_TYPE_X25519
+}
+
+// privateKey is nil, as the key never leaves the signer.
+func (xk *ExternalAgentKey) privateKey() crypto.PrivateKey {
+	return nil
+}
+
+func (xk *ExternalAgentKey) publicKey() crypto.PublicKey {
+	return xk.public
+}
+
+func (xk *ExternalAgentKey) envelopePublicKey() crypto.PublicKey {
+	return nil
+}
+
+func (xk *ExternalAgentKey) envelopeVersions() []string {
+	if xk.ecdhPublic != nil {
+		return []string{ENVELOPE_V4}
+	}
+	return []string{ENVELOPE_V1, ENVELOPE_V2, ENVELOPE_V3}
+}
+
+func (xk *ExternalAgentKey) openEnvelope(version string, data []byte) ([]byte, error) {
+	if xk.ecdhPublic != nil {
+		if version != ENVELOPE_V4 {
+			return nil, errors.New(fmt.Sprintf("%s keys cannot open %s envelopes",
+				xk.keyType(), version))
+		}
+		return openEcdhEnvelope(xk, data, envelopeLabel(version))
+	}
+	switch version {
+	case ENVELOPE_V1:
+		return openLegacyEnvelope(xk, data)
+	case ENVELOPE_V2:
+		return openOaepEnvelope(xk, data, envelopeLabel(version))
+	case ENVELOPE_V3:
+		return openHybridEnvelope(xk, data, envelopeLabel(version))
+	}
+	return nil, errors.New(fmt.Sprintf("RSA keys cannot open %s envelopes", version))
+}
+
+// signer is nil for X25519 keys, which cannot sign.
+func (xk *ExternalAgentKey) signer() crypto.Signer {
+	if xk.keyType() == KEY_TYPE_X25519 {
+		return nil
+	}
+	return xk
+}
+
+func (xk *ExternalAgentKey) wipe() {
+}
+
+// Public, Decrypt, Sign, PublicKey and ECDH implement crypto.Decrypter,
+// crypto.Signer and ecdhAgreement through the signer.
+
+func (xk *ExternalAgentKey) Public() crypto.PublicKey {
+	return xk.public
+}
+
+func (xk *ExternalAgentKey) Decrypt(_ io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	request := &SignerRequest{
+		Op:        SIGNER_OP_DECRYPT,
+		Algorithm: SIGNER_ALGORITHM_RSA_PKCS1V15,
+		Data:      msg,
+	}
+	if oaep, ok := opts.(*rsa.OAEPOptions); ok {
+		if oaep.Hash != crypto.SHA256 {
+			return nil, errors.New("The signer only supports OAEP with SHA-256")
+		}
+		request.Algorithm = SIGNER_ALGORITHM_RSA_OAEP
+		request.Label = oaep.Label
+	}
+	response, err := xk.client.call(request)
+	if err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+func (xk *ExternalAgentKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.SHA256 {
+		return nil, errors.New("The signer only signs SHA-256 digests")
+	}
+	algorithm := signatureAlgorithm(xk.public)
+	if _, ok := opts.(*rsa.PSSOptions); algorithm == SIGNATURE_ALG_RSA_PSS && !ok {
+		return nil, errors.New("The signer only signs with RSA-PSS")
+	}
+	response, err := xk.client.call(&SignerRequest{
+		Op:        SIGNER_OP_SIGN,
+		Algorithm: algorithm,
+		Data:      digest,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
+
+func (xk *ExternalAgentKey) PublicKey() *ecdh.PublicKey {
+	return xk.ecdhPublic
+}
+
+func (xk *ExternalAgentKey) ECDH(remote *ecdh.PublicKey) ([]byte, error) {
+	response, err := xk.client.call(&SignerRequest{
+		Op:        SIGNER_OP_ECDH,
+		PublicKey: remote.Bytes(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return response.Data, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveFakeSigner answers signer requests with the key, the way a signer
+// bridging to a PKCS#11 token would.
+func serveFakeSigner(t *testing.T, socket string, key AgentKey) net.Listener {
+	listener, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+	pub, err := encodePublicKey(key)
+	assert.Nil(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var request SignerRequest
+			json.NewDecoder(conn).Decode(&request)
+			response := SignerResponse{}
+			switch request.Op {
+			case SIGNER_OP_PUBLIC_KEY:
+				response.PublicKey = string(pub)
+			case SIGNER_OP_DECRYPT:
+				var opts crypto.DecrypterOpts
+				if request.Algorithm == SIGNER_ALGORITHM_RSA_OAEP {
+					opts = oaepOptions(request.Label)
+				}
+				response.Data, err = key.privateKey().(*rsa.PrivateKey).Decrypt(rand.Reader, request.Data, opts)
+			case SIGNER_OP_ECDH:
+				var remote *ecdh.PublicKey
+				remote, err = ecdh.X25519().NewPublicKey(request.PublicKey)
+				if err == nil {
+					response.Data, err = key.privateKey().(*ecdh.PrivateKey).ECDH(remote)
+				}
+			case SIGNER_OP_SIGN:
+				var opts crypto.SignerOpts = crypto.SHA256
+				if request.Algorithm == SIGNATURE_ALG_RSA_PSS {
+					opts = pssOptions
+				}
+				response.Data, err = key.signer().Sign(rand.Reader, request.Data, opts)
+			}
+			if err != nil {
+				response.Error = err.Error()
+			}
+			json.NewEncoder(conn).Encode(response)
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestExternalSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	secret := []byte("PasW';drop table `foo`")
+
+	rsaKey, err := generateAgentKey(KEY_TYPE_RSA)
+	assert.Nil(t, err)
+	socket := filepath.Join(dir, "rsa.sock")
+	listener := serveFakeSigner(t, socket, rsaKey)
+	defer listener.Close()
+	key, err := newExternalAgentKey(socket)
+	assert.Nil(t, err)
+	assert.Equal(t, KEY_TYPE_RSA, key.keyType())
+	assert.Equal(t, rsaKey.publicKey(), key.publicKey())
+	raw := rsaKey.privateKey().(*rsa.PrivateKey)
+	for _, envelope := range []string{
+		sealLegacyEnvelope(t, raw, secret),
+		sealOaepEnvelope(t, raw, secret),
+		sealHybridEnvelope(t, raw, secret),
+	} {
+		opened, err := openEnvelope(key, envelope)
+		assert.Nil(t, err)
+		assert.Equal(t, secret, opened)
+	}
+	// Errors of the signer are passed on.
+	_, err = openEnvelope(key, "v2:"+base64.StdEncoding.EncodeToString(make([]byte, 256)))
+	assert.Contains(t, err.Error(), "The signer failed to decrypt")
+
+	x25519Key, err := generateAgentKey(KEY_TYPE_X25519)
+	assert.Nil(t, err)
+	socket = filepath.Join(dir, "x25519.sock")
+	listener = serveFakeSigner(t, socket, x25519Key)
+	defer listener.Close()
+	key, err = newExternalAgentKey(socket)
+	assert.Nil(t, err)
+	assert.Equal(t, KEY_TYPE_X25519, key.keyType())
+	assert.Equal(t, []string{ENVELOPE_V4}, key.envelopeVersions())
+	opened, err := openEnvelope(key, sealEcdhEnvelope(t, x25519Key, secret))
+	assert.Nil(t, err)
+	assert.Equal(t, secret, opened)
+
+	_, err = newExternalAgentKey(filepath.Join(dir, "missing.sock"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests to DbRhino carry a timestamp, a random nonce and the SHA-256 of
+// their body, and are signed with the agent key over:
+//
+//	dbrhino-agent-v1\n<method>\n<path and query>\n<timestamp>\n<nonce>\n<body hash>
+//
+// The server rejects stale timestamps and nonces it already saw. When a
+// server signing key is configured, responses must be signed over:
+//
+//	dbrhino-server-v1\n<request nonce>\n<status>\n<timestamp>\n<body hash>
+//
+// which ties every response to the request it answers.
+const (
+	SIGNATURE_HEADER      = "X-Dbrhino-Signature"
+	TIMESTAMP_HEADER      = "X-Dbrhino-Timestamp"
+	NONCE_HEADER          = "X-Dbrhino-Nonce"
+	CONTENT_SHA256_HEADER = "X-Dbrhino-Content-Sha256"
+
+	REQUEST_SIGNATURE_CONTEXT  = "dbrhino-agent-v1"
+	RESPONSE_SIGNATURE_CONTEXT = "dbrhino-server-v1"
+
+	SIGNATURE_MAX_SKEW = 5 * time.Minute
+
+	SIGNATURE_ALG_RSA_PSS = "rsa-pss-sha256"
+	SIGNATURE_ALG_ECDSA   = "ecdsa-sha256"
+	SIGNATURE_ALG_ED25519 = "ed25519"
+)
+
+func signatureAlgorithm(pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return SIGNATURE_ALG_RSA_PSS
+	case *ecdsa.PublicKey:
+		return SIGNATURE_ALG_ECDSA
+	case ed25519.PublicKey:
+		return SIGNATURE_ALG_ED25519
+	}
+	return ""
+}
+
+var pssOptions = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+
+func signMessage(signer crypto.Signer, message []byte) (string, []byte, error) {
+	alg := signatureAlgorithm(signer.Public())
+	digest := sha256.Sum256(message)
+	var sig []byte
+	var err error
+	switch alg {
+	case SIGNATURE_ALG_RSA_PSS:
+		sig, err = signer.Sign(rand.Reader, digest[:], pssOptions)
+	case SIGNATURE_ALG_ECDSA:
+		sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case SIGNATURE_ALG_ED25519:
+		sig, err = signer.Sign(rand.Reader, message, crypto.Hash(0))
+	default:
+		return "", nil, errors.New(fmt.Sprintf("Keys of type %T cannot sign", signer.Public()))
+	}
+	return alg, sig, err
+}
+
+func verifyMessage(pub crypto.PublicKey, alg string, message []byte, sig []byte) error {
+	if alg != signatureAlgorithm(pub) {
+		return errors.New(fmt.Sprintf("Unexpected signature algorithm %s", alg))
+	}
+	digest := sha256.Sum256(message)
+	valid := false
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPSS(key, crypto.SHA256, digest[:], sig, pssOptions) == nil
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, message, sig)
+	}
+	if !valid {
+		return errors.New("Invalid signature")
+	}
+	return nil
+}
+
+// publicKeyId identifies a key by the hash of its PKIX encoding, like the
+// pins of the HTTP client.
+func publicKeyId(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return SPKI_PIN_PREFIX + base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+func formatSignatureHeader(keyId string, alg string, sig []byte) string {
+	return fmt.Sprintf("keyid=%s;alg=%s;sig=%s", keyId, alg,
+		base64.StdEncoding.EncodeToString(sig))
+}
+
+func parseSignatureHeader(header string) (string, string, []byte, error) {
+	fields := map[string]string{}
+	for _, field := range strings.Split(header, ";") {
+		if idx := strings.Index(field, "="); idx > 0 {
+			fields[strings.TrimSpace(field[:idx])] = strings.TrimSpace(field[idx+1:])
+		}
+	}
+	sig, err := base64.StdEncoding.DecodeString(fields["sig"])
+	if err != nil || len(sig) == 0 {
+		return "", "", nil, errors.New("Malformed signature header")
+	}
+	return fields["keyid"], fields["alg"], sig, nil
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func requestSigningString(req *http.Request, timestamp string, nonce string, hash string) []byte {
+	return []byte(strings.Join([]string{REQUEST_SIGNATURE_CONTEXT, req.Method,
+		req.URL.RequestURI(), timestamp, nonce, hash}, "\n"))
+}
+
+func responseSigningString(nonce string, status int, timestamp string, hash string) []byte {
+	return []byte(strings.Join([]string{RESPONSE_SIGNATURE_CONTEXT, nonce,
+		strconv.Itoa(status), timestamp, hash}, "\n"))
+}
+
+// signRequest sets the signing headers of the request and returns its
+// nonce. The signature itself is left out if the key cannot sign.
+func signRequest(key AgentKey, req *http.Request, body []byte) (string, error) {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	hash := bodyHash(body)
+	req.Header.Set(TIMESTAMP_HEADER, timestamp)
+	req.Header.Set(NONCE_HEADER, nonce)
+	req.Header.Set(CONTENT_SHA256_HEADER, hash)
+	if key == nil || key.signer() == nil {
+		return nonce, nil
+	}
+	signer := key.signer()
+	keyId, err := publicKeyId(signer.Public())
+	if err != nil {
+		return "", err
+	}
+	alg, sig, err := signMessage(signer, requestSigningString(req, timestamp, nonce, hash))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(SIGNATURE_HEADER, formatSignatureHeader(keyId, alg, sig))
+	return nonce, nil
+}
+
+// verifyResponse checks the signature of the response to the request sent
+// with the nonce, and that it is recent.
+func verifyResponse(pub crypto.PublicKey, nonce string, res *http.Response, body []byte) error {
+	header := res.Header.Get(SIGNATURE_HEADER)
+	if header == "" {
+		return errors.New("The DbRhino response is not signed")
+	}
+	_, alg, sig, err := parseSignatureHeader(header)
+	if err != nil {
+		return err
+	}
+	timestamp := res.Header.Get(TIMESTAMP_HEADER)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("The DbRhino response has no valid timestamp")
+	}
+	skew := time.Since(time.Unix(seconds, 0))
+	if skew > SIGNATURE_MAX_SKEW || skew < -SIGNATURE_MAX_SKEW {
+		return errors.New(fmt.Sprintf("The DbRhino response timestamp is off by %s", skew))
+	}
+	message := responseSigningString(nonce, res.StatusCode, timestamp, bodyHash(body))
+	if err = verifyMessage(pub, alg, message, sig); err != nil {
+		return errors.New(fmt.Sprintf("The DbRhino response signature is invalid: %s", err))
+	}
+	return nil
+}
+
+func readServerSigningKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pemBlock, _ := pem.Decode(data)
+	if pemBlock == nil || pemBlock.Type != "PUBLIC KEY" {
+		return nil, errors.New(fmt.Sprintf("No PEM public key found in %s", path))
+	}
+	pub, err := x509.ParsePKIXPublicKey(pemBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if signatureAlgorithm(pub) == "" {
+		return nil, errors.New(fmt.Sprintf("Keys of type %T cannot sign", pub))
+	}
+	return pub, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// signingServer checks the signature of the requests against the agent key
+// and signs its responses with the server key.
+func signingServer(t *testing.T, agentKey *AgentKey, serverKey ed25519.PrivateKey,
+	tamper func(http.ResponseWriter)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		hash := r.Header.Get(CONTENT_SHA256_HEADER)
+		assert.Equal(t, bodyHash(body), hash)
+		nonce := r.Header.Get(NONCE_HEADER)
+		if *agentKey != nil {
+			keyId, alg, sig, err := parseSignatureHeader(r.Header.Get(SIGNATURE_HEADER))
+			assert.Nil(t, err)
+			pub := (*agentKey).publicKey()
+			expectedId, _ := publicKeyId(pub)
+			assert.Equal(t, expectedId, keyId)
+			message := requestSigningString(r, r.Header.Get(TIMESTAMP_HEADER), nonce, hash)
+			assert.Nil(t, verifyMessage(pub, alg, message, sig))
+		} else {
+			assert.Equal(t, "", r.Header.Get(SIGNATURE_HEADER))
+		}
+		response := []byte(`{"ok": true}`)
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		alg, sig, _ := signMessage(serverKey,
+			responseSigningString(nonce, http.StatusOK, timestamp, bodyHash(response)))
+		w.Header().Set(TIMESTAMP_HEADER, timestamp)
+		w.Header().Set(SIGNATURE_HEADER, formatSignatureHeader("server", alg, sig))
+		if tamper != nil {
+			tamper(w)
+		}
+		w.Write(response)
+	}))
+}
+
+func TestRequestSigning(t *testing.T) {
+	serverPub, serverKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	var agentKey AgentKey
+	server := signingServer(t, &agentKey, serverKey, nil)
+	defer server.Close()
+	conf := &Config{ServerUrl: server.URL, SignRequests: true, ServerSigningKey: serverPub}
+	app := &Application{conf: conf}
+	post := func() error {
+		var result map[string]bool
+		return dbrhinoPostRequest(app, "/api/checkins?full=1", []byte(`{"version": "1"}`), &result)
+	}
+
+	for _, keyType := range []string{KEY_TYPE_RSA, KEY_TYPE_ECDSA, KEY_TYPE_ED25519} {
+		agentKey, err = generateAgentKey(keyType)
+		assert.Nil(t, err)
+		app.key = agentKey
+		assert.Nil(t, post(), keyType)
+	}
+
+	// X25519 keys cannot sign, nor can any key once signing is disabled.
+	app.key, err = generateAgentKey(KEY_TYPE_X25519)
+	assert.Nil(t, err)
+	assert.Nil(t, app.key.signer())
+	agentKey = nil
+	assert.Nil(t, post())
+	app.key = testAgentKey
+	conf.SignRequests = false
+	assert.Nil(t, post())
+
+	// Keys held by the external signer sign through it.
+	dir, err := ioutil.TempDir("", "signing")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, keyType := range []string{KEY_TYPE_RSA, KEY_TYPE_ECDSA} {
+		agentKey, err = generateAgentKey(keyType)
+		assert.Nil(t, err)
+		socket := filepath.Join(dir, keyType+".sock")
+		listener := serveFakeSigner(t, socket, agentKey)
+		defer listener.Close()
+		app.key, err = newExternalAgentKey(socket)
+		assert.Nil(t, err)
+		conf.SignRequests = true
+		assert.Nil(t, post(), keyType)
+	}
+}
+
+func TestResponseVerification(t *testing.T) {
+	serverPub, serverKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	get := func(tamper func(http.ResponseWriter)) error {
+		var agentKey AgentKey
+		server := signingServer(t, &agentKey, serverKey, tamper)
+		defer server.Close()
+		app := &Application{conf: &Config{ServerUrl: server.URL, ServerSigningKey: serverPub}}
+		var result map[string]bool
+		return dbrhinoGetRequest(app, "/api/grants", &result)
+	}
+	assert.Nil(t, get(nil))
+
+	err = get(func(w http.ResponseWriter) {
+		w.Header().Del(SIGNATURE_HEADER)
+	})
+	assert.Contains(t, err.Error(), "not signed")
+	err = get(func(w http.ResponseWriter) {
+		timestamp := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+		w.Header().Set(TIMESTAMP_HEADER, timestamp)
+	})
+	assert.Contains(t, err.Error(), "timestamp is off")
+	err = get(func(w http.ResponseWriter) {
+		timestamp := w.Header().Get(TIMESTAMP_HEADER)
+		alg, sig, _ := signMessage(otherKey,
+			responseSigningString("nonce", http.StatusOK, timestamp, bodyHash([]byte(`{"ok": true}`))))
+		w.Header().Set(SIGNATURE_HEADER, formatSignatureHeader("server", alg, sig))
+	})
+	assert.Contains(t, err.Error(), "signature is invalid")
+	// A response signed for another request is rejected as well.
+	err = get(func(w http.ResponseWriter) {
+		timestamp := w.Header().Get(TIMESTAMP_HEADER)
+		alg, sig, _ := signMessage(serverKey,
+			responseSigningString("other", http.StatusOK, timestamp, bodyHash([]byte(`{"ok": true}`))))
+		w.Header().Set(SIGNATURE_HEADER, formatSignatureHeader("server", alg, sig))
+	})
+	assert.Contains(t, err.Error(), "signature is invalid")
+}
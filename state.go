@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TimedGrant records a time-bound grant that has been applied, so that it
+// can be revoked when it expires even if the server cannot be reached.
+type TimedGrant struct {
+	GrantId      int       `json:"grant_id"`
+	ConnectionId int       `json:"connection_id"`
+	Grantee      Grantee   `json:"grantee"`
+	ValidUntil   time.Time `json:"valid_until"`
+}
+
+// Tombstone marks a user that was revoked locally with the revoke-user
+// command. Server cycles leave such users alone until the tombstone is
+// cleared.
+type Tombstone struct {
+	DatabaseId   int       `json:"database_id"`
+	DatabaseName string    `json:"database_name"`
+	Username     string    `json:"username"`
+	Dropped      bool      `json:"dropped"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// GrantFingerprint captures the privileges a grant left its grantee with on
+// a connection right after it was applied.
+type GrantFingerprint struct {
+	GrantId      int       `json:"grant_id"`
+	ConnectionId int       `json:"connection_id"`
+	Version      string    `json:"version"`
+	RenderedHash string    `json:"rendered_hash"`
+	Privileges   []string  `json:"privileges"`
+	AppliedAt    time.Time `json:"applied_at"`
+}
+
+// LocalPassword records the last password of a user handed to the
+// credential sinks, whether the agent generated it or not. Only its
+// fingerprint is kept.
+type LocalPassword struct {
+	DatabaseId  int       `json:"database_id"`
+	Username    string    `json:"username"`
+	Fingerprint string    `json:"fingerprint"`
+	RotatedAt   time.Time `json:"rotated_at"`
+	// PendingDelivery is set from before the password is changed in the
+	// database until every sink received it.
+	PendingDelivery bool `json:"pending_delivery,omitempty"`
+}
+
+// userKey identifies a user of a database in the maps of the state.
+func userKey(databaseId int, username string) string {
+	return fmt.Sprintf("%d/%s", databaseId, username)
+}
+
+// AgentState is the local state store of the agent. It is persisted as JSON
+// in the config directory, or kept in memory only when it has no path. The
+// commands run next to the server, such as revoke-user, change it as well,
+// so every change is made on the state just read from the file, with the
+// file locked.
+type AgentState struct {
+	path  string
+	mutex sync.Mutex
+	agentStateData
+}
+
+// agentStateData holds what is persisted of the state.
+type agentStateData struct {
+	// Connections caches the connections last received from the server.
+	// Master passwords are stored encrypted, exactly as the server sent them.
+	Connections  map[int]Connection        `json:"connections"`
+	TimedGrants  map[int]*TimedGrant       `json:"timed_grants"`
+	ExpiryEvents []*ExpiryEvent            `json:"expiry_events"`
+	Tombstones   map[string]*Tombstone     `json:"tombstones"`
+	Fingerprints map[int]*GrantFingerprint `json:"grant_fingerprints"`
+	Passwords    map[string]*LocalPassword `json:"local_passwords"`
+	// UserExpiries are the VALID UNTIL set on users by the agent, so that
+	// it only clears the ones it set.
+	UserExpiries map[string]time.Time `json:"user_expiries"`
+	// KeyRotatedAt is when the agent key was last rotated, or first seen.
+	KeyRotatedAt time.Time `json:"key_rotated_at"`
+}
+
+func newAgentStateData() agentStateData {
+	return agentStateData{
+		Connections:  map[int]Connection{},
+		TimedGrants:  map[int]*TimedGrant{},
+		ExpiryEvents: []*ExpiryEvent{},
+		Tombstones:   map[string]*Tombstone{},
+		Fingerprints: map[int]*GrantFingerprint{},
+		Passwords:    map[string]*LocalPassword{},
+		UserExpiries: map[string]time.Time{},
+	}
+}
+
+func newAgentState(path string) *AgentState {
+	return &AgentState{path: path, agentStateData: newAgentStateData()}
+}
+
+func loadAgentState(path string) (*AgentState, error) {
+	state := newAgentState(path)
+	if err := state.reload(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// read replaces the state with the one of the file. It must be called with
+// the mutex held.
+func (st *AgentState) read() error {
+	if st.path == "" || !fileExists(st.path) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(st.path)
+	if err != nil {
+		return err
+	}
+	fresh := newAgentStateData()
+	if err = json.Unmarshal(data, &fresh); err != nil {
+		return err
+	}
+	st.agentStateData = fresh
+	return nil
+}
+
+// reload picks up the changes made by other processes, and is called at the
+// start of every cycle.
+func (st *AgentState) reload() error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.path == "" {
+		return nil
+	}
+	unlock, err := lockFile(st.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return st.read()
+}
+
+// update applies the change to the state read from the file and saves it,
+// with the file locked so that other processes do not interleave.
+func (st *AgentState) update(change func()) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.path == "" {
+		change()
+		return nil
+	}
+	unlock, err := lockFile(st.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err = st.read(); err != nil {
+		return err
+	}
+	change()
+	return st.save()
+}
+
+// save writes the state to a temporary file first, so that a crash can never
+// leave a truncated state file behind. It must be called with the mutex held
+// and the file locked.
+func (st *AgentState) save() error {
+	data, err := json.Marshal(&st.agentStateData)
+	if err != nil {
+		return err
+	}
+	tmpPath := st.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, st.path)
+}
+
+func (st *AgentState) cacheConnections(conns []Connection) error {
+	return st.update(func() {
+		st.Connections = map[int]Connection{}
+		for _, conn := range conns {
+			st.Connections[conn.Id] = conn
+		}
+	})
+}
+
+func (st *AgentState) cachedConnection(connId int) (Connection, bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	conn, ok := st.Connections[connId]
+	return conn, ok
+}
+
+func (st *AgentState) trackTimedGrant(timed *TimedGrant) error {
+	return st.update(func() {
+		st.TimedGrants[timed.GrantId] = timed
+	})
+}
+
+func (st *AgentState) isTimedGrantTracked(grantId int) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	_, ok := st.TimedGrants[grantId]
+	return ok
+}
+
+func (st *AgentState) expiredTimedGrants(now time.Time) []*TimedGrant {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	var expired []*TimedGrant
+	for _, timed := range st.TimedGrants {
+		if !now.Before(timed.ValidUntil) {
+			expired = append(expired, timed)
+		}
+	}
+	return expired
+}
+
+// recordExpiry stops tracking the grant and queues an event for the next
+// checkin.
+func (st *AgentState) recordExpiry(event *ExpiryEvent) error {
+	return st.update(func() {
+		delete(st.TimedGrants, event.GrantId)
+		st.ExpiryEvents = append(st.ExpiryEvents, event)
+	})
+}
+
+func (st *AgentState) pendingExpiryEvents() []*ExpiryEvent {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return append([]*ExpiryEvent{}, st.ExpiryEvents...)
+}
+
+// clearExpiryEvents forgets the first n events once they have been reported.
+func (st *AgentState) clearExpiryEvents(n int) error {
+	return st.update(func() {
+		if n > len(st.ExpiryEvents) {
+			n = len(st.ExpiryEvents)
+		}
+		st.ExpiryEvents = st.ExpiryEvents[n:]
+	})
+}
+
+// cachedConnections returns every cached connection, ordered by connection
+// id.
+func (st *AgentState) cachedConnections() []Connection {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	conns := []Connection{}
+	for _, conn := range st.Connections {
+		conns = append(conns, conn)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Id < conns[j].Id
+	})
+	return conns
+}
+
+// cachedConnectionsForDatabase returns the cached connections of the
+// database with the given name, ordered by connection id.
+func (st *AgentState) cachedConnectionsForDatabase(name string) []Connection {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	var conns []Connection
+	for _, conn := range st.Connections {
+		if conn.Database.Name == name {
+			conns = append(conns, conn)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Id < conns[j].Id
+	})
+	return conns
+}
+
+func (st *AgentState) addTombstone(tombstone *Tombstone) error {
+	return st.update(func() {
+		st.Tombstones[userKey(tombstone.DatabaseId, tombstone.Username)] = tombstone
+	})
+}
+
+func (st *AgentState) tombstone(databaseId int, username string) *Tombstone {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.Tombstones[userKey(databaseId, username)]
+}
+
+func (st *AgentState) isTombstoned(databaseId int, username string) bool {
+	return st.tombstone(databaseId, username) != nil
+}
+
+// tombstoneKeys lists the users with a tombstone, in order.
+func (st *AgentState) tombstoneKeys() []string {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	keys := []string{}
+	for key := range st.Tombstones {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (st *AgentState) removeTombstone(databaseId int, username string) error {
+	return st.update(func() {
+		delete(st.Tombstones, userKey(databaseId, username))
+	})
+}
+
+func (st *AgentState) grantFingerprint(grantId int) *GrantFingerprint {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.Fingerprints[grantId]
+}
+
+// replaceGrantFingerprints stores the new fingerprints and forgets those of
+// grants that are not in keep.
+func (st *AgentState) replaceGrantFingerprints(fingerprints []*GrantFingerprint, keep map[int]bool) error {
+	return st.update(func() {
+		for grantId := range st.Fingerprints {
+			if !keep[grantId] {
+				delete(st.Fingerprints, grantId)
+			}
+		}
+		for _, fingerprint := range fingerprints {
+			st.Fingerprints[fingerprint.GrantId] = fingerprint
+		}
+	})
+}
+
+func (st *AgentState) localPassword(databaseId int, username string) *LocalPassword {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.Passwords[userKey(databaseId, username)]
+}
+
+func (st *AgentState) saveLocalPassword(password *LocalPassword) error {
+	return st.update(func() {
+		st.Passwords[userKey(password.DatabaseId, password.Username)] = password
+	})
+}
+
+func (st *AgentState) removeLocalPassword(databaseId int, username string) error {
+	if st.localPassword(databaseId, username) == nil {
+		return nil
+	}
+	return st.update(func() {
+		delete(st.Passwords, userKey(databaseId, username))
+	})
+}
+
+func (st *AgentState) hasUserExpiry(databaseId int, username string) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	_, ok := st.UserExpiries[userKey(databaseId, username)]
+	return ok
+}
+
+// setUserExpiry records the expiry set on the user, or that it was cleared
+// if validUntil is nil.
+func (st *AgentState) setUserExpiry(databaseId int, username string, validUntil *time.Time) error {
+	if validUntil == nil && !st.hasUserExpiry(databaseId, username) {
+		return nil
+	}
+	return st.update(func() {
+		if validUntil == nil {
+			delete(st.UserExpiries, userKey(databaseId, username))
+		} else {
+			st.UserExpiries[userKey(databaseId, username)] = *validUntil
+		}
+	})
+}
+
+// keyRotatedAt returns when the key was last rotated, recording the current
+// time if it is not known yet.
+func (st *AgentState) keyRotatedAt() (time.Time, error) {
+	st.mutex.Lock()
+	rotatedAt := st.KeyRotatedAt
+	st.mutex.Unlock()
+	if !rotatedAt.IsZero() {
+		return rotatedAt, nil
+	}
+	err := st.update(func() {
+		if st.KeyRotatedAt.IsZero() {
+			st.KeyRotatedAt = time.Now()
+		}
+		rotatedAt = st.KeyRotatedAt
+	})
+	return rotatedAt, err
+}
+
+func (st *AgentState) setKeyRotatedAt(rotatedAt time.Time) error {
+	return st.update(func() {
+		st.KeyRotatedAt = rotatedAt
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateSharedBetweenProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	server, err := loadAgentState(path)
+	assert.Nil(t, err)
+	assert.Nil(t, server.cacheConnections([]Connection{{Id: 1, Database: &Database{Id: 1}}}))
+
+	// The revoke-user command runs in its own process, with its own state.
+	command, err := loadAgentState(path)
+	assert.Nil(t, err)
+	assert.Nil(t, command.addTombstone(&Tombstone{DatabaseId: 1, Username: "bob"}))
+	assert.Nil(t, command.setKeyRotatedAt(time.Unix(1000, 0)))
+
+	// Changes of the server keep the tombstone, which it sees once reloaded.
+	assert.Nil(t, server.trackTimedGrant(&TimedGrant{GrantId: 5}))
+	assert.True(t, server.isTombstoned(1, "bob"))
+	assert.Nil(t, server.reload())
+	assert.True(t, server.isTombstoned(1, "bob"))
+	assert.Equal(t, time.Unix(1000, 0).Unix(), server.KeyRotatedAt.Unix())
+
+	assert.Nil(t, command.removeTombstone(1, "bob"))
+	assert.Nil(t, server.reload())
+	assert.False(t, server.isTombstoned(1, "bob"))
+	assert.True(t, server.isTimedGrantTracked(5))
+	_, ok := server.cachedConnection(1)
+	assert.True(t, ok)
+}
+
+func TestReloadStateForcesFullCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	state, err := loadAgentState(path)
+	assert.Nil(t, err)
+	app := &Application{conf: &Config{}, state: state, grantsEtag: `"1"`}
+	assert.Nil(t, app.reloadState())
+	assert.Equal(t, `"1"`, app.grantsEtag)
+
+	command, err := loadAgentState(path)
+	assert.Nil(t, err)
+	assert.Nil(t, command.addTombstone(&Tombstone{DatabaseId: 1, Username: "bob"}))
+	assert.Nil(t, app.reloadState())
+	assert.Equal(t, "", app.grantsEtag)
+}
+
+// expiryTestImpl records the expiries set, and must not be asked for
+// anything else.
+type expiryTestImpl struct {
+	DatabaseImpl
+	expiries []*time.Time
+}
+
+func (ei *expiryTestImpl) setValidUntil(user *User, validUntil *time.Time) error {
+	ei.expiries = append(ei.expiries, validUntil)
+	return nil
+}
+
+func TestUserExpiryOnlyClearedIfSet(t *testing.T) {
+	app := &Application{state: newAgentState("")}
+	fake := &expiryTestImpl{}
+	var impl DatabaseImpl = fake
+	user := &User{Username: "bob", DatabaseId: 1}
+	assert.Nil(t, applyUserExpiry(app, &impl, user, nil))
+	assert.Len(t, fake.expiries, 0)
+
+	validUntil := time.Unix(1000, 0)
+	assert.Nil(t, applyUserExpiry(app, &impl, user, &validUntil))
+	assert.True(t, app.state.hasUserExpiry(1, "bob"))
+	assert.Nil(t, applyUserExpiry(app, &impl, user, nil))
+	assert.Nil(t, applyUserExpiry(app, &impl, user, nil))
+	assert.Equal(t, []*time.Time{&validUntil, nil}, fake.expiries)
+	assert.False(t, app.state.hasUserExpiry(1, "bob"))
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Windows has no flock, so the lock file is created exclusively instead.
+// Locks left behind by crashed processes are broken once stale.
+const (
+	LOCK_FILE_STALE   = time.Minute
+	LOCK_FILE_TIMEOUT = 30 * time.Second
+)
+
+// lockFile takes an exclusive lock on a file next to the given one, and
+// returns the function releasing it.
+func lockFile(path string) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(LOCK_FILE_TIMEOUT)
+	for {
+		lock, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			lock.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > LOCK_FILE_STALE {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New(fmt.Sprintf("Timed out waiting for the lock %s", lockPath))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
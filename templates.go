@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	pglib "github.com/lib/pq"
+)
+
+// TemplateObject describes a database object such as a table or a function
+// in the context grant templates are rendered with. The "schema" and "name"
+// keys hold the raw, unquoted names so that they can be pattern matched.
+type TemplateObject map[string]interface{}
+
+func init() {
+	pongo2.RegisterFilter("like", filterLike)
+	pongo2.RegisterFilter("not_like", filterNotLike)
+	pongo2.RegisterFilter("in_schema", filterInSchema)
+	pongo2.RegisterFilter("not_in_schema", filterNotInSchema)
+	pongo2.RegisterFilter("quote_ident", filterQuoteIdent)
+	pongo2.RegisterFilter("quote_mysql_ident", filterQuoteMysqlIdent)
+}
+
+// likeRegexp converts a SQL LIKE pattern into an anchored regular
+// expression. As in SQL, % matches any sequence of characters, _ matches a
+// single character and a backslash escapes either of them.
+func likeRegexp(pattern string) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	buf.WriteString("^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			buf.WriteString(".*")
+		case r == '_':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+// unquoteIdent strips the quoting from identifiers such as the entries of
+// the "schemas" list, which are quoted before being put in the context.
+func unquoteIdent(ident string) string {
+	if len(ident) < 2 {
+		return ident
+	}
+	for _, quote := range []string{`"`, "`"} {
+		if strings.HasPrefix(ident, quote) && strings.HasSuffix(ident, quote) {
+			inner := ident[1 : len(ident)-1]
+			return strings.Replace(inner, quote+quote, quote, -1)
+		}
+	}
+	return ident
+}
+
+func templateFilterError(sender string, err error) *pongo2.Error {
+	return &pongo2.Error{Sender: "filter:" + sender, OrigError: err}
+}
+
+// filterByPattern keeps the items of a list for which the value of the given
+// key matches (or, if negate is set, does not match) the LIKE pattern.
+// Plain strings are matched as a whole.
+func filterByPattern(sender string, in *pongo2.Value, param *pongo2.Value,
+	key string, negate bool) (*pongo2.Value, *pongo2.Error) {
+	if !in.CanSlice() {
+		return nil, templateFilterError(sender, errors.New("Can only filter lists"))
+	}
+	re, err := likeRegexp(param.String())
+	if err != nil {
+		return nil, templateFilterError(sender, err)
+	}
+	var filtered []interface{}
+	for i := 0; i < in.Len(); i++ {
+		item := in.Index(i).Interface()
+		var value string
+		switch v := item.(type) {
+		case string:
+			value = unquoteIdent(v)
+		case TemplateObject:
+			value, _ = v[key].(string)
+		default:
+			return nil, templateFilterError(sender, errors.New("Unsupported list item"))
+		}
+		if re.MatchString(value) != negate {
+			filtered = append(filtered, item)
+		}
+	}
+	return pongo2.AsValue(filtered), nil
+}
+
+func filterLike(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	return filterByPattern("like", in, param, "name", false)
+}
+
+func filterNotLike(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	return filterByPattern("not_like", in, param, "name", true)
+}
+
+func filterInSchema(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	return filterByPattern("in_schema", in, param, "schema", false)
+}
+
+func filterNotInSchema(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	return filterByPattern("not_in_schema", in, param, "schema", true)
+}
+
+// quoteWith quotes an identifier, or every identifier in a list of them.
+func quoteWith(sender string, in *pongo2.Value,
+	quote func(string) string) (*pongo2.Value, *pongo2.Error) {
+	if in.IsString() {
+		return pongo2.AsValue(quote(in.String())), nil
+	}
+	if !in.CanSlice() {
+		return nil, templateFilterError(sender, errors.New("Can only quote strings"))
+	}
+	quoted := make([]string, in.Len())
+	for i := 0; i < in.Len(); i++ {
+		quoted[i] = quote(in.Index(i).String())
+	}
+	return pongo2.AsValue(quoted), nil
+}
+
+func filterQuoteIdent(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	return quoteWith("quote_ident", in, pglib.QuoteIdentifier)
+}
+
+func filterQuoteMysqlIdent(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	return quoteWith("quote_mysql_ident", in, mysqlQuoteIdent)
+}
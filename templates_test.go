@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/flosch/pongo2"
+	"github.com/stretchr/testify/assert"
+)
+
+func renderTestTemplate(t *testing.T, tpl string, ctx pongo2.Context) string {
+	pongo2.SetAutoescape(false)
+	compiled, err := pongo2.FromString(tpl)
+	assert.Nil(t, err)
+	rendered, err := compiled.Execute(ctx)
+	assert.Nil(t, err)
+	return rendered
+}
+
+func TestLikeRegexp(t *testing.T) {
+	re, err := likeRegexp(`report\_%`)
+	assert.Nil(t, err)
+	assert.True(t, re.MatchString("report_q1"))
+	assert.False(t, re.MatchString("reportq1"))
+	assert.False(t, re.MatchString("x_report_q1"))
+	re, err = likeRegexp("a_c.%")
+	assert.Nil(t, err)
+	assert.True(t, re.MatchString("abc.d"))
+	assert.False(t, re.MatchString("abcxd"))
+}
+
+func TestTemplateFilters(t *testing.T) {
+	obj := func(schema string, name string) TemplateObject {
+		return TemplateObject{"schema": schema, "name": name, "columns": []string{"a", `b"c`}}
+	}
+	ctx := pongo2.Context{
+		"schemas": []string{`"report_q1"`, `"public"`},
+		"tables": []TemplateObject{
+			obj("report_q1", "sales"),
+			obj("report_q1", "sales_pii"),
+			obj("public", "sales"),
+		},
+	}
+	rendered := renderTestTemplate(t,
+		`{% for t in tables|in_schema:"report_%"|not_like:"%_pii" %}{{ t.schema }}.{{ t.name }};{% endfor %}`, ctx)
+	assert.Equal(t, "report_q1.sales;", rendered)
+	rendered = renderTestTemplate(t, `{{ schemas|like:"rep%"|join:"," }}`, ctx)
+	assert.Equal(t, `"report_q1"`, rendered)
+	rendered = renderTestTemplate(t,
+		`{% for t in tables|not_in_schema:"report_%" %}{{ t.columns|quote_ident|join:"," }}{% endfor %}`, ctx)
+	assert.Equal(t, `"a","b""c"`, rendered)
+	rendered = renderTestTemplate(t, `{{ "my table"|quote_ident }}`, ctx)
+	assert.Equal(t, `"my table"`, rendered)
+	rendered = renderTestTemplate(t, "{{ \"my`table\"|quote_mysql_ident }}", ctx)
+	assert.Equal(t, "`my``table`", rendered)
+}
@@ -0,0 +1,73 @@
+package main
+
+// knownUsernames lists the managed users and roles of a database.
+func knownUsernames(gr *GrantsResponse, databaseId int) map[string]bool {
+	known := gr.usernamesForDatabase(databaseId)
+	for _, role := range gr.Roles {
+		if role.DatabaseId == databaseId {
+			known[role.Name] = true
+		}
+	}
+	return known
+}
+
+// isUnmanagedAccount tells whether the account is neither managed nor
+// ignored. Managed MySQL users always have the agent host, so the same
+// username with another host is still reported.
+func isUnmanagedAccount(app *Application, conn *Connection, known map[string]bool, account *DbAccount) bool {
+	if account.Username == conn.Database.Username || app.conf.IgnoredUsers[account.Username] {
+		return false
+	}
+	if app.state.isTombstoned(conn.Database.Id, account.Username) {
+		return false
+	}
+	if account.Host != "" && account.Host != MYSQL_USER_HOST {
+		return true
+	}
+	return !known[account.Username]
+}
+
+// findUnmanagedUsers lists the accounts of every database that DbRhino does
+// not know about, and locks them if configured to. Accounts are global to a
+// database server, so only its default connection is looked at.
+func findUnmanagedUsers(app *Application, gr *GrantsResponse, connRegistry ConnRegistry) []*UnmanagedUser {
+	unmanaged := []*UnmanagedUser{}
+	for _, databaseId := range gr.databaseIds() {
+		conn, err := gr.defaultConnection(databaseId)
+		if err != nil {
+			continue
+		}
+		regItem := connRegistry[conn.Id]
+		if regItem == nil || regItem.Error != nil {
+			continue
+		}
+		accounts, err := regItem.Impl.listAccounts()
+		if err != nil {
+			logger.Errorf("(%s) Could not list accounts: %s", regItem.Impl.getName(), err)
+			continue
+		}
+		known := knownUsernames(gr, databaseId)
+		for _, account := range accounts {
+			if !isUnmanagedAccount(app, conn, known, account) {
+				continue
+			}
+			user := &UnmanagedUser{
+				DatabaseId: databaseId,
+				Username:   account.Username,
+				Host:       account.Host,
+			}
+			logger.Warningf("(%s) Found unmanaged user %s", regItem.Impl.getName(), account.Username)
+			if app.conf.UnmanagedUsers == UNMANAGED_USERS_LOCK {
+				if err := regItem.Impl.lockAccount(account); err != nil {
+					logger.Errorf("(%s) Could not lock unmanaged user %s: %s",
+						regItem.Impl.getName(), account.Username, err)
+					user.ErrorStr = err.Error()
+				} else {
+					user.Locked = true
+				}
+			}
+			unmanaged = append(unmanaged, user)
+		}
+	}
+	return unmanaged
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+)
+
+// Tokens obtained through AppRole are renewed this long before they expire.
+const VAULT_TOKEN_RENEW_MARGIN = time.Minute
+
+// VaultSink writes credentials to a KV version 2 secrets engine of Vault.
+type VaultSink struct {
+	conf   *VaultConfig
+	client *http.Client
+	mutex  sync.Mutex
+	// token is the one obtained through AppRole, valid until tokenExpiry.
+	token       string
+	tokenExpiry time.Time
+}
+
+func newVaultSink(conf *VaultConfig) (*VaultSink, error) {
+	client, err := newHttpClient(&conf.Http)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid Vault client settings: %s", err))
+	}
+	return &VaultSink{conf: conf, client: client}, nil
+}
+
+func (vs *VaultSink) getName() string {
+	return "vault"
+}
+
+type vaultAppRoleLogin struct {
+	RoleId   string `json:"role_id"`
+	SecretId string `json:"secret_id,omitempty"`
+}
+
+type vaultAuthResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+func (vs *VaultSink) request(method string, path string, token string,
+	payload interface{}, result interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	// The body may hold a password.
+	defer wipeBytes(body)
+	req, err := http.NewRequest(method, vs.conf.Addr+"/v1/"+path, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if vs.conf.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vs.conf.Namespace)
+	}
+	_, err = doRequest(vs.client, req, nil, result)
+	return err
+}
+
+// getToken returns the configured token, or logs in with AppRole when there
+// is none or the previous token is about to expire.
+func (vs *VaultSink) getToken() (string, error) {
+	if vs.conf.Token != "" {
+		return vs.conf.Token, nil
+	}
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	if vs.token != "" && time.Now().Before(vs.tokenExpiry) {
+		return vs.token, nil
+	}
+	result := &vaultAuthResponse{}
+	login := vaultAppRoleLogin{RoleId: vs.conf.RoleId, SecretId: vs.conf.SecretId}
+	path := "auth/" + vs.conf.AppRoleMount + "/login"
+	if err := vs.request(http.MethodPost, path, "", login, result); err != nil {
+		return "", errors.New(fmt.Sprintf("Vault AppRole login failed: %s", err))
+	}
+	if result.Auth.ClientToken == "" {
+		return "", errors.New("Vault AppRole login returned no token")
+	}
+	vs.token = result.Auth.ClientToken
+	lifetime := time.Duration(result.Auth.LeaseDuration) * time.Second
+	vs.tokenExpiry = time.Now().Add(lifetime - VAULT_TOKEN_RENEW_MARGIN)
+	return vs.token, nil
+}
+
+func (vs *VaultSink) forgetToken() {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	vs.token = ""
+}
+
+// secretPath renders the path template of the credential, with the same
+// syntax as grant templates.
+func (vs *VaultSink) secretPath(cred *Credential) (string, error) {
+	pongo2.SetAutoescape(false)
+	tpl, err := pongo2.FromString(vs.conf.PathTemplate)
+	if err != nil {
+		return "", err
+	}
+	path, err := tpl.Execute(pongo2.Context{
+		"database_id":   cred.DatabaseId,
+		"database_name": cred.DatabaseName,
+		"db_name":       cred.DbName,
+		"username":      cred.Username,
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(strings.TrimSpace(path), "/"), nil
+}
+
+type vaultKvWrite struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+func (vs *VaultSink) deliver(cred *Credential) error {
+	path, err := vs.secretPath(cred)
+	if err != nil {
+		return err
+	}
+	payload := vaultKvWrite{Data: map[string]interface{}{
+		"username": cred.Username,
+		"password": cred.Password.unsafeString(),
+		"host":     cred.Host,
+		"port":     cred.Port,
+		"database": cred.DbName,
+	}}
+	fullPath := vs.conf.Mount + "/data/" + path
+	var result interface{}
+	for attempt := 0; ; attempt++ {
+		token, err := vs.getToken()
+		if err != nil {
+			return err
+		}
+		err = vs.request(http.MethodPost, fullPath, token, payload, &result)
+		// An AppRole token may have been revoked early, in which case
+		// logging in again is worth one more try.
+		var statusErr *HttpStatusError
+		if attempt == 0 && vs.conf.Token == "" && errors.As(err, &statusErr) &&
+			statusErr.StatusCode == http.StatusForbidden {
+			vs.forgetToken()
+			continue
+		}
+		return err
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeVault struct {
+	logins  int
+	revoked bool
+	writes  map[string]map[string]interface{}
+}
+
+func (fv *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/auth/approle/login":
+		var login vaultAppRoleLogin
+		json.NewDecoder(r.Body).Decode(&login)
+		if login.RoleId != "role" || login.SecretId != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fv.logins++
+		w.Write([]byte(`{"auth": {"client_token": "approle-token", "lease_duration": 3600}}`))
+	case r.Header.Get("X-Vault-Token") != "approle-token" || fv.revoked:
+		fv.revoked = false
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors": ["permission denied"]}`))
+	default:
+		var payload vaultKvWrite
+		json.NewDecoder(r.Body).Decode(&payload)
+		fv.writes[r.URL.Path] = payload.Data
+		w.Write([]byte(`{"data": {"version": 1}}`))
+	}
+}
+
+func testCredential() *Credential {
+	return &Credential{
+		DatabaseId:   1,
+		DatabaseName: "pg_test",
+		Host:         "db.example.com",
+		Port:         5432,
+		DbName:       "app",
+		Username:     "bob",
+		Password:     newSecret([]byte("s3cret")),
+	}
+}
+
+func TestVaultSinkWithAppRole(t *testing.T) {
+	fv := &fakeVault{writes: map[string]map[string]interface{}{}}
+	server := httptest.NewServer(fv)
+	defer server.Close()
+	sink, err := newVaultSink(&VaultConfig{
+		Addr:         server.URL,
+		RoleId:       "role",
+		SecretId:     "secret",
+		AppRoleMount: DEFAULT_VAULT_APPROLE_MOUNT,
+		Mount:        DEFAULT_VAULT_MOUNT,
+		PathTemplate: DEFAULT_VAULT_PATH,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, sink.deliver(testCredential()))
+	data := fv.writes["/v1/secret/data/dbrhino/pg_test/bob"]
+	assert.Equal(t, "s3cret", data["password"])
+	assert.Equal(t, "db.example.com", data["host"])
+	assert.Equal(t, float64(5432), data["port"])
+	assert.Equal(t, "app", data["database"])
+
+	fv.revoked = true
+	assert.Nil(t, sink.deliver(testCredential()))
+	assert.Equal(t, 2, fv.logins)
+}
+
+func TestVaultSinkWithBadToken(t *testing.T) {
+	fv := &fakeVault{writes: map[string]map[string]interface{}{}}
+	server := httptest.NewServer(fv)
+	defer server.Close()
+	sink, err := newVaultSink(&VaultConfig{
+		Addr:         server.URL,
+		Token:        "wrong",
+		Mount:        DEFAULT_VAULT_MOUNT,
+		PathTemplate: "{{ database_id }}/{{ username }}",
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, sink.deliver(testCredential()))
+	assert.Equal(t, 0, fv.logins)
+}
+
+// TestVaultDevServer writes to a real Vault, such as one started with
+// "vault server -dev", when DBRHINO_TEST_VAULT_ADDR and
+// DBRHINO_TEST_VAULT_TOKEN are set.
+func TestVaultDevServer(t *testing.T) {
+	addr := os.Getenv("DBRHINO_TEST_VAULT_ADDR")
+	if addr == "" {
+		t.Skip("DBRHINO_TEST_VAULT_ADDR is not set")
+	}
+	sink, err := newVaultSink(&VaultConfig{
+		Addr:         addr,
+		Token:        os.Getenv("DBRHINO_TEST_VAULT_TOKEN"),
+		Mount:        DEFAULT_VAULT_MOUNT,
+		PathTemplate: DEFAULT_VAULT_PATH,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, sink.deliver(testCredential()))
+}